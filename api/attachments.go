@@ -0,0 +1,348 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"html"
+	"image"
+	_ "image/gif" // register decoders for thumbnails
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"jj/logging"
+	"jj/models"
+	"jj/storage"
+	"jj/store"
+
+	"github.com/google/uuid"
+)
+
+const (
+	thumbnailMaxDimension = 200
+	maxImagePixels        = 40_000_000 // refuse to decode larger images for thumbnails
+
+	// pendingAttachmentMaxAge is how long an upload may wait to be sent
+	// with a message before the retention job removes it.
+	pendingAttachmentMaxAge = 24 * time.Hour
+)
+
+// allowedAttachmentTypes are the sniffed content types accepted for upload.
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// Errors about the attachments of a message; their text is safe to show to users.
+var (
+	ErrTooManyAttachments = errors.New("too many attachments")
+	ErrAttachmentNotFound = store.ErrAttachmentNotFound
+)
+
+// Files is where uploaded attachments are stored. main sets it at startup.
+var Files storage.Storage
+
+// Attachment describes an uploaded file as returned to clients.
+type Attachment struct {
+	ID           string `json:"id"`
+	FileName     string `json:"fileName"`
+	ContentType  string `json:"contentType"`
+	Size         int64  `json:"size"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+}
+
+func newAttachment(id, fileName, contentType string, size int64, hasThumbnail bool) Attachment {
+	a := Attachment{
+		ID:          id,
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        size,
+		URL:         "/api/attachments/" + id,
+	}
+	if hasThumbnail {
+		a.ThumbnailURL = a.URL + "?thumbnail=1"
+	}
+	return a
+}
+
+// UploadAttachmentHandler stores an uploaded file and returns its attachment ID,
+// which the uploader can then reference from a private_message payload.
+func UploadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+	if Files == nil {
+		RespondWithError(w, http.StatusServiceUnavailable, "Attachments are disabled")
+		return
+	}
+
+	// Leave room for the multipart framing around the file itself
+	r.Body = http.MaxBytesReader(w, r.Body, int64(conf.Limits.AttachmentBytes)+64<<10)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			RespondWithError(w, http.StatusRequestEntityTooLarge, "File too large")
+			return
+		}
+		RespondWithError(w, http.StatusBadRequest, "Missing file")
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(conf.Limits.AttachmentBytes)+1))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Failed to read file")
+		return
+	}
+	if len(data) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "Empty file")
+		return
+	}
+	if len(data) > conf.Limits.AttachmentBytes {
+		RespondWithError(w, http.StatusRequestEntityTooLarge, "File too large")
+		return
+	}
+
+	// Trust the bytes, not the client-supplied Content-Type
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !allowedAttachmentTypes[contentType] {
+		RespondWithError(w, http.StatusUnsupportedMediaType, "Unsupported file type")
+		return
+	}
+
+	fileName := strings.TrimSpace(filepath.Base(header.Filename))
+	if fileName == "" || fileName == "." || fileName == "/" {
+		fileName = "file"
+	}
+	if len(fileName) > 100 {
+		fileName = fileName[:100]
+	}
+	fileName = models.Skip(fileName)
+
+	id := uuid.New().String()
+	if _, err := Files.Save(id, bytes.NewReader(data)); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to store attachment", "attachment_id", id, "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to store file")
+		return
+	}
+
+	var thumbnailKey string
+	if strings.HasPrefix(contentType, "image/") {
+		if thumb, err := makeThumbnail(data); err == nil {
+			if _, err := Files.Save(id+"_thumb", bytes.NewReader(thumb)); err == nil {
+				thumbnailKey = id + "_thumb"
+			} else {
+				logging.FromContext(r.Context()).Error("Failed to store thumbnail", "attachment_id", id, "error", err)
+			}
+		}
+	}
+
+	err = Stores.Attachments.Create(r.Context(), store.NewAttachment{
+		ID:           id,
+		UploaderID:   userID,
+		FileName:     fileName,
+		ContentType:  contentType,
+		Size:         int64(len(data)),
+		StorageKey:   id,
+		ThumbnailKey: thumbnailKey,
+	})
+	if err != nil {
+		Files.Delete(id)
+		if thumbnailKey != "" {
+			Files.Delete(thumbnailKey)
+		}
+		RespondWithError(w, http.StatusInternalServerError, "Failed to save attachment")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, newAttachment(id, fileName, contentType, int64(len(data)), thumbnailKey != ""))
+}
+
+// GetAttachmentHandler streams an attachment (or its thumbnail with
+// ?thumbnail=1). Only the uploader and the participants of the message it
+// is attached to may fetch it.
+func GetAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	// No Accept check here: browsers request these from <img> tags.
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+	if Files == nil {
+		RespondWithError(w, http.StatusServiceUnavailable, "Attachments are disabled")
+		return
+	}
+
+	a, err := Stores.Attachments.Get(r.Context(), r.PathValue("id"), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			// Same answer for "missing" and "not yours", so IDs can't be probed
+			RespondWithError(w, http.StatusNotFound, "Attachment not found")
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch attachment")
+		return
+	}
+
+	key, contentType := a.StorageKey, a.ContentType
+	if r.URL.Query().Get("thumbnail") != "" {
+		if a.ThumbnailKey == "" {
+			RespondWithError(w, http.StatusNotFound, "Thumbnail not found")
+			return
+		}
+		key, contentType = a.ThumbnailKey, "image/png"
+	}
+
+	f, err := Files.Open(key)
+	if err != nil {
+		RespondWithError(w, http.StatusNotFound, "Attachment not found")
+		return
+	}
+	defer f.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": html.UnescapeString(a.FileName)}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", a.CreatedAt, rs)
+		return
+	}
+	io.Copy(w, f)
+}
+
+// Attachments converts attachments stored with a message into what clients get.
+func Attachments(infos []store.AttachmentInfo) []Attachment {
+	attachments := make([]Attachment, len(infos))
+	for i, a := range infos {
+		attachments[i] = newAttachment(a.ID, a.FileName, a.ContentType, a.Size, a.HasThumbnail)
+	}
+	return attachments
+}
+
+// LoadMessageAttachments returns the attachments of the given messages, keyed by message ID.
+func LoadMessageAttachments(ctx context.Context, messageIDs []string) (map[string][]Attachment, error) {
+	infos, err := Stores.Attachments.ForMessages(ctx, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]Attachment, len(infos))
+	for messageID, list := range infos {
+		result[messageID] = Attachments(list)
+	}
+	return result, nil
+}
+
+// DeleteMessageAttachments removes the files and rows of a message's attachments.
+func DeleteMessageAttachments(ctx context.Context, messageID string) error {
+	keys, err := Stores.Attachments.DeleteForMessage(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if Files != nil {
+		for _, key := range keys {
+			if err := Files.Delete(key); err != nil {
+				logging.FromContext(ctx).Error("Failed to delete stored file", "key", key, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// PurgePendingAttachments removes the files and rows of uploads that were
+// never attached to a message within pendingAttachmentMaxAge, in batches
+// of purgeBatchSize. It returns how many uploads were removed.
+func PurgePendingAttachments(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, keys, err := Stores.Attachments.DeletePending(ctx, pendingAttachmentMaxAge, purgeBatchSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if Files != nil {
+			for _, key := range keys {
+				if err := Files.Delete(key); err != nil {
+					logging.FromContext(ctx).Error("Failed to delete stored file", "key", key, "error", err)
+				}
+			}
+		}
+		if n < purgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// makeThumbnail decodes an image and scales it down so that its longest
+// side is at most thumbnailMaxDimension, encoded as PNG.
+func makeThumbnail(data []byte) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errors.New("image too large to thumbnail")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil, errors.New("empty image")
+	}
+	scale := 1.0
+	if w > h && w > thumbnailMaxDimension {
+		scale = float64(thumbnailMaxDimension) / float64(w)
+	} else if h >= w && h > thumbnailMaxDimension {
+		scale = float64(thumbnailMaxDimension) / float64(h)
+	}
+	tw, th := max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+
+	// Nearest-neighbour sampling is plenty for a preview
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		sy := b.Min.Y + y*h/th
+		for x := 0; x < tw; x++ {
+			dst.Set(x, y, src.At(b.Min.X+x*w/tw, sy))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"jj/logging"
+	"jj/models"
+	"jj/store"
+)
+
+// Kinds of relation one user can set on another.
+const (
+	// RelationBlock stops all direct contact in both directions and hides
+	// the two users from each other's user and online lists.
+	RelationBlock = store.RelationBlock
+	// RelationMute only collapses the muted user's posts and comments.
+	RelationMute = store.RelationMute
+)
+
+// IsBlocked reports whether either user has blocked the other.
+func IsBlocked(ctx context.Context, userA, userB string) (bool, error) {
+	return Stores.Relations.Blocked(ctx, userA, userB)
+}
+
+// BlockedUserIDs returns every user that userID has blocked or been blocked by.
+func BlockedUserIDs(ctx context.Context, userID string) (map[string]bool, error) {
+	return Stores.Relations.BlockedIDs(ctx, userID)
+}
+
+// CollapsedAuthorIDs returns the users whose posts and comments userID
+// wants collapsed: everyone they muted or blocked.
+func CollapsedAuthorIDs(ctx context.Context, userID string) (map[string]bool, error) {
+	if userID == "" {
+		return map[string]bool{}, nil
+	}
+	return Stores.Relations.TargetIDs(ctx, userID)
+}
+
+// collapsedAuthorsFor returns CollapsedAuthorIDs for the requesting user,
+// or an empty set for anonymous requests and lookup failures.
+func collapsedAuthorsFor(r *http.Request) map[string]bool {
+	userID, err := authenticateUser(r)
+	if err != nil {
+		return map[string]bool{}
+	}
+	ids, err := CollapsedAuthorIDs(r.Context(), userID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to load muted users", "error", err)
+		return map[string]bool{}
+	}
+	return ids
+}
+
+// BlockUserHandler blocks a user for the current user.
+func BlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateRelation(w, r, RelationBlock, true)
+}
+
+// UnblockUserHandler removes a block set by the current user.
+func UnblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateRelation(w, r, RelationBlock, false)
+}
+
+// MuteUserHandler mutes a user for the current user.
+func MuteUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateRelation(w, r, RelationMute, true)
+}
+
+// UnmuteUserHandler removes a mute set by the current user.
+func UnmuteUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateRelation(w, r, RelationMute, false)
+}
+
+// updateRelation adds or removes a block/mute from the current user to the
+// user given in the request body.
+func updateRelation(w http.ResponseWriter, r *http.Request, kind string, add bool) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	var req struct {
+		UserID string `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	if req.UserID == "" || req.UserID == userID {
+		RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := Stores.Relations.Set(r.Context(), userID, req.UserID, kind, add); err != nil {
+		// The only foreign key that can fail here is the target user
+		RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	// Keep the user's other tabs in sync; the other side is not told.
+	NotifyUsers([]string{userID}, "blocks_updated", map[string]interface{}{
+		"userId": req.UserID,
+		"kind":   kind,
+		"active": add,
+	})
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Updated successfully"})
+}
+
+// GetBlockedUsersHandler lists the users the current user has blocked and muted.
+func GetBlockedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	relations, err := Stores.Relations.List(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch blocked users")
+		return
+	}
+
+	result := map[string][]models.User{
+		"blocked": {},
+		"muted":   {},
+	}
+	for _, rel := range relations {
+		if rel.Kind == RelationBlock {
+			result["blocked"] = append(result["blocked"], rel.User)
+		} else {
+			result["muted"] = append(result["muted"], rel.User)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, result)
+}
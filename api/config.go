@@ -0,0 +1,20 @@
+package api
+
+import (
+	"jj/config"
+	"jj/store"
+)
+
+// conf holds the limits and settings the handlers enforce. It starts with
+// the defaults so the package works before Configure is called.
+var conf = config.Default()
+
+// Configure sets the configuration used by the handlers. It must be called
+// before the server starts.
+func Configure(c *config.Config) {
+	conf = c
+}
+
+// Stores holds users, sessions, posts, comments and private messages. main
+// sets it at startup to the backend chosen by the configuration.
+var Stores store.Store
@@ -0,0 +1,482 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"jj/logging"
+	"jj/models"
+	"jj/store"
+
+	"github.com/google/uuid"
+)
+
+// NotifyUsers pushes a realtime event to every connection of the given users.
+// It is a no-op until main wires it to the websocket hub.
+var NotifyUsers = func(userIDs []string, eventType string, payload interface{}) {}
+
+// Group is a named conversation with any number of members.
+type Group struct {
+	ID            string        `json:"id"`
+	Name          string        `json:"name"`
+	CreatedBy     string        `json:"createdBy"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	Members       []models.User `json:"members"`
+	UnreadCount   int           `json:"unreadCount"`
+	LastMessageAt *time.Time    `json:"lastMessageAt"`
+}
+
+// ConversationSummary describes the current user's 1:1 conversation with another user.
+type ConversationSummary struct {
+	models.User
+	IsOnline    bool                `json:"isOnline"`
+	LastMessage *LastMessagePreview `json:"lastMessage"`
+	UnreadCount int                 `json:"unreadCount"`
+}
+
+// LastMessagePreview is the most recent message of a conversation.
+type LastMessagePreview struct {
+	ID        string    `json:"id"`
+	SenderID  string    `json:"senderId"`
+	Preview   string    `json:"preview"`
+	Timestamp time.Time `json:"timestamp"`
+	IsDeleted bool      `json:"isDeleted"`
+	// IsEncrypted marks Preview as e2ee ciphertext.
+	IsEncrypted bool `json:"isEncrypted"`
+}
+
+// IsConversationMember reports whether userID belongs to the group conversation.
+func IsConversationMember(ctx context.Context, conversationID, userID string) (bool, error) {
+	return Stores.Groups.IsMember(ctx, conversationID, userID)
+}
+
+// ConversationMemberIDs returns the user IDs of every member of a group conversation.
+func ConversationMemberIDs(ctx context.Context, conversationID string) ([]string, error) {
+	return Stores.Groups.MemberIDs(ctx, conversationID)
+}
+
+// loadGroup fetches a group with its members, as seen by userID.
+func loadGroup(ctx context.Context, conversationID, userID string) (Group, error) {
+	g, err := Stores.Groups.Get(ctx, conversationID, userID)
+	return Group(g), err
+}
+
+// notifyGroupUpdated sends the current state of a group to its members and
+// to anyone who just left it.
+func notifyGroupUpdated(ctx context.Context, conversationID string, extraUserIDs ...string) {
+	memberIDs, err := ConversationMemberIDs(ctx, conversationID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load conversation members", "conversation_id", conversationID, "error", err)
+		return
+	}
+	payload := map[string]interface{}{"conversationId": conversationID}
+	if len(memberIDs) > 0 {
+		if g, err := loadGroup(ctx, conversationID, ""); err == nil {
+			payload["name"] = g.Name
+			payload["members"] = g.Members
+		}
+	}
+	NotifyUsers(append(memberIDs, extraUserIDs...), "conversation_updated", payload)
+}
+
+// validGroupName trims and checks a group name, returning the sanitized form.
+func validGroupName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if len(name) < 2 || len(name) > 30 {
+		return "", false
+	}
+	return models.Skip(name), true
+}
+
+// GetGroupsHandler lists the group conversations the current user belongs to.
+func GetGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	list, err := Stores.Groups.List(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch conversations")
+		return
+	}
+
+	groups := make([]Group, len(list))
+	for i, g := range list {
+		groups[i] = Group(g)
+	}
+
+	respondWithJSON(w, http.StatusOK, groups)
+}
+
+// CreateGroupHandler creates a group conversation with the current user and
+// the given members, none of whom may be in a block relation with another.
+func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	var req struct {
+		Name      string   `json:"name"`
+		MemberIDs []string `json:"memberIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	name, ok := validGroupName(req.Name)
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, "Group name must be 2 to 30 characters")
+		return
+	}
+
+	members := map[string]bool{userID: true}
+	for _, id := range req.MemberIDs {
+		members[id] = true
+	}
+	if len(members) > conf.Limits.GroupMembers {
+		RespondWithError(w, http.StatusBadRequest, "Too many members")
+		return
+	}
+	memberIDs := make([]string, 0, len(members))
+	for id := range members {
+		memberIDs = append(memberIDs, id)
+	}
+	// Blocks rule out any direct contact, a shared group included
+	for _, id := range memberIDs {
+		if blocked, err := blockedAmong(r.Context(), id, memberIDs); err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to create conversation")
+			return
+		} else if blocked {
+			RespondWithError(w, http.StatusForbidden, "You cannot add this user")
+			return
+		}
+	}
+	conversationID := uuid.New().String()
+	if err := Stores.Groups.Create(r.Context(), conversationID, name, userID, memberIDs); err != nil {
+		// Any member who doesn't exist fails the foreign key
+		RespondWithError(w, http.StatusBadRequest, "Unknown member")
+		return
+	}
+
+	notifyGroupUpdated(r.Context(), conversationID)
+	respondWithJSON(w, http.StatusCreated, map[string]string{
+		"message":         "Conversation created successfully",
+		"conversation_id": conversationID,
+	})
+}
+
+// RenameGroupHandler renames a group conversation the current user belongs to.
+func RenameGroupHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	var req struct {
+		ConversationID string `json:"conversationId"`
+		Name           string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	name, ok := validGroupName(req.Name)
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, "Group name must be 2 to 30 characters")
+		return
+	}
+	if !requireMembership(r.Context(), w, req.ConversationID, userID) {
+		return
+	}
+
+	if err := Stores.Groups.Rename(r.Context(), req.ConversationID, name); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to rename conversation")
+		return
+	}
+
+	notifyGroupUpdated(r.Context(), req.ConversationID)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Conversation renamed successfully"})
+}
+
+// LeaveGroupHandler removes the current user from a group conversation.
+// The conversation is deleted once its last member leaves.
+func LeaveGroupHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	var req struct {
+		ConversationID string `json:"conversationId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	if !requireMembership(r.Context(), w, req.ConversationID, userID) {
+		return
+	}
+
+	if err := Stores.Groups.RemoveMember(r.Context(), req.ConversationID, userID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to leave conversation")
+		return
+	}
+
+	notifyGroupUpdated(r.Context(), req.ConversationID, userID)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Left conversation successfully"})
+}
+
+// AddGroupMemberHandler adds a user to a group conversation the current user
+// belongs to, unless they are in a block relation with one of its members.
+func AddGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	var req struct {
+		ConversationID string `json:"conversationId"`
+		UserID         string `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	if req.UserID == "" {
+		RespondWithError(w, http.StatusBadRequest, "Missing user ID")
+		return
+	}
+	if !requireMembership(r.Context(), w, req.ConversationID, userID) {
+		return
+	}
+
+	memberIDs, err := ConversationMemberIDs(r.Context(), req.ConversationID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to add member")
+		return
+	}
+	if len(memberIDs) >= conf.Limits.GroupMembers {
+		RespondWithError(w, http.StatusBadRequest, "Too many members")
+		return
+	}
+
+	if _, err := Stores.Users.ByID(r.Context(), req.UserID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			RespondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	if blocked, err := blockedAmong(r.Context(), req.UserID, memberIDs); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return
+	} else if blocked {
+		RespondWithError(w, http.StatusForbidden, "You cannot add this user")
+		return
+	}
+
+	if err := Stores.Groups.AddMember(r.Context(), req.ConversationID, req.UserID); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to add member")
+		return
+	}
+
+	notifyGroupUpdated(r.Context(), req.ConversationID)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Member added successfully"})
+}
+
+// blockedAmong reports whether userID is in a block relation with any of
+// memberIDs.
+func blockedAmong(ctx context.Context, userID string, memberIDs []string) (bool, error) {
+	blocked, err := BlockedUserIDs(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range memberIDs {
+		if blocked[id] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// requireMembership writes an error response and returns false unless
+// userID is a member of the conversation.
+func requireMembership(ctx context.Context, w http.ResponseWriter, conversationID, userID string) bool {
+	if conversationID == "" {
+		RespondWithError(w, http.StatusBadRequest, "Missing conversation ID")
+		return false
+	}
+	ok, err := IsConversationMember(ctx, conversationID, userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Database error")
+		return false
+	}
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, "Conversation not found")
+		return false
+	}
+	return true
+}
+
+// getGroupMessages writes one page of a group conversation, oldest first.
+func getGroupMessages(ctx context.Context, w http.ResponseWriter, userID, conversationID string, limit, offset int) {
+	if !requireMembership(ctx, w, conversationID, userID) {
+		return
+	}
+
+	// Per-member read positions, used to report who has read each message
+	readState, err := Stores.Groups.ReadPositions(ctx, conversationID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch messages")
+		return
+	}
+	page, err := Stores.Groups.Messages(ctx, conversationID, limit, offset)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch messages")
+		return
+	}
+
+	type Message struct {
+		ID             string    `json:"id"`
+		ConversationID string    `json:"conversationId"`
+		SenderId       string    `json:"senderId"`
+		Content        string    `json:"content"`
+		Timestamp      time.Time `json:"timestamp"`
+		Sender         string    `json:"sender"`
+		IsRead         bool      `json:"isRead"`
+		ReadBy         []string  `json:"readBy"`
+	}
+
+	var messages []Message
+	for _, m := range page {
+		msg := Message{
+			ID:             m.ID,
+			ConversationID: conversationID,
+			SenderId:       m.SenderID,
+			Content:        m.Content,
+			Timestamp:      m.CreatedAt,
+			Sender:         m.Sender,
+			ReadBy:         []string{},
+		}
+		for memberID, lastRead := range readState {
+			if memberID != msg.SenderId && lastRead >= m.Seq {
+				msg.ReadBy = append(msg.ReadBy, memberID)
+			}
+		}
+		msg.IsRead = msg.SenderId == userID || readState[userID] >= m.Seq
+		messages = append(messages, msg)
+	}
+
+	respondWithJSON(w, http.StatusOK, messages)
+}
+
+// GetConversationsHandler lists every other user together with the last
+// private message exchanged with them and how many of their messages are
+// still unread, most recent conversation first. It replaces fetching the
+// user list and then each conversation separately.
+func GetConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	list, err := Stores.Messages.Conversations(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch conversations")
+		return
+	}
+	blocked, err := BlockedUserIDs(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch conversations")
+		return
+	}
+
+	conversations := []ConversationSummary{}
+	for _, c := range list {
+		if blocked[c.ID] {
+			continue
+		}
+		summary := ConversationSummary{User: c.User, IsOnline: c.IsOnline, UnreadCount: c.UnreadCount}
+		if m := c.LastMessage; m != nil {
+			summary.LastMessage = &LastMessagePreview{
+				ID:          m.ID,
+				SenderID:    m.SenderID,
+				Preview:     m.Content,
+				Timestamp:   m.CreatedAt,
+				IsDeleted:   m.IsDeleted,
+				IsEncrypted: m.IsEncrypted,
+			}
+		}
+		conversations = append(conversations, summary)
+	}
+
+	respondWithJSON(w, http.StatusOK, conversations)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"jj/store"
+)
+
+func TestGroupsRefuseBlockedMembers(t *testing.T) {
+	st := memStore()
+	useStore(t, st)
+
+	ids := map[string]string{}
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		register(t, name)
+		c, _ := st.Users.Credentials(context.Background(), name)
+		ids[name] = c.ID
+	}
+	cookie := login(t, "alice")
+	ctx := context.Background()
+	// alice blocked bob, carol blocked alice; a block in either direction counts
+	st.Relations.Set(ctx, ids["alice"], ids["bob"], store.RelationBlock, true)
+	st.Relations.Set(ctx, ids["carol"], ids["alice"], store.RelationBlock, true)
+	// A mute is not a block
+	st.Relations.Set(ctx, ids["alice"], ids["dave"], store.RelationMute, true)
+	// Blocks between other members count too
+	st.Relations.Set(ctx, ids["erin"], ids["frank"], store.RelationBlock, true)
+
+	for _, names := range [][2]string{{"dave", "bob"}, {"dave", "carol"}, {"erin", "frank"}} {
+		w := call(CreateGroupHandler, "POST", "/api/groups/create", `{"name":"team","memberIds":["`+ids[names[0]]+`","`+ids[names[1]]+`"]}`, cookie)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("create with %s and %s: status %d, want %d", names[0], names[1], w.Code, http.StatusForbidden)
+		}
+	}
+	if groups, _ := st.Groups.List(ctx, ids["alice"]); len(groups) != 0 {
+		t.Fatalf("refused creates left %d groups", len(groups))
+	}
+
+	w := call(CreateGroupHandler, "POST", "/api/groups/create", `{"name":"team","memberIds":["`+ids["dave"]+`","`+ids["erin"]+`"]}`, cookie)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create with dave and erin: status %d, body %s", w.Code, w.Body)
+	}
+	var created struct {
+		ConversationID string `json:"conversation_id"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+
+	for _, name := range []string{"bob", "carol", "frank"} {
+		w := call(AddGroupMemberHandler, "POST", "/api/groups/members", `{"conversationId":"`+created.ConversationID+`","userId":"`+ids[name]+`"}`, cookie)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("add %s: status %d, want %d", name, w.Code, http.StatusForbidden)
+		}
+	}
+	members, _ := st.Groups.MemberIDs(ctx, created.ConversationID)
+	if len(members) != 3 {
+		t.Errorf("group has %d members, want alice, dave and erin", len(members))
+	}
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"time"
+
+	"jj/logging"
+	"jj/store"
+)
+
+// exportBatchSize is how many messages an export reads per query; each
+// batch is flushed to the client before the next one is read.
+const exportBatchSize = 200
+
+// ExportedMessage is one private message in a conversation export.
+type ExportedMessage struct {
+	ID        string     `json:"id"`
+	SenderID  string     `json:"senderId"`
+	Sender    string     `json:"sender"`
+	Content   string     `json:"content"`
+	Timestamp time.Time  `json:"timestamp"`
+	IsRead    bool       `json:"isRead"`
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	IsDeleted bool       `json:"isDeleted"`
+	// IsEncrypted marks Content as e2ee ciphertext, exported as stored.
+	IsEncrypted bool `json:"isEncrypted"`
+}
+
+// exportWriter writes a conversation export in one format. Messages arrive
+// oldest first, between a single call to begin and one to end.
+type exportWriter interface {
+	begin(w io.Writer, user, other string) error
+	message(w io.Writer, msg ExportedMessage) error
+	end(w io.Writer) error
+}
+
+// exportFormats maps the format parameter to its writer, content type and
+// file extension.
+var exportFormats = map[string]struct {
+	newWriter   func() exportWriter
+	contentType string
+	extension   string
+}{
+	"json": {func() exportWriter { return &jsonExport{} }, "application/json", "json"},
+	"txt":  {func() exportWriter { return textExport{} }, "text/plain; charset=utf-8", "txt"},
+	"html": {func() exportWriter { return htmlExport{} }, "text/html; charset=utf-8", "html"},
+}
+
+// ExportMessagesHandler streams the current user's whole private
+// conversation with the user given in "with", oldest message first, as a
+// downloadable JSON, plain text or HTML file.
+func ExportMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	withUserID := r.URL.Query().Get("with")
+	if withUserID == "" || withUserID == userID {
+		RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "json"
+	}
+	format, ok := exportFormats[formatName]
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, "Format must be json, txt or html")
+		return
+	}
+
+	user, err := Stores.Users.ByID(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to export messages")
+		return
+	}
+	other, err := Stores.Users.ByID(r.Context(), withUserID)
+	if errors.Is(err, store.ErrNotFound) {
+		RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	} else if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to export messages")
+		return
+	}
+
+	// The filename uses IDs, nicknames may not be safe in a header
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="conversation-%s.%s"`, withUserID, format.extension))
+	w.WriteHeader(http.StatusOK)
+
+	// Headers are sent by now, so failures can only cut the export short
+	out := bufio.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	export := format.newWriter()
+	if err := export.begin(out, user.Nickname, other.Nickname); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to export conversation", "with_user_id", withUserID, "error", err)
+		return
+	}
+
+	// Messages are read a batch at a time and written out before the next
+	// batch is queried, so neither memory use nor the database read lock
+	// depend on the length of the conversation or the speed of the client.
+	var after int64
+	for {
+		batch, last, err := exportBatch(r.Context(), userID, withUserID, after)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Failed to export conversation", "with_user_id", withUserID, "error", err)
+			return
+		}
+		for _, msg := range batch {
+			if err := export.message(out, msg); err != nil {
+				logging.FromContext(r.Context()).Error("Failed to export conversation", "with_user_id", withUserID, "error", err)
+				return
+			}
+		}
+		if len(batch) < exportBatchSize {
+			break
+		}
+		after = last
+		out.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := export.end(out); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to export conversation", "with_user_id", withUserID, "error", err)
+		return
+	}
+	out.Flush()
+}
+
+// exportBatch loads up to exportBatchSize messages of the conversation
+// between the two users that come after the cursor after, and returns the
+// cursor of the last one.
+func exportBatch(ctx context.Context, userID, withUserID string, after int64) ([]ExportedMessage, int64, error) {
+	// The export as a whole is not bounded by the request timeout, each batch is
+	if d := conf.Timeouts.Request.D(); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	page, last, err := Stores.Messages.ListAfter(ctx, userID, withUserID, after, exportBatchSize)
+	if err != nil {
+		return nil, after, err
+	}
+
+	batch := make([]ExportedMessage, len(page))
+	for i, m := range page {
+		batch[i] = ExportedMessage{
+			ID:          m.ID,
+			SenderID:    m.SenderID,
+			Sender:      m.Sender,
+			Content:     m.Content,
+			Timestamp:   m.CreatedAt,
+			IsRead:      m.IsRead,
+			EditedAt:    m.EditedAt,
+			IsDeleted:   m.IsDeleted,
+			IsEncrypted: m.IsEncrypted,
+		}
+	}
+	return batch, last, nil
+}
+
+// jsonExport writes a JSON array of ExportedMessage.
+type jsonExport struct {
+	written bool
+}
+
+func (e *jsonExport) begin(w io.Writer, user, other string) error {
+	_, err := io.WriteString(w, "[\n")
+	return err
+}
+
+func (e *jsonExport) message(w io.Writer, msg ExportedMessage) error {
+	if e.written {
+		if _, err := io.WriteString(w, ",\n"); err != nil {
+			return err
+		}
+	}
+	e.written = true
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (e *jsonExport) end(w io.Writer) error {
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+// textExport writes one line per message. Content is stored HTML-escaped
+// and unescaped here.
+type textExport struct{}
+
+func (textExport) begin(w io.Writer, user, other string) error {
+	_, err := fmt.Fprintf(w, "Conversation between %s and %s\n\n",
+		html.UnescapeString(user), html.UnescapeString(other))
+	return err
+}
+
+func (textExport) message(w io.Writer, msg ExportedMessage) error {
+	content := html.UnescapeString(msg.Content)
+	if msg.IsDeleted {
+		content = "(message deleted)"
+	} else if msg.IsEncrypted {
+		content = "(encrypted message)"
+	} else if msg.EditedAt != nil {
+		content += " (edited)"
+	}
+	read := "unread"
+	if msg.IsRead {
+		read = "read"
+	}
+	_, err := fmt.Fprintf(w, "[%s] %s: %s [%s]\n",
+		msg.Timestamp.UTC().Format(time.RFC3339), html.UnescapeString(msg.Sender), content, read)
+	return err
+}
+
+func (textExport) end(w io.Writer) error {
+	return nil
+}
+
+// htmlExport writes a standalone HTML page. Nicknames and content are
+// stored HTML-escaped and written as they are.
+type htmlExport struct{}
+
+func (htmlExport) begin(w io.Writer, user, other string) error {
+	_, err := fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Conversation between %[1]s and %[2]s</title>
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; }
+.message { margin: 0.5em 0; }
+.meta { color: #666; font-size: 0.85em; }
+</style>
+</head>
+<body>
+<h1>Conversation between %[1]s and %[2]s</h1>
+`, user, other)
+	return err
+}
+
+func (htmlExport) message(w io.Writer, msg ExportedMessage) error {
+	content := msg.Content
+	if msg.IsDeleted {
+		content = "<em>message deleted</em>"
+	} else if msg.IsEncrypted {
+		content = "<em>encrypted message</em>"
+	} else if msg.EditedAt != nil {
+		content += " <small>(edited)</small>"
+	}
+	read := "unread"
+	if msg.IsRead {
+		read = "read"
+	}
+	ts := msg.Timestamp.UTC().Format(time.RFC3339)
+	_, err := fmt.Fprintf(w, `<div class="message" id="m-%s">
+<div class="meta"><strong>%s</strong> <time datetime="%s">%s</time> · %s</div>
+<div class="content">%s</div>
+</div>
+`, msg.ID, msg.Sender, ts, ts, read, content)
+	return err
+}
+
+func (htmlExport) end(w io.Writer) error {
+	_, err := io.WriteString(w, "</body>\n</html>\n")
+	return err
+}
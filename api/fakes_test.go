@@ -0,0 +1,354 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"jj/models"
+	"jj/store"
+)
+
+// memStore returns in-memory stores for the handlers that only need
+// users, sessions, relations and groups; the other stores are left nil.
+func memStore() store.Store {
+	return store.Store{
+		Users:     &memUsers{users: map[string]store.NewUser{}, online: map[string]bool{}},
+		Sessions:  &memSessions{tokens: map[string]string{}},
+		Relations: &memRelations{},
+		Groups:    &memGroups{groups: map[string]*memGroup{}},
+	}
+}
+
+// useStore installs st as the package stores for the rest of the test.
+func useStore(t testing.TB, st store.Store) {
+	prev := Stores
+	Stores = st
+	t.Cleanup(func() { Stores = prev })
+}
+
+type memUsers struct {
+	mu     sync.Mutex
+	users  map[string]store.NewUser
+	online map[string]bool
+}
+
+func (s *memUsers) Create(ctx context.Context, u store.NewUser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.users {
+		if existing.Nickname == u.Nickname || existing.Email == u.Email {
+			return store.ErrDuplicate
+		}
+	}
+	s.users[u.ID] = u
+	return nil
+}
+
+func (s *memUsers) ByID(ctx context.Context, id string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return models.User{}, store.ErrNotFound
+	}
+	return models.User{ID: u.ID, Nickname: u.Nickname}, nil
+}
+
+func (s *memUsers) ByIDs(ctx context.Context, ids []string) ([]models.User, error) {
+	var list []models.User
+	for _, id := range ids {
+		if u, err := s.ByID(ctx, id); err == nil {
+			list = append(list, u)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	return list, nil
+}
+
+func (s *memUsers) Credentials(ctx context.Context, identifier string) (store.Credentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.Nickname == identifier || u.Email == identifier {
+			return store.Credentials{ID: u.ID, Nickname: u.Nickname, PasswordHash: u.PasswordHash}, nil
+		}
+	}
+	return store.Credentials{}, store.ErrNotFound
+}
+
+func (s *memUsers) List(ctx context.Context) ([]store.UserStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []store.UserStatus
+	for _, u := range s.users {
+		list = append(list, store.UserStatus{User: models.User{ID: u.ID, Nickname: u.Nickname}, IsOnline: s.online[u.ID]})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nickname < list[j].Nickname })
+	return list, nil
+}
+
+func (s *memUsers) SetOnline(ctx context.Context, id string, online bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.online[id] = online
+	return nil
+}
+
+func (s *memUsers) ResetOnline(ctx context.Context, keep []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := map[string]bool{}
+	for _, id := range keep {
+		kept[id] = true
+	}
+	var n int64
+	for id, online := range s.online {
+		if online && !kept[id] {
+			s.online[id] = false
+			n++
+		}
+	}
+	return n, nil
+}
+
+type memSessions struct {
+	mu     sync.Mutex
+	tokens map[string]string // token to user ID
+}
+
+func (s *memSessions) Create(ctx context.Context, userID, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, id := range s.tokens {
+		if id == userID {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = userID
+	return nil
+}
+
+func (s *memSessions) UserID(ctx context.Context, token string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.tokens[token]
+	if !ok {
+		return "", store.ErrNotFound
+	}
+	return id, nil
+}
+
+func (s *memSessions) Delete(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, id := range s.tokens {
+		if id == userID {
+			delete(s.tokens, t)
+		}
+	}
+	return nil
+}
+
+type memRelations struct {
+	mu   sync.Mutex
+	list []memRelation
+}
+
+type memRelation struct {
+	userID, targetID, kind string
+}
+
+func (s *memRelations) Blocked(ctx context.Context, userA, userB string) (bool, error) {
+	ids, _ := s.BlockedIDs(ctx, userA)
+	return ids[userB], nil
+}
+
+func (s *memRelations) BlockedIDs(ctx context.Context, userID string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := map[string]bool{}
+	for _, r := range s.list {
+		if r.kind != store.RelationBlock {
+			continue
+		}
+		if r.userID == userID {
+			ids[r.targetID] = true
+		} else if r.targetID == userID {
+			ids[r.userID] = true
+		}
+	}
+	return ids, nil
+}
+
+func (s *memRelations) TargetIDs(ctx context.Context, userID string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := map[string]bool{}
+	for _, r := range s.list {
+		if r.userID == userID {
+			ids[r.targetID] = true
+		}
+	}
+	return ids, nil
+}
+
+func (s *memRelations) Set(ctx context.Context, userID, targetID, kind string, active bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := memRelation{userID, targetID, kind}
+	for i, existing := range s.list {
+		if existing == r {
+			if !active {
+				s.list = append(s.list[:i], s.list[i+1:]...)
+			}
+			return nil
+		}
+	}
+	if active {
+		s.list = append([]memRelation{r}, s.list...)
+	}
+	return nil
+}
+
+func (s *memRelations) List(ctx context.Context, userID string) ([]store.Relation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []store.Relation
+	for _, r := range s.list {
+		if r.userID == userID {
+			list = append(list, store.Relation{Kind: r.kind, User: models.User{ID: r.targetID}})
+		}
+	}
+	return list, nil
+}
+
+// memGroups keeps groups without messages; reads and unread counts are
+// always zero.
+type memGroups struct {
+	mu     sync.Mutex
+	groups map[string]*memGroup
+}
+
+type memGroup struct {
+	store.Group
+	memberIDs []string
+}
+
+func (s *memGroups) Create(ctx context.Context, id, name, createdBy string, memberIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[id] = &memGroup{
+		Group:     store.Group{ID: id, Name: name, CreatedBy: createdBy, CreatedAt: time.Now()},
+		memberIDs: slices.Clone(memberIDs),
+	}
+	return nil
+}
+
+func (s *memGroups) Get(ctx context.Context, id, viewerID string) (store.Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[id]
+	if !ok {
+		return store.Group{}, store.ErrNotFound
+	}
+	group := g.Group
+	group.Members = []models.User{}
+	for _, userID := range g.memberIDs {
+		group.Members = append(group.Members, models.User{ID: userID})
+	}
+	return group, nil
+}
+
+func (s *memGroups) List(ctx context.Context, userID string) ([]store.Group, error) {
+	s.mu.Lock()
+	var ids []string
+	for id, g := range s.groups {
+		if slices.Contains(g.memberIDs, userID) {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(ids)
+
+	list := []store.Group{}
+	for _, id := range ids {
+		g, err := s.Get(ctx, id, userID)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	return list, nil
+}
+
+func (s *memGroups) Rename(ctx context.Context, id, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.groups[id]; ok {
+		g.Name = name
+	}
+	return nil
+}
+
+func (s *memGroups) IsMember(ctx context.Context, id, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[id]
+	return ok && slices.Contains(g.memberIDs, userID), nil
+}
+
+func (s *memGroups) MemberIDs(ctx context.Context, id string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.groups[id]; ok {
+		return slices.Clone(g.memberIDs), nil
+	}
+	return []string{}, nil
+}
+
+func (s *memGroups) AddMember(ctx context.Context, id, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok := s.groups[id]; ok && !slices.Contains(g.memberIDs, userID) {
+		g.memberIDs = append(g.memberIDs, userID)
+	}
+	return nil
+}
+
+func (s *memGroups) RemoveMember(ctx context.Context, id, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[id]
+	if !ok {
+		return nil
+	}
+	g.memberIDs = slices.DeleteFunc(g.memberIDs, func(m string) bool { return m == userID })
+	if len(g.memberIDs) == 0 {
+		delete(s.groups, id)
+	}
+	return nil
+}
+
+func (s *memGroups) ReadPositions(ctx context.Context, id string) (map[string]int64, error) {
+	return map[string]int64{}, nil
+}
+
+func (s *memGroups) Messages(ctx context.Context, id string, limit, offset int) ([]store.GroupMessage, error) {
+	return nil, nil
+}
+
+func (s *memGroups) Send(ctx context.Context, m store.GroupMessage) error {
+	return nil
+}
+
+func (s *memGroups) MarkRead(ctx context.Context, id, userID, messageID string) (bool, error) {
+	return false, nil
+}
+
+func (s *memGroups) Unread(ctx context.Context, userID string) ([]store.UnreadGroup, error) {
+	return []store.UnreadGroup{}, nil
+}
@@ -1,10 +1,7 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"regexp"
@@ -13,8 +10,10 @@ import (
 	"sync"
 	"time"
 
-	"jj/database"
+	"jj/logging"
+	"jj/metrics"
 	"jj/models"
+	"jj/store"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -42,6 +41,32 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	json.NewEncoder(w).Encode(payload)
 }
 
+// postResponse is a post as returned to clients.
+type postResponse struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Category  string    `json:"category"`
+	CreatedAt time.Time `json:"created_at"`
+	Author    string    `json:"author"`
+	AuthorID  string    `json:"authorId"`
+	Muted     bool      `json:"muted"`
+}
+
+// newPostResponse converts p, muting it if its author is collapsed.
+func newPostResponse(p store.Post, collapsed map[string]bool) postResponse {
+	return postResponse{
+		ID:        p.ID,
+		Title:     p.Title,
+		Content:   p.Content,
+		Category:  p.Category,
+		CreatedAt: p.CreatedAt,
+		Author:    p.Author,
+		AuthorID:  p.UserID,
+		Muted:     collapsed[p.UserID],
+	}
+}
+
 // RegisterHandler handles new user registration.
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	k := r.Header.Get("Accept")
@@ -96,12 +121,18 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	Firstname := models.Skip(req.FirstName)
 	Lastname := models.Skip(req.LastName)
 
-	_, err = database.DB.Exec(`
-        INSERT INTO users (id, nickname, age, gender, first_name, last_name, email, password)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		id, nickname, req.Age, req.Gender, Firstname, Lastname, req.Email, string(hashedPassword))
+	err = Stores.Users.Create(r.Context(), store.NewUser{
+		ID:           id,
+		Nickname:     nickname,
+		Age:          req.Age,
+		Gender:       req.Gender,
+		FirstName:    Firstname,
+		LastName:     Lastname,
+		Email:        req.Email,
+		PasswordHash: string(hashedPassword),
+	})
 	if err != nil {
-		if database.IsDuplicateKeyError(err) { // Use database.IsDuplicateKeyError
+		if err == store.ErrDuplicate {
 			RespondWithError(w, http.StatusConflict, "Nickname or email already exists")
 			return
 		}
@@ -113,7 +144,6 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 // LoginHandler handles user login.
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.Method)
 	k := r.Header.Get("Accept")
 	if k != "*/*" {
 
@@ -135,49 +165,31 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user struct {
-		ID       string
-		Nickname string
-		Password string
-	}
 	token := uuid.New().String()
 
-	err := database.DB.QueryRow(`
-        SELECT id, nickname, password FROM users WHERE nickname = ? OR email = ?`,
-		req.Identifier, req.Identifier).Scan(&user.ID, &user.Nickname, &user.Password)
+	user, err := Stores.Users.Credentials(r.Context(), req.Identifier)
 	if err != nil {
 		RespondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
 		RespondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
-	_, err = database.DB.Exec(`
-        UPDATE users SET last_seen = CURRENT_TIMESTAMP, is_online = TRUE WHERE id = ?`,
-		user.ID)
-	if err != nil {
-		log.Printf("Failed to update user status: %v", err)
-	}
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_id",
 		Value:    token,
 		Path:     "/",
 		HttpOnly: false,
-		Secure:   false,
+		Secure:   r.TLS != nil, // only sent back over HTTPS once served over it
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   86400,
 	})
-	_, err1 := database.DB.Exec(`
-    UPDATE users
-    SET token = ?
-    WHERE id = ?`,
-		token, user.ID,
-	)
-	if err1 != nil {
-		log.Println("Failed to update token:", err)
+	logging.SetUser(r.Context(), user.ID)
+	if err := Stores.Sessions.Create(r.Context(), user.ID, token); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to store session", "error", err)
 		return
 	}
 	Lougout = false
@@ -204,11 +216,8 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	withUserId := r.URL.Query().Get("with")
 	Lougout = true
 
-	_, err := database.DB.Exec(`
-        UPDATE users SET is_online = FALSE WHERE id = ?`,
-		withUserId)
-	if err != nil {
-		log.Printf("Failed to update user status: %v", err)
+	if err := Stores.Users.SetOnline(r.Context(), withUserId, false); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to update user status", "user_id", withUserId, "error", err)
 	}
 
 	http.SetCookie(w, &http.Cookie{
@@ -216,16 +225,11 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   r.TLS != nil,
 		MaxAge:   -1,
 	})
-	_, err2 := database.DB.Exec(`
-    UPDATE users
-    SET token = NULL
-    WHERE id = ?`,
-		withUserId, // l'user li kay logout
-	)
-	if err2 != nil {
-		log.Println("Failed to clear token in DB:", err)
+	if err := Stores.Sessions.Delete(r.Context(), withUserId); err != nil { // l'user li kay logout
+		logging.FromContext(r.Context()).Error("Failed to clear session", "user_id", withUserId, "error", err)
 		return
 	}
 
@@ -249,10 +253,7 @@ func GetCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user models.User // Use models.User
-	err = database.DB.QueryRow(`
-        SELECT id, nickname FROM users WHERE id = ?`,
-		userID).Scan(&user.ID, &user.Nickname)
+	user, err := Stores.Users.ByID(r.Context(), userID)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Failed to get user info")
 		return
@@ -275,27 +276,33 @@ func GetUsersHandler(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
-	rows, err := database.DB.Query("SELECT id, nickname, is_online FROM users")
+	// Users in a block relation with the viewer are hidden unless asked for
+	hidden := map[string]bool{}
+	if userID, err := authenticateUser(r); err == nil && r.URL.Query().Get("includeBlocked") == "" {
+		if hidden, err = BlockedUserIDs(r.Context(), userID); err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to fetch users")
+			return
+		}
+	}
+
+	list, err := Stores.Users.List(r.Context())
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch users")
 		return
 	}
-	defer rows.Close()
 
 	var users []struct {
 		models.User      // Embed models.User
 		IsOnline    bool `json:"isOnline"`
 	}
-	for rows.Next() {
-		var user struct {
+	for _, u := range list {
+		if hidden[u.ID] {
+			continue
+		}
+		users = append(users, struct {
 			models.User
 			IsOnline bool `json:"isOnline"`
-		}
-		if err := rows.Scan(&user.ID, &user.Nickname, &user.IsOnline); err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "Failed to process users")
-			return
-		}
-		users = append(users, user)
+		}{u.User, u.IsOnline})
 	}
 
 	respondWithJSON(w, http.StatusOK, users)
@@ -312,26 +319,9 @@ func GetPostsHandlerfor(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
-	row := database.DB.QueryRow(`
-        SELECT p.id, p.title, p.content, p.category, p.created_at, u.nickname
-        FROM posts p
-        JOIN users u ON p.user_id = u.id
-        ORDER BY p.created_at DESC
-        LIMIT 1`)
-
-	type Post struct {
-		ID        string    `json:"id"`
-		Title     string    `json:"title"`
-		Content   string    `json:"content"`
-		Category  string    `json:"category"`
-		CreatedAt time.Time `json:"created_at"`
-		Author    string    `json:"author"`
-	}
-
-	var post Post
-	err := row.Scan(&post.ID, &post.Title, &post.Content, &post.Category, &post.CreatedAt, &post.Author)
+	p, err := Stores.Posts.Latest(r.Context())
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == store.ErrNotFound {
 			respondWithJSON(w, http.StatusOK, nil) // ma kaynsh post
 			return
 		}
@@ -339,7 +329,7 @@ func GetPostsHandlerfor(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, post)
+	respondWithJSON(w, http.StatusOK, newPostResponse(p, collapsedAuthorsFor(r)))
 }
 
 // GetPostsHandler retrieves a list of all posts.
@@ -356,38 +346,22 @@ func GetPostsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	limit := 10
-	offset := r.URL.Query().Get("with")
-
-	rows, err := database.DB.Query(`
-    SELECT p.id, p.title, p.content, p.category, p.created_at, u.nickname
-    FROM posts p
-    JOIN users u ON p.user_id = u.id
-    ORDER BY p.created_at DESC
-    LIMIT ? OFFSET ?`, limit, offset)
-	if err != nil {
-		log.Println("Query error:", err)
-		return
+	offset, _ := strconv.Atoi(r.URL.Query().Get("with"))
+	if offset < 0 {
+		offset = 0
 	}
-	defer rows.Close()
 
-	type Post struct {
-		ID        string    `json:"id"`
-		Title     string    `json:"title"`
-		Content   string    `json:"content"`
-		Category  string    `json:"category"`
-		CreatedAt time.Time `json:"created_at"`
-		Author    string    `json:"author"`
+	list, err := Stores.Posts.List(r.Context(), limit, offset)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to list posts", "error", err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch posts")
+		return
 	}
 
-	var posts []Post
-	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.Category, &post.CreatedAt, &post.Author)
-		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "Failed to process posts")
-			return
-		}
-		posts = append(posts, post)
+	collapsed := collapsedAuthorsFor(r)
+	var posts []postResponse
+	for _, p := range list {
+		posts = append(posts, newPostResponse(p, collapsed))
 	}
 
 	respondWithJSON(w, http.StatusOK, posts)
@@ -414,22 +388,9 @@ func GetPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	postID := parts[3]
 
-	var post struct {
-		ID        string    `json:"id"`
-		Title     string    `json:"title"`
-		Content   string    `json:"content"`
-		Category  string    `json:"category"`
-		CreatedAt time.Time `json:"created_at"`
-		Author    string    `json:"author"`
-	}
-	err := database.DB.QueryRow(`
-        SELECT p.id, p.title, p.content, p.category, p.created_at, u.nickname
-        FROM posts p
-        JOIN users u ON p.user_id = u.id
-        WHERE p.id = ?`, postID).Scan(
-		&post.ID, &post.Title, &post.Content, &post.Category, &post.CreatedAt, &post.Author)
+	p, err := Stores.Posts.Get(r.Context(), postID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if err == store.ErrNotFound {
 			RespondWithError(w, http.StatusNotFound, "Post not found")
 			return
 		}
@@ -437,7 +398,7 @@ func GetPostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, post)
+	respondWithJSON(w, http.StatusOK, newPostResponse(p, collapsedAuthorsFor(r)))
 }
 
 // CreatePostHandler creates a new post.
@@ -450,13 +411,11 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method != "POST" {
-		fmt.Println("222222222")
 		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
 	userID, err := authenticateUser(r)
 	if err != nil {
-		fmt.Println("2222")
 		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
 		return
 	}
@@ -474,7 +433,9 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	req.Title = strings.TrimSpace(req.Title)
 	req.Content = strings.TrimSpace(req.Content)
-	if (len(req.Title) < 5 || len(req.Title) > 50) || (len(req.Content) < 5 || len(req.Content) > 50) || req.Category == "" {
+	limits := conf.Limits
+	if (len(req.Title) < limits.PostTitleMin || len(req.Title) > limits.PostTitleMax) ||
+		(len(req.Content) < limits.PostContentMin || len(req.Content) > limits.PostContentMax) || req.Category == "" {
 		RespondWithError(w, http.StatusBadRequest, "Missing required fields")
 		return
 	}
@@ -482,10 +443,13 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 	content := models.Skip(req.Content)
 
 	postID := uuid.New().String()
-	_, err = database.DB.Exec(`
-        INSERT INTO posts (id, user_id, category, title, content)
-        VALUES (?, ?, ?, ?, ?)`,
-		postID, userID, req.Category, title, content)
+	err = Stores.Posts.Create(r.Context(), store.Post{
+		ID:       postID,
+		UserID:   userID,
+		Category: req.Category,
+		Title:    title,
+		Content:  content,
+	})
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Failed to create post")
 		return
@@ -517,34 +481,32 @@ func GetCommentsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := database.DB.Query(`
-        SELECT c.id, c.content, c.created_at, u.nickname
-        FROM comments c
-        JOIN users u ON c.user_id = u.id
-        WHERE c.post_id = ?
-        ORDER BY c.created_at ASC`, postID)
+	list, err := Stores.Comments.ListByPost(r.Context(), postID)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch comments")
 		return
 	}
-	defer rows.Close()
 
 	type Comment struct {
 		ID        string    `json:"id"`
 		Content   string    `json:"content"`
 		CreatedAt time.Time `json:"created_at"`
 		Author    string    `json:"author"`
+		AuthorID  string    `json:"authorId"`
+		Muted     bool      `json:"muted"`
 	}
 
+	collapsed := collapsedAuthorsFor(r)
 	var comments []Comment
-	for rows.Next() {
-		var comment Comment
-		err := rows.Scan(&comment.ID, &comment.Content, &comment.CreatedAt, &comment.Author)
-		if err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "Failed to process comments")
-			return
-		}
-		comments = append(comments, comment)
+	for _, c := range list {
+		comments = append(comments, Comment{
+			ID:        c.ID,
+			Content:   c.Content,
+			CreatedAt: c.CreatedAt,
+			Author:    c.Author,
+			AuthorID:  c.UserID,
+			Muted:     collapsed[c.UserID],
+		})
 	}
 
 	respondWithJSON(w, http.StatusOK, comments)
@@ -584,27 +546,26 @@ func CreateCommentHandler(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusBadRequest, "Missing required fields")
 		return
 	}
-	if len(req.Content) < 3 || len(req.Content) > 30 {
+	if len(req.Content) < conf.Limits.CommentMin || len(req.Content) > conf.Limits.CommentMax {
 		RespondWithError(w, http.StatusBadRequest, "Missing required fields")
 		return
 	}
 	sanitizedContent := models.Skip(req.Content)
-	row := database.DB.QueryRow(`SELECT title FROM posts WHERE id = ?`, req.PostID)
-	var exists int
-	err1 := row.Scan(&exists)
-	if err1 == sql.ErrNoRows {
+	if _, err := Stores.Posts.Get(r.Context(), req.PostID); err == store.ErrNotFound {
 		RespondWithError(w, http.StatusNotFound, "Post not found")
 		return
-	} else if err1 != nil {
+	} else if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
 
 	commentID := uuid.New().String()
-	_, err = database.DB.Exec(`
-        INSERT INTO comments (id, post_id, user_id, content)
-        VALUES (?, ?, ?, ?)`,
-		commentID, req.PostID, userID, sanitizedContent)
+	err = Stores.Comments.Create(r.Context(), store.Comment{
+		ID:      commentID,
+		PostID:  req.PostID,
+		UserID:  userID,
+		Content: sanitizedContent,
+	})
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Failed to create comment")
 		return
@@ -616,7 +577,8 @@ func CreateCommentHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// GetMessagesHandler retrieves private messages between two users.
+// GetMessagesHandler retrieves private messages between two users,
+// or the messages of a group conversation when ?conversation= is given.
 func GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	k := r.Header.Get("Accept")
 	if k != "*/*" {
@@ -635,7 +597,8 @@ func GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	withUserId := r.URL.Query().Get("with")
-	if withUserId == "" {
+	conversationID := r.URL.Query().Get("conversation")
+	if withUserId == "" && conversationID == "" {
 		RespondWithError(w, http.StatusBadRequest, "Missing user ID")
 		return
 	}
@@ -654,49 +617,84 @@ func GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	query := `
-        SELECT m.id, m.sender_id, m.content, m.created_at, u.nickname, m.is_read
-        FROM private_messages m
-        JOIN users u ON m.sender_id = u.id
-        WHERE (m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?)
-        ORDER BY m.idss DESC, m.id DESC
-        LIMIT ? OFFSET ?
-    `
-	args := []interface{}{userID, withUserId, withUserId, userID, limit, offset}
+	if conversationID != "" {
+		getGroupMessages(r.Context(), w, userID, conversationID, limit, offset)
+		return
+	}
 
-	rows, err := database.DB.Query(query, args...)
+	list, err := Stores.Messages.ListPrivate(r.Context(), userID, withUserId, limit, offset)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch messages")
 		return
 	}
-	defer rows.Close()
 
 	type Message struct {
-		ID        string    `json:"id"`
-		SenderId  string    `json:"senderId"`
-		Content   string    `json:"content"`
-		Timestamp time.Time `json:"timestamp"`
-		Sender    string    `json:"sender"`
-		IsRead    bool      `json:"isRead"`
+		ID          string       `json:"id"`
+		SenderId    string       `json:"senderId"`
+		Content     string       `json:"content"`
+		Timestamp   time.Time    `json:"timestamp"`
+		Sender      string       `json:"sender"`
+		IsRead      bool         `json:"isRead"`
+		EditedAt    *time.Time   `json:"editedAt,omitempty"`
+		IsDeleted   bool         `json:"isDeleted"`
+		ExpiresAt   *time.Time   `json:"expiresAt,omitempty"`
+		IsEncrypted bool         `json:"isEncrypted"`
+		Attachments []Attachment `json:"attachments"`
+		Reactions   []Reaction   `json:"reactions"`
+		// Envelopes are the content key envelopes for the requesting
+		// user's devices, keyed by key ID; only set when IsEncrypted.
+		Envelopes map[string]string `json:"envelopes,omitempty"`
 	}
 
 	var messages []Message
-	for rows.Next() {
-		var msg Message
-		if err := rows.Scan(&msg.ID, &msg.SenderId, &msg.Content, &msg.Timestamp, &msg.Sender, &msg.IsRead); err != nil {
-			RespondWithError(w, http.StatusInternalServerError, "Failed to process messages")
-			return
-		}
-		messages = append(messages, msg)
+	for _, m := range list {
+		messages = append(messages, Message{
+			ID:          m.ID,
+			SenderId:    m.SenderID,
+			Content:     m.Content,
+			Timestamp:   m.CreatedAt,
+			Sender:      m.Sender,
+			IsRead:      m.IsRead,
+			EditedAt:    m.EditedAt,
+			IsDeleted:   m.IsDeleted,
+			ExpiresAt:   m.ExpiresAt,
+			IsEncrypted: m.IsEncrypted,
+		})
+	}
+
+	messageIDs := make([]string, len(messages))
+	for i, msg := range messages {
+		messageIDs[i] = msg.ID
+	}
+	attachments, err := LoadMessageAttachments(r.Context(), messageIDs)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch attachments")
+		return
 	}
-
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	reactions, err := LoadMessageReactions(r.Context(), messageIDs)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch reactions")
+		return
+	}
+	envelopes, err := LoadMessageEnvelopes(r.Context(), messageIDs, userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch key envelopes")
+		return
+	}
+	for i := range messages {
+		messages[i].Attachments = attachments[messages[i].ID]
+		messages[i].Reactions = reactions[messages[i].ID]
+		messages[i].Envelopes = envelopes[messages[i].ID]
 	}
 
 	respondWithJSON(w, http.StatusOK, messages)
 }
 
+// RateLimitRejections counts requests turned away by a rate limit, by
+// scope ("http" or "websocket") and route pattern.
+var RateLimitRejections = metrics.NewCounter("forum_rate_limit_rejections_total",
+	"Requests rejected by a rate limit, by scope and route.", "scope", "route")
+
 func RateLimitMiddleware(next http.HandlerFunc, limit int, window time.Duration) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ip := r.RemoteAddr
@@ -716,6 +714,7 @@ func RateLimitMiddleware(next http.HandlerFunc, limit int, window time.Duration)
 				if c.Requests > limit {
 					c.Requests = 0
 					c.LastSeen = time.Now()
+					RateLimitRejections.Inc("http", r.Pattern)
 					RespondWithError(w, http.StatusMethodNotAllowed, "A lot of requests")
 					return
 				}
@@ -732,13 +731,11 @@ func authenticateUser(r *http.Request) (string, error) {
 		return "", err
 	}
 
-	var userID string
-	err = database.DB.QueryRow("SELECT id FROM users WHERE token = ?", cookie.Value).Scan(&userID)
+	userID, err := Stores.Sessions.UserID(r.Context(), cookie.Value)
 	if err != nil {
-		// fmt.Println(err)
 		return "", err
 	}
-
+	logging.SetUser(r.Context(), userID)
 	return userID, nil
 }
 
@@ -753,8 +750,7 @@ func Auto(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	withUserId := r.URL.Query().Get("with")
-	var userid string
-	err := database.DB.QueryRow(`SELECT id FROM users WHERE token = ?`, withUserId).Scan(&userid)
+	userid, err := Stores.Sessions.UserID(r.Context(), withUserId)
 	if err != nil {
 		respondWithJSON(w, http.StatusUnauthorized, map[string]string{"message": "Invalid session"})
 		return
@@ -769,10 +765,8 @@ func IsGmail(email string) bool {
 
 func StyleHandler(w http.ResponseWriter, r *http.Request) {
 	filePath := strings.TrimPrefix(r.URL.Path, "/")
-	fmt.Println(filePath)
 	File, err := os.Stat(filePath)
 	if err != nil || File.IsDir() {
-		fmt.Println("alaaaa")
 		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
 		return
 	}
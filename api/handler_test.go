@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/certs"
+	"jj/store"
+)
+
+// call runs handler on a request the way the frontend sends it.
+func call(handler http.HandlerFunc, method, target, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Accept", "*/*")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// register creates a user through RegisterHandler.
+func register(t *testing.T, nickname string) {
+	t.Helper()
+	body := `{"nickname":"` + nickname + `","age":30,"gender":"x","first_name":"First","last_name":"Last",` +
+		`"email":"` + nickname + `.test@gmail.com","password":"secret"}`
+	if w := call(RegisterHandler, "POST", "/api/register", body); w.Code != http.StatusCreated {
+		t.Fatalf("register %s: status %d, body %s", nickname, w.Code, w.Body)
+	}
+}
+
+// login logs a user in through LoginHandler and returns the session cookie.
+func login(t *testing.T, nickname string) *http.Cookie {
+	t.Helper()
+	w := call(LoginHandler, "POST", "/api/login", `{"identifier":"`+nickname+`","password":"secret"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login %s: status %d, body %s", nickname, w.Code, w.Body)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "session_id" {
+			return c
+		}
+	}
+	t.Fatalf("login %s: no session cookie", nickname)
+	return nil
+}
+
+func TestRegisterLoginAndCurrentUser(t *testing.T) {
+	useStore(t, memStore())
+
+	register(t, "alice")
+	cookie := login(t, "alice")
+
+	w := call(GetCurrentUserHandler, "GET", "/api/user", "", cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("current user: status %d, body %s", w.Code, w.Body)
+	}
+	var user struct{ Nickname string }
+	if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Nickname != "alice" {
+		t.Errorf("current user is %q, want alice", user.Nickname)
+	}
+}
+
+func TestRegisterDuplicateNickname(t *testing.T) {
+	useStore(t, memStore())
+
+	register(t, "alice")
+	body := `{"nickname":"alice","age":30,"gender":"x","first_name":"First","last_name":"Last",` +
+		`"email":"other.test@gmail.com","password":"secret"}`
+	if w := call(RegisterHandler, "POST", "/api/register", body); w.Code != http.StatusConflict {
+		t.Errorf("status %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	useStore(t, memStore())
+
+	register(t, "alice")
+	w := call(LoginHandler, "POST", "/api/login", `{"identifier":"alice","password":"wrong"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("failed login set a cookie")
+	}
+}
+
+func TestHandlersRequireSession(t *testing.T) {
+	useStore(t, memStore())
+
+	w := call(GetCurrentUserHandler, "GET", "/api/user", "", &http.Cookie{Name: "session_id", Value: "unknown"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestGetUsersHidesBlockedUsers(t *testing.T) {
+	st := memStore()
+	useStore(t, st)
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		register(t, name)
+	}
+	cookie := login(t, "alice")
+	// Blocks hide users both ways, whoever set them
+	carol, _ := st.Users.Credentials(context.Background(), "carol")
+	alice, _ := st.Users.Credentials(context.Background(), "alice")
+	if err := st.Relations.Set(context.Background(), carol.ID, alice.ID, store.RelationBlock, true); err != nil {
+		t.Fatal(err)
+	}
+
+	nicknames := func(w *httptest.ResponseRecorder) []string {
+		t.Helper()
+		var users []struct{ Nickname string }
+		if err := json.NewDecoder(w.Body).Decode(&users); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, u := range users {
+			names = append(names, u.Nickname)
+		}
+		return names
+	}
+
+	got := nicknames(call(GetUsersHandler, "GET", "/api/users", "", cookie))
+	if strings.Join(got, ",") != "alice,bob" {
+		t.Errorf("users = %v, want [alice bob]", got)
+	}
+	got = nicknames(call(GetUsersHandler, "GET", "/api/users?includeBlocked=1", "", cookie))
+	if strings.Join(got, ",") != "alice,bob,carol" {
+		t.Errorf("users with includeBlocked = %v, want [alice bob carol]", got)
+	}
+}
+
+func TestLoginCookieSecureOverTLS(t *testing.T) {
+	useStore(t, memStore())
+	register(t, "alice")
+
+	certPEM, keyPEM, err := certs.SelfSigned(time.Hour, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure := httptest.NewUnstartedServer(http.HandlerFunc(LoginHandler))
+	secure.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	secure.StartTLS()
+	defer secure.Close()
+	plain := httptest.NewServer(http.HandlerFunc(LoginHandler))
+	defer plain.Close()
+
+	for _, s := range []struct {
+		server *httptest.Server
+		secure bool
+	}{{secure, true}, {plain, false}} {
+		req, _ := http.NewRequest("POST", s.server.URL+"/api/login", strings.NewReader(`{"identifier":"alice","password":"secret"}`))
+		req.Header.Set("Accept", "*/*")
+		resp, err := s.server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("login over %s: status %d", s.server.URL, resp.StatusCode)
+		}
+		var session *http.Cookie
+		for _, c := range resp.Cookies() {
+			if c.Name == "session_id" {
+				session = c
+			}
+		}
+		if session == nil {
+			t.Fatalf("login over %s: no session cookie", s.server.URL)
+		}
+		if session.Secure != s.secure {
+			t.Errorf("login over %s: Secure = %v, want %v", s.server.URL, session.Secure, s.secure)
+		}
+	}
+}
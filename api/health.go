@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"jj/database"
+	"jj/logging"
+)
+
+// readyTimeout bounds the database checks of one readiness probe.
+const readyTimeout = 2 * time.Second
+
+// shuttingDown is set once main starts shutting the server down.
+var shuttingDown atomic.Bool
+
+// ShuttingDown makes ReadyHandler fail from now on, so the orchestrator
+// stops routing new traffic here while in-flight requests finish.
+func ShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// HealthHandler reports that the process is up and serving HTTP. It checks
+// nothing else, so a failing database doesn't get the process restarted.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ReadyHandler reports whether this instance should receive traffic: the
+// database answers, its schema is up to date and the server is not
+// shutting down. It answers 503 with the failing checks otherwise.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	checks := map[string]string{"shutdown": "ok", "database": "ok", "migrations": "ok"}
+	ready := true
+	fail := func(check, status string, err error) {
+		checks[check] = status
+		ready = false
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Readiness check failed", "check", check, "error", err)
+		}
+	}
+
+	if shuttingDown.Load() {
+		fail("shutdown", "shutting down", nil)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := database.DB.PingContext(ctx); err != nil {
+		fail("database", "unreachable", err)
+		fail("migrations", "unknown", nil)
+	} else if err := database.CheckSchema(ctx); errors.Is(err, database.ErrSchemaTooNew) {
+		fail("migrations", "schema newer than this server", err)
+	} else if err != nil {
+		fail("migrations", "pending", err)
+	}
+
+	status, state := http.StatusOK, "ready"
+	if !ready {
+		status, state = http.StatusServiceUnavailable, "not ready"
+	}
+	respondWithJSON(w, status, map[string]interface{}{"status": state, "checks": checks})
+}
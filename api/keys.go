@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"jj/e2ee"
+	"jj/store"
+
+	"github.com/google/uuid"
+)
+
+const maxDeviceIDLength = 64
+
+var (
+	// ErrNoRecipientKeys is returned when encrypting to a user who has not
+	// published any device key.
+	ErrNoRecipientKeys = errors.New("this user has not set up encryption")
+	// ErrKeysChanged is returned when the envelopes of an encrypted message
+	// don't match the participants' current device keys.
+	ErrKeysChanged = errors.New("encryption keys changed, reload them and try again")
+	// ErrEncryptedConversation is returned for a plaintext message in a
+	// conversation that has switched to end-to-end encryption.
+	ErrEncryptedConversation = errors.New("this conversation is end-to-end encrypted")
+)
+
+// DeviceKey is a public key published by one device of a user.
+type DeviceKey struct {
+	ID        string    `json:"keyId"`
+	UserID    string    `json:"userId"`
+	DeviceID  string    `json:"deviceId"`
+	PublicKey string    `json:"publicKey"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ActiveKeys returns the device keys of userID that have not been revoked.
+func ActiveKeys(ctx context.Context, userID string) ([]DeviceKey, error) {
+	stored, err := Stores.Keys.Active(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]DeviceKey, len(stored))
+	for i, k := range stored {
+		keys[i] = DeviceKey(k)
+	}
+	return keys, nil
+}
+
+// CheckEnvelopes verifies that an encrypted message between the two users
+// carries exactly one well-formed envelope for every active device key of
+// both of them, so no device is left unable to read it.
+func CheckEnvelopes(ctx context.Context, senderID, receiverID string, envelopes map[string]string) error {
+	receiverKeys, err := ActiveKeys(ctx, receiverID)
+	if err != nil {
+		return err
+	}
+	if len(receiverKeys) == 0 {
+		return ErrNoRecipientKeys
+	}
+	senderKeys, err := ActiveKeys(ctx, senderID)
+	if err != nil {
+		return err
+	}
+
+	keys := append(receiverKeys, senderKeys...)
+	if len(envelopes) != len(keys) {
+		return ErrKeysChanged
+	}
+	for _, k := range keys {
+		envelope, ok := envelopes[k.ID]
+		if !ok {
+			return ErrKeysChanged
+		}
+		if err := e2ee.ValidateEnvelope(envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadMessageEnvelopes returns, for each of the given encrypted messages,
+// the envelopes addressed to userID's devices keyed by key ID. Envelopes
+// for revoked keys are included so older devices can still read history.
+func LoadMessageEnvelopes(ctx context.Context, messageIDs []string, userID string) (map[string]map[string]string, error) {
+	return Stores.Keys.Envelopes(ctx, messageIDs, userID)
+}
+
+// notifyKeysChanged tells the user's own connections and everyone they
+// share an encrypted conversation with that their device keys changed.
+func notifyKeysChanged(ctx context.Context, userID string) {
+	userIDs := []string{userID}
+	if peers, err := Stores.Settings.EncryptedPeers(ctx, userID); err == nil {
+		userIDs = append(userIDs, peers...)
+	}
+	NotifyUsers(userIDs, "keys_updated", map[string]string{"userId": userID})
+}
+
+// GetKeysHandler lists the active device keys of the user given in "user",
+// or of the current user.
+func GetKeysHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	ownerID := r.URL.Query().Get("user")
+	if ownerID == "" {
+		ownerID = userID
+	}
+	keys, err := ActiveKeys(r.Context(), ownerID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch keys")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, keys)
+}
+
+// PublishKeyHandler publishes the public key of one of the current user's
+// devices. A device that already has a key rotates it: the old key is
+// revoked and only the new one receives envelopes from then on.
+func PublishKeyHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	var req struct {
+		DeviceID  string `json:"deviceId"`
+		PublicKey string `json:"publicKey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	req.DeviceID = strings.TrimSpace(req.DeviceID)
+	if req.DeviceID == "" || len(req.DeviceID) > maxDeviceIDLength {
+		RespondWithError(w, http.StatusBadRequest, "Invalid device ID")
+		return
+	}
+	if _, err := e2ee.ParsePublicKey(req.PublicKey); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid public key")
+		return
+	}
+
+	stored, err := Stores.Keys.Publish(r.Context(), store.DeviceKey{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		DeviceID:  req.DeviceID,
+		PublicKey: req.PublicKey,
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to publish key")
+		return
+	}
+	key := DeviceKey(stored)
+
+	notifyKeysChanged(r.Context(), userID)
+	respondWithJSON(w, http.StatusCreated, key)
+}
+
+// RevokeKeyHandler revokes one of the current user's device keys, e.g. for
+// a lost device.
+func RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	var req struct {
+		KeyID string `json:"keyId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	if err := Stores.Keys.Revoke(r.Context(), req.KeyID, userID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			RespondWithError(w, http.StatusNotFound, "Key not found")
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, "Failed to revoke key")
+		return
+	}
+
+	notifyKeysChanged(r.Context(), userID)
+	respondWithJSON(w, http.StatusOK, map[string]string{"message": "Key revoked"})
+}
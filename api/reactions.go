@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxReactionsPerUser caps how many different emoji one user can put on a message.
+const maxReactionsPerUser = 10
+
+// Reaction aggregates one emoji on a message.
+type Reaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"userIds"`
+}
+
+// ValidReaction reports whether emoji looks like a single emoji (possibly a
+// ZWJ sequence) rather than arbitrary text or markup.
+func ValidReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > 32 || utf8.RuneCountInString(emoji) > 10 || !utf8.ValidString(emoji) {
+		return false
+	}
+	if strings.ContainsAny(emoji, `<>&"'`) {
+		return false
+	}
+	hasSymbol := false
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r) {
+			return false
+		}
+		if r >= 0x2000 {
+			hasSymbol = true
+		}
+	}
+	return hasSymbol
+}
+
+// LoadMessageReactions returns the aggregated reactions of the given
+// messages, keyed by message ID, in the order each emoji was first used.
+func LoadMessageReactions(ctx context.Context, messageIDs []string) (map[string][]Reaction, error) {
+	stored, err := Stores.Reactions.ForMessages(ctx, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]Reaction, len(stored))
+	for messageID, list := range stored {
+		reactions := make([]Reaction, len(list))
+		for i, r := range list {
+			reactions[i] = Reaction{Emoji: r.Emoji, Count: len(r.UserIDs), UserIDs: r.UserIDs}
+		}
+		result[messageID] = reactions
+	}
+	return result, nil
+}
+
+// ReactionLimitReached reports whether userID may not add emoji to a
+// message. Adding an emoji userID already put on it changes nothing, so it
+// is always allowed.
+func ReactionLimitReached(ctx context.Context, messageID, userID, emoji string) (bool, error) {
+	used, err := Stores.Reactions.Emoji(ctx, messageID, userID)
+	if err != nil {
+		return false, err
+	}
+	return len(used) >= maxReactionsPerUser && !slices.Contains(used, emoji), nil
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"jj/logging"
+)
+
+// What happens to private messages once they expire.
+const (
+	// RetentionPurge deletes expired messages with their edits, reactions
+	// and attachments.
+	RetentionPurge = "purge"
+	// RetentionRedact keeps expired messages as deleted tombstones so the
+	// conversation history still shows that something was said.
+	RetentionRedact = "redact"
+)
+
+// Limits of the disappearing-message timer users can set on a conversation.
+const (
+	MinDisappearingTimer = 60               // one minute
+	MaxDisappearingTimer = 7 * 24 * 60 * 60 // one week
+)
+
+const purgeBatchSize = 500 // expired messages removed per transaction
+
+// ErrInvalidTimer is returned for a disappearing timer outside the allowed range.
+var ErrInvalidTimer = errors.New("invalid disappearing timer")
+
+// ConversationSettings are the retention settings of a private conversation
+// as seen by one of its two participants.
+type ConversationSettings struct {
+	WithUserID          string `json:"withUserId"`
+	RetentionSeconds    int64  `json:"retentionSeconds"`
+	DisappearingSeconds int64  `json:"disappearingSeconds"`
+	// EffectiveRetentionSeconds is the shorter of the global and the
+	// conversation retention; zero means messages are kept forever.
+	EffectiveRetentionSeconds int64 `json:"effectiveRetentionSeconds"`
+	// Encrypted is set once the first end-to-end encrypted message is
+	// sent and never cleared.
+	Encrypted bool   `json:"encrypted"`
+	UpdatedBy string `json:"updatedBy,omitempty"`
+}
+
+// effectiveRetention combines the global retention with a conversation's,
+// in seconds; zero means no limit.
+func effectiveRetention(conversation int64) int64 {
+	global := int64(conf.Retention.Messages.D() / time.Second)
+	if conversation > 0 && (global == 0 || conversation < global) {
+		return conversation
+	}
+	return global
+}
+
+// ValidDisappearingTimer reports whether seconds can be used as a
+// disappearing timer; zero turns the timer off.
+func ValidDisappearingTimer(seconds int64) bool {
+	return seconds == 0 || (seconds >= MinDisappearingTimer && seconds <= MaxDisappearingTimer)
+}
+
+// LoadConversationSettings returns the settings of the conversation between
+// userID and otherID, with defaults if none were ever set.
+func LoadConversationSettings(ctx context.Context, userID, otherID string) (ConversationSettings, error) {
+	cs, err := Stores.Settings.Get(ctx, userID, otherID)
+	if err != nil {
+		return ConversationSettings{WithUserID: otherID}, err
+	}
+	return ConversationSettings{
+		WithUserID:                otherID,
+		RetentionSeconds:          cs.RetentionSeconds,
+		DisappearingSeconds:       cs.DisappearingSeconds,
+		EffectiveRetentionSeconds: effectiveRetention(cs.RetentionSeconds),
+		Encrypted:                 cs.Encrypted,
+		UpdatedBy:                 cs.UpdatedBy,
+	}, nil
+}
+
+// SetDisappearingTimer sets the disappearing timer of the conversation
+// between userID and otherID. Messages sent from now on expire that many
+// seconds after they are sent; earlier ones are not affected.
+func SetDisappearingTimer(ctx context.Context, userID, otherID string, seconds int64) (ConversationSettings, error) {
+	if !ValidDisappearingTimer(seconds) {
+		return ConversationSettings{}, ErrInvalidTimer
+	}
+	if err := Stores.Settings.SetDisappearing(ctx, userID, otherID, seconds); err != nil {
+		return ConversationSettings{}, err
+	}
+	return LoadConversationSettings(ctx, userID, otherID)
+}
+
+// NotifyConversationSettings announces new conversation settings to both
+// participants, each seeing the other as withUserId.
+func NotifyConversationSettings(userID, otherID string, s ConversationSettings) {
+	s.WithUserID = otherID
+	NotifyUsers([]string{userID}, "conversation_settings_updated", s)
+	s.WithUserID = userID
+	NotifyUsers([]string{otherID}, "conversation_settings_updated", s)
+}
+
+// ConversationSettingsHandler returns (GET ?with=) or changes (POST) the
+// retention settings of a private conversation of the current user.
+func ConversationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	if r.Method == "GET" {
+		withUserID := r.URL.Query().Get("with")
+		if withUserID == "" || withUserID == userID {
+			RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		settings, err := LoadConversationSettings(r.Context(), userID, withUserID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to fetch conversation settings")
+			return
+		}
+		respondWithJSON(w, http.StatusOK, settings)
+		return
+	}
+
+	var req struct {
+		WithUserID       string `json:"withUserId"`
+		RetentionSeconds int64  `json:"retentionSeconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request format")
+		return
+	}
+	if req.WithUserID == "" || req.WithUserID == userID {
+		RespondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	// A conversation can shorten the global retention, never extend it
+	global := int64(conf.Retention.Messages.D() / time.Second)
+	if req.RetentionSeconds < 0 || (global > 0 && req.RetentionSeconds > global) {
+		RespondWithError(w, http.StatusBadRequest, "Retention exceeds the server limit")
+		return
+	}
+	if blocked, err := IsBlocked(r.Context(), userID, req.WithUserID); err != nil || blocked {
+		RespondWithError(w, http.StatusForbidden, "You cannot change this conversation")
+		return
+	}
+
+	if err := Stores.Settings.SetRetention(r.Context(), userID, req.WithUserID, req.RetentionSeconds); err != nil {
+		// The only foreign key that can fail here is the other user
+		RespondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	settings, err := LoadConversationSettings(r.Context(), userID, req.WithUserID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch conversation settings")
+		return
+	}
+
+	NotifyConversationSettings(userID, req.WithUserID, settings)
+	respondWithJSON(w, http.StatusOK, settings)
+}
+
+// RunRetention removes expired private messages, and uploads that were
+// never sent, every interval until ctx is cancelled.
+func RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := PurgeExpiredMessages(ctx); err != nil && ctx.Err() == nil {
+			logging.FromContext(ctx).Error("Failed to purge expired messages", "error", err)
+		} else if n > 0 {
+			logging.FromContext(ctx).Info("Expired private messages", "count", n, "mode", conf.Retention.Mode)
+		}
+		if n, err := PurgePendingAttachments(ctx); err != nil && ctx.Err() == nil {
+			logging.FromContext(ctx).Error("Failed to purge pending attachments", "error", err)
+		} else if n > 0 {
+			logging.FromContext(ctx).Info("Removed unsent attachments", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeExpiredMessages purges or redacts, according to the retention mode, every
+// private message past its disappearing timer or its conversation's
+// effective retention, in batches of purgeBatchSize. It returns how many
+// messages were expired; cancelling ctx stops it between or inside batches.
+func PurgeExpiredMessages(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := expireBatch(ctx)
+		total += n
+		if err != nil || n < purgeBatchSize {
+			return total, err
+		}
+	}
+}
+
+// expireBatch expires up to purgeBatchSize messages and announces them to
+// their participants.
+func expireBatch(ctx context.Context) (int, error) {
+	// Tombstones are already as redacted as they get
+	redact := conf.Retention.Mode == RetentionRedact
+	batch, err := Stores.Messages.Expired(ctx, conf.Retention.Messages.D(), redact, purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, len(batch))
+	for i, m := range batch {
+		ids[i] = m.ID
+		// Stored files go first, their rows would cascade away with the message
+		if err := DeleteMessageAttachments(ctx, m.ID); err != nil {
+			logging.FromContext(ctx).Error("Failed to delete message attachments", "message_id", m.ID, "error", err)
+		}
+	}
+	if err := Stores.Messages.Expire(ctx, ids, redact); err != nil {
+		return 0, err
+	}
+
+	// Tell each conversation which of its messages are gone
+	byPair := make(map[[2]string][]string)
+	for _, m := range batch {
+		pair := [2]string{m.SenderID, m.ReceiverID}
+		if pair[0] > pair[1] {
+			pair[0], pair[1] = pair[1], pair[0]
+		}
+		byPair[pair] = append(byPair[pair], m.ID)
+	}
+	for pair, messageIDs := range byPair {
+		NotifyUsers(pair[:], "messages_expired", map[string]interface{}{
+			"messageIds": messageIDs,
+			"mode":       conf.Retention.Mode,
+		})
+	}
+	return len(batch), nil
+}
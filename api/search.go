@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"jj/models"
+	"jj/store"
+)
+
+const (
+	searchContextSize  = 2  // messages returned on each side of a match
+	defaultSearchLimit = 20 // matches per request
+	maxSearchLimit     = 50
+)
+
+// SearchResult is a private message matching a search, with enough
+// context to open the conversation at that point.
+type SearchResult struct {
+	ID         string    `json:"id"`
+	SenderID   string    `json:"senderId"`
+	ReceiverID string    `json:"receiverId"`
+	WithUserID string    `json:"withUserId"`
+	Sender     string    `json:"sender"`
+	Content    string    `json:"content"`
+	Timestamp  time.Time `json:"timestamp"`
+	// Before and After are the IDs of the neighbouring messages in the
+	// conversation, oldest first.
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+	// Offset is the number of newer messages in the conversation; passed as
+	// GetMessagesHandler's offset it loads the page starting at the match.
+	Offset int `json:"offset"`
+}
+
+// SearchMessagesHandler searches the current user's private messages, in
+// every conversation or only the one with the user given in "with".
+func SearchMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(q) < 2 || len(q) > 100 {
+		RespondWithError(w, http.StatusBadRequest, "Search must be between 2 and 100 characters")
+		return
+	}
+	// Stored content is HTML-escaped, so the terms must be too
+	terms := strings.Fields(models.Skip(q))
+	withUserID := r.URL.Query().Get("with")
+
+	limit := defaultSearchLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxSearchLimit)
+	}
+
+	matches, err := Stores.Messages.Search(r.Context(), store.MessageSearch{
+		UserID:     userID,
+		WithUserID: withUserID,
+		Terms:      terms,
+		Limit:      limit,
+		Context:    searchContextSize,
+	})
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to search messages")
+		return
+	}
+
+	results := make([]SearchResult, 0, len(matches))
+	for _, m := range matches {
+		res := SearchResult{
+			ID:         m.ID,
+			SenderID:   m.SenderID,
+			ReceiverID: m.ReceiverID,
+			WithUserID: m.ReceiverID,
+			Sender:     m.Sender,
+			Content:    m.Content,
+			Timestamp:  m.CreatedAt,
+			Before:     m.Before,
+			After:      m.After,
+			Offset:     m.Offset,
+		}
+		if res.WithUserID == userID {
+			res.WithUserID = res.SenderID
+		}
+		results = append(results, res)
+	}
+
+	respondWithJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// UnreadSummary totals what a user has not read yet: private messages per
+// sender and group messages per conversation.
+type UnreadSummary struct {
+	Total   int            `json:"total"`
+	Senders []UnreadSender `json:"senders"`
+	Groups  []UnreadGroup  `json:"groups"`
+}
+
+// UnreadSender counts the unread private messages from one sender.
+type UnreadSender struct {
+	SenderID      string    `json:"senderId"`
+	Nickname      string    `json:"nickname"`
+	Count         int       `json:"count"`
+	LastMessageAt time.Time `json:"lastMessageAt"`
+}
+
+// UnreadGroup counts the unread messages of one group conversation.
+type UnreadGroup struct {
+	ConversationID string `json:"conversationId"`
+	Name           string `json:"name"`
+	Count          int    `json:"count"`
+}
+
+// LoadUnreadSummary computes the unread totals for userID.
+func LoadUnreadSummary(ctx context.Context, userID string) (UnreadSummary, error) {
+	summary := UnreadSummary{Senders: []UnreadSender{}, Groups: []UnreadGroup{}}
+
+	senders, err := Stores.Messages.UnreadBySender(ctx, userID)
+	if err != nil {
+		return summary, err
+	}
+	for _, u := range senders {
+		summary.Total += u.Count
+		summary.Senders = append(summary.Senders, UnreadSender(u))
+	}
+
+	groups, err := Stores.Groups.Unread(ctx, userID)
+	if err != nil {
+		return summary, err
+	}
+	for _, g := range groups {
+		summary.Total += g.Count
+		summary.Groups = append(summary.Groups, UnreadGroup(g))
+	}
+	return summary, nil
+}
+
+// GetUnreadHandler returns the current user's unread message totals.
+func GetUnreadHandler(w http.ResponseWriter, r *http.Request) {
+	k := r.Header.Get("Accept")
+	if k != "*/*" {
+		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
+		return
+	}
+	if r.Method != "GET" {
+		RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	userID, err := authenticateUser(r)
+	if err != nil {
+		RespondWithError(w, http.StatusUnauthorized, "Authentication required")
+		return
+	}
+
+	summary, err := LoadUnreadSummary(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, "Failed to fetch unread messages")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,41 @@
+// Package broker moves realtime events between the server instances that
+// hold websocket connections, and tracks which users are connected to any
+// of them.
+package broker
+
+import "encoding/json"
+
+// Message is an event addressed to users. Every instance delivers it to
+// the matching connections it holds.
+type Message struct {
+	// UserIDs are the recipients. Empty means every connected user.
+	UserIDs []string `json:"userIds,omitempty"`
+	// Except leaves users out of a message sent to everyone.
+	Except []string `json:"except,omitempty"`
+	// Event is the encoded frame written to the connections.
+	Event json.RawMessage `json:"event"`
+}
+
+// Broker publishes messages to every subscribed instance, the publishing
+// one included.
+type Broker interface {
+	// Publish sends msg to every instance.
+	Publish(msg Message) error
+	// Subscribe registers the function that delivers messages to local
+	// connections. It replaces any previous subscriber; nil unsubscribes.
+	Subscribe(deliver func(Message))
+	// Close stops the broker and releases its resources.
+	Close() error
+}
+
+// Presence counts the live connections of each user across all instances.
+type Presence interface {
+	// Connect registers a connection for userID and reports whether it is
+	// the user's first one anywhere (offline -> online).
+	Connect(userID string) (bool, error)
+	// Disconnect removes a connection for userID and reports whether it
+	// was the user's last one anywhere (online -> offline).
+	Disconnect(userID string) (bool, error)
+	// Online returns the IDs of all users with at least one connection, sorted.
+	Online() ([]string, error)
+}
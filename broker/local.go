@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+)
+
+// Local is a Broker for a single server instance: published messages are
+// handed straight to the subscriber.
+type Local struct {
+	mu      sync.RWMutex
+	deliver func(Message)
+}
+
+// NewLocal returns an in-process broker.
+func NewLocal() *Local {
+	return &Local{}
+}
+
+// Publish delivers msg to the local subscriber.
+func (b *Local) Publish(msg Message) error {
+	b.mu.RLock()
+	deliver := b.deliver
+	b.mu.RUnlock()
+	if deliver != nil {
+		deliver(msg)
+	}
+	return nil
+}
+
+// Subscribe sets the function that receives published messages.
+func (b *Local) Subscribe(deliver func(Message)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deliver = deliver
+}
+
+// Close does nothing; Local holds no resources.
+func (b *Local) Close() error {
+	return nil
+}
+
+// LocalPresence keeps track of how many live connections each user has on
+// this instance. A user is online while their connection count is above zero.
+type LocalPresence struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewLocalPresence returns an empty presence registry.
+func NewLocalPresence() *LocalPresence {
+	return &LocalPresence{counts: make(map[string]int)}
+}
+
+// Connect registers a new connection for userID and reports whether
+// this was the user's first connection (offline -> online).
+func (p *LocalPresence) Connect(userID string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counts[userID]++
+	return p.counts[userID] == 1, nil
+}
+
+// Disconnect removes a connection for userID and reports whether this
+// was the user's last connection (online -> offline).
+func (p *LocalPresence) Disconnect(userID string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n, ok := p.counts[userID]
+	if !ok {
+		return false, nil
+	}
+	if n <= 1 {
+		delete(p.counts, userID)
+		return true, nil
+	}
+	p.counts[userID] = n - 1
+	return false, nil
+}
+
+// Online returns the IDs of all users with at least one live connection.
+func (p *LocalPresence) Online() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := make([]string, 0, len(p.counts))
+	for id := range p.counts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
@@ -0,0 +1,360 @@
+package broker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Timings of the SQLite broker.
+const (
+	pollInterval      = 100 * time.Millisecond
+	heartbeatInterval = 2 * time.Second
+	instanceTimeout   = 10 * time.Second
+	eventRetention    = time.Minute
+)
+
+// SQLite is a Broker and Presence shared by server instances on one host
+// that use the same SQLite database file.
+//
+// Published messages are appended to the broker_events outbox, which every
+// instance polls. Connection counts live in presence_instances, one row per
+// instance and user. Each instance keeps its broker_instances heartbeat
+// fresh; the rows of an instance that stops doing so (because it crashed)
+// are removed by the others.
+type SQLite struct {
+	db         *sql.DB
+	instanceID string
+
+	mu        sync.RWMutex
+	deliver   func(Message)
+	onOffline func(userID string)
+
+	lastID int64 // last outbox row seen, only used by pollLoop
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewSQLite registers instanceID and starts polling the outbox and
+// sending heartbeats.
+func NewSQLite(db *sql.DB, instanceID string) (*SQLite, error) {
+	b := &SQLite{db: db, instanceID: instanceID, stop: make(chan struct{})}
+	if err := b.heartbeat(); err != nil {
+		return nil, fmt.Errorf("failed to register broker instance: %w", err)
+	}
+	// Only messages published from now on are of interest
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM broker_events`).Scan(&b.lastID); err != nil {
+		return nil, fmt.Errorf("failed to read broker outbox: %w", err)
+	}
+
+	b.wg.Add(2)
+	go b.pollLoop()
+	go b.heartbeatLoop()
+	return b, nil
+}
+
+// InstanceID returns the ID this instance registered with.
+func (b *SQLite) InstanceID() string {
+	return b.instanceID
+}
+
+// Publish delivers msg locally right away and stores it in the outbox for
+// the other instances.
+func (b *SQLite) Publish(msg Message) error {
+	b.deliverLocal(msg)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec(`
+        INSERT INTO broker_events (origin, message, created_at) VALUES (?, ?, ?)`,
+		b.instanceID, string(data), time.Now().Unix())
+	return err
+}
+
+// Subscribe sets the function that receives published messages.
+func (b *SQLite) Subscribe(deliver func(Message)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deliver = deliver
+}
+
+// OnStaleOffline sets the function called for each user who went offline
+// because the instances holding their connections stopped sending heartbeats.
+func (b *SQLite) OnStaleOffline(fn func(userID string)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onOffline = fn
+}
+
+// Close stops polling and removes this instance and its presence rows.
+// Connections should be closed before, so their users are announced offline.
+func (b *SQLite) Close() error {
+	close(b.stop)
+	b.wg.Wait()
+
+	if _, err := b.db.Exec(`DELETE FROM presence_instances WHERE instance_id = ?`, b.instanceID); err != nil {
+		return err
+	}
+	_, err := b.db.Exec(`DELETE FROM broker_instances WHERE id = ?`, b.instanceID)
+	return err
+}
+
+// Connect registers a connection for userID on this instance.
+func (b *SQLite) Connect(userID string) (bool, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var before int
+	err = tx.QueryRow(`
+        SELECT COALESCE(SUM(connections), 0) FROM presence_instances WHERE user_id = ?`,
+		userID).Scan(&before)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+        INSERT INTO presence_instances (instance_id, user_id, connections) VALUES (?, ?, 1)
+        ON CONFLICT (instance_id, user_id) DO UPDATE SET connections = connections + 1`,
+		b.instanceID, userID)
+	if err != nil {
+		return false, err
+	}
+	return before == 0, tx.Commit()
+}
+
+// Disconnect removes a connection for userID from this instance.
+func (b *SQLite) Disconnect(userID string) (bool, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+        UPDATE presence_instances SET connections = connections - 1
+        WHERE instance_id = ? AND user_id = ? AND connections > 0`,
+		b.instanceID, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	_, err = tx.Exec(`
+        DELETE FROM presence_instances WHERE instance_id = ? AND user_id = ? AND connections <= 0`,
+		b.instanceID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	var remaining int
+	err = tx.QueryRow(`
+        SELECT COALESCE(SUM(connections), 0) FROM presence_instances WHERE user_id = ?`,
+		userID).Scan(&remaining)
+	if err != nil {
+		return false, err
+	}
+	return remaining == 0, tx.Commit()
+}
+
+// Online returns the users connected to any live instance.
+func (b *SQLite) Online() ([]string, error) {
+	rows, err := b.db.Query(`
+        SELECT DISTINCT user_id FROM presence_instances WHERE connections > 0 ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// deliverLocal hands msg to the subscriber, if there is one yet.
+func (b *SQLite) deliverLocal(msg Message) {
+	b.mu.RLock()
+	deliver := b.deliver
+	b.mu.RUnlock()
+	if deliver != nil {
+		deliver(msg)
+	}
+}
+
+// pollLoop delivers the messages other instances publish.
+func (b *SQLite) pollLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if err := b.poll(); err != nil {
+				log.Printf("Failed to poll broker outbox: %v", err)
+			}
+		}
+	}
+}
+
+// poll reads the outbox rows added since the last call.
+func (b *SQLite) poll() error {
+	rows, err := b.db.Query(`
+        SELECT id, origin, message FROM broker_events WHERE id > ? ORDER BY id`, b.lastID)
+	if err != nil {
+		return err
+	}
+
+	var messages []Message
+	for rows.Next() {
+		var id int64
+		var origin, data string
+		if err := rows.Scan(&id, &origin, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		b.lastID = id
+		if origin == b.instanceID {
+			continue // already delivered by Publish
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			log.Printf("Skipping malformed broker event %d: %v", id, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	err = rows.Err()
+	rows.Close()
+
+	// Deliver after the rows are closed, so slow connections don't hold the read open
+	for _, msg := range messages {
+		b.deliverLocal(msg)
+	}
+	return err
+}
+
+// heartbeatLoop keeps this instance registered, removes dead instances and
+// trims the outbox.
+func (b *SQLite) heartbeatLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if err := b.heartbeat(); err != nil {
+				log.Printf("Failed to send broker heartbeat: %v", err)
+			}
+			if err := b.reap(); err != nil {
+				log.Printf("Failed to remove stale broker instances: %v", err)
+			}
+			cutoff := time.Now().Add(-eventRetention).Unix()
+			if _, err := b.db.Exec(`DELETE FROM broker_events WHERE created_at < ?`, cutoff); err != nil {
+				log.Printf("Failed to trim broker outbox: %v", err)
+			}
+		}
+	}
+}
+
+// heartbeat records that this instance is alive.
+func (b *SQLite) heartbeat() error {
+	_, err := b.db.Exec(`
+        INSERT INTO broker_instances (id, heartbeat_at) VALUES (?, ?)
+        ON CONFLICT (id) DO UPDATE SET heartbeat_at = excluded.heartbeat_at`,
+		b.instanceID, time.Now().Unix())
+	return err
+}
+
+// reap removes instances whose heartbeat timed out together with their
+// presence rows, and reports the users that left offline.
+func (b *SQLite) reap() error {
+	cutoff := time.Now().Add(-instanceTimeout).Unix()
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+        SELECT DISTINCT p.user_id
+        FROM presence_instances p
+        JOIN broker_instances i ON i.id = p.instance_id
+        WHERE i.heartbeat_at < ?`, cutoff)
+	if err != nil {
+		return err
+	}
+	var affected []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		affected = append(affected, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        DELETE FROM presence_instances
+        WHERE instance_id IN (SELECT id FROM broker_instances WHERE heartbeat_at < ?)`, cutoff)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM broker_instances WHERE heartbeat_at < ?`, cutoff)
+	if err != nil {
+		return err
+	}
+
+	var offline []string
+	for _, id := range affected {
+		var remaining int
+		err := tx.QueryRow(`
+            SELECT COALESCE(SUM(connections), 0) FROM presence_instances WHERE user_id = ?`,
+			id).Scan(&remaining)
+		if err != nil {
+			return err
+		}
+		if remaining == 0 {
+			offline = append(offline, id)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Printf("Removed %d stale broker instances", n)
+	}
+
+	b.mu.RLock()
+	onOffline := b.onOffline
+	b.mu.RUnlock()
+	if onOffline != nil {
+		for _, id := range offline {
+			onOffline(id)
+		}
+	}
+	return nil
+}
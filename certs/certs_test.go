@@ -0,0 +1,142 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a new self-signed certificate for localhost to
+// the given files and returns its PEM encoding.
+func writeSelfSigned(t *testing.T, certFile, keyFile string) []byte {
+	t.Helper()
+	certPEM, keyPEM, err := SelfSigned(time.Hour, "localhost", "127.0.0.1", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPEM
+}
+
+// serve starts an HTTPS server, HTTP/2 enabled, that takes its certificate
+// from r the way main configures it.
+func serve(t *testing.T, r *Reloader) *httptest.Server {
+	t.Helper()
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.TLS = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: r.GetCertificate}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// client trusts the given certificates for localhost. Each request opens a
+// new connection, so it sees the certificate in use at the time.
+func client(t *testing.T, certPEMs ...[]byte) *http.Client {
+	t.Helper()
+	roots := x509.NewCertPool()
+	for _, p := range certPEMs {
+		if !roots.AppendCertsFromPEM(p) {
+			t.Fatal("invalid certificate PEM")
+		}
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, ServerName: "localhost"},
+		ForceAttemptHTTP2: true,
+		DisableKeepAlives: true,
+	}}
+}
+
+// serial makes a request to s and returns the serial number of the
+// certificate the server presented.
+func serial(t *testing.T, c *http.Client, s *httptest.Server) *big.Int {
+	t.Helper()
+	resp, err := c.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("negotiated %s, want HTTP/2", resp.Proto)
+	}
+	return resp.TLS.PeerCertificates[0].SerialNumber
+}
+
+// parseCert decodes the certificate in certPEM.
+func parseCert(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("invalid certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestReloadSwapsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	first := writeSelfSigned(t, certFile, keyFile)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := serve(t, r)
+
+	second := writeSelfSigned(t, certFile, keyFile)
+	c := client(t, first, second)
+
+	// Until Reload, the server keeps presenting the certificate it loaded
+	if got, want := serial(t, c, s), parseCert(t, first).SerialNumber; got.Cmp(want) != 0 {
+		t.Errorf("before Reload: serial %x, want %x", got, want)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := serial(t, c, s), parseCert(t, second).SerialNumber; got.Cmp(want) != 0 {
+		t.Errorf("after Reload: serial %x, want %x", got, want)
+	}
+
+	// A failed reload leaves the current certificate in use
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("Reload with a broken key: no error")
+	}
+	if got, want := serial(t, c, s), parseCert(t, second).SerialNumber; got.Cmp(want) != 0 {
+		t.Errorf("after a failed Reload: serial %x, want %x", got, want)
+	}
+}
+
+func TestSelfSignedHosts(t *testing.T) {
+	certPEM, _, err := SelfSigned(time.Hour, "forum.test", "10.0.0.1", "::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCert(t, certPEM)
+	for _, host := range []string{"forum.test", "10.0.0.1", "::1"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Errorf("VerifyHostname(%s): %v", host, err)
+		}
+	}
+	if err := cert.VerifyHostname("other.test"); err == nil {
+		t.Error("VerifyHostname(other.test): no error")
+	}
+}
@@ -0,0 +1,157 @@
+// Command msgbench measures how many private messages per second the
+// SQLite store sustains while other connections authenticate and read
+// conversations, the load the websocket hub puts on it.
+//
+//	go run ./cmd/msgbench -duration 10s -senders 16 -readers 8
+//
+// Each sender authenticates its session and sends a message in a loop,
+// as a connected client does for every frame. Run it with -shared-writer
+// to send through the pool instead of the serialized writer, or with
+// -journal-mode delete to compare against SQLite's defaults.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jj/config"
+	"jj/database"
+	"jj/store"
+	"jj/store/sqlstore"
+
+	"github.com/google/uuid"
+)
+
+func main() {
+	cfg := config.Default().Database
+	duration := flag.Duration("duration", 10*time.Second, "how long to send messages")
+	senders := flag.Int("senders", 16, "concurrent senders")
+	readers := flag.Int("readers", 8, "concurrent conversation readers")
+	sharedWriter := flag.Bool("shared-writer", false, "send through the connection pool instead of the serialized writer")
+	path := flag.String("db", "", "database file (default: a temporary file)")
+	flag.StringVar(&cfg.JournalMode, "journal-mode", cfg.JournalMode, "SQLite journal mode")
+	flag.StringVar(&cfg.Synchronous, "synchronous", cfg.Synchronous, "SQLite synchronous setting")
+	flag.IntVar(&cfg.MaxOpenConns, "max-open-conns", cfg.MaxOpenConns, "maximum open connections, 0 for no limit")
+	busyTimeout := flag.Duration("busy-timeout", cfg.BusyTimeout.D(), "how long to wait for a locked database")
+	flag.Parse()
+	cfg.BusyTimeout = config.Duration(*busyTimeout)
+
+	if *path == "" {
+		dir, err := os.MkdirTemp("", "msgbench")
+		if err != nil {
+			log.Fatalf("Failed to create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		*path = filepath.Join(dir, "bench.db")
+	}
+	cfg.Path = *path
+
+	if err := database.InitDB(cfg); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer database.CloseDB()
+	if err := database.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	writer := database.Writer
+	if *sharedWriter {
+		writer = database.DB
+	}
+	stores, err := sqlstore.New(database.DB, writer, database.Current)
+	if err != nil {
+		log.Fatalf("Failed to prepare database statements: %v", err)
+	}
+
+	ctx := context.Background()
+	tokens := make([]string, 2*max(*senders, *readers))
+	ids := make([]string, len(tokens))
+	for i := range tokens {
+		ids[i], tokens[i] = uuid.New().String(), uuid.New().String()
+		err := stores.Users.Create(ctx, store.NewUser{
+			ID:       ids[i],
+			Nickname: fmt.Sprintf("bench%d", i),
+			Age:      30,
+			Gender:   "other",
+			Email:    fmt.Sprintf("bench%d@example.com", i),
+		})
+		if err == nil {
+			err = stores.Sessions.Create(ctx, ids[i], tokens[i])
+		}
+		if err != nil {
+			log.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	var sent, reads, failures atomic.Int64
+	var mu sync.Mutex
+	var latencies []time.Duration
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+
+	for i := 0; i < *senders; i++ {
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			var local []time.Duration
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				senderID, err := stores.Sessions.UserID(ctx, tokens[from])
+				if err == nil {
+					_, err = stores.Messages.SendPrivate(ctx, store.NewPrivateMessage{
+						ID:         uuid.New().String(),
+						SenderID:   senderID,
+						ReceiverID: ids[to],
+						Content:    "benchmark message",
+					})
+				}
+				if err != nil {
+					failures.Add(1)
+					continue
+				}
+				local = append(local, time.Since(start))
+				sent.Add(1)
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}(2*i, 2*i+1)
+	}
+	for i := 0; i < *readers; i++ {
+		wg.Add(1)
+		go func(user, other int) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				_, err := stores.Sessions.UserID(ctx, tokens[user])
+				if err == nil {
+					_, err = stores.Messages.ListPrivate(ctx, ids[user], ids[other], 50, 0)
+				}
+				if err != nil {
+					failures.Add(1)
+					continue
+				}
+				reads.Add(1)
+			}
+		}(2*i+1, 2*i)
+	}
+	wg.Wait()
+
+	seconds := duration.Seconds()
+	fmt.Printf("journal_mode=%s synchronous=%s senders=%d readers=%d shared-writer=%t\n",
+		cfg.JournalMode, cfg.Synchronous, *senders, *readers, *sharedWriter)
+	fmt.Printf("messages: %d (%.0f/s)\n", sent.Load(), float64(sent.Load())/seconds)
+	fmt.Printf("reads:    %d (%.0f/s)\n", reads.Load(), float64(reads.Load())/seconds)
+	fmt.Printf("failures: %d\n", failures.Load())
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf("send latency: p50 %v, p99 %v, max %v\n",
+			latencies[len(latencies)/2], latencies[len(latencies)*99/100], latencies[len(latencies)-1])
+	}
+}
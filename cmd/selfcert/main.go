@@ -0,0 +1,39 @@
+// Command selfcert writes a self-signed certificate and key for trying
+// the server over HTTPS locally.
+//
+//	go run ./cmd/selfcert -hosts localhost,127.0.0.1
+//	go run . -tls-cert cert.pem -tls-key key.pem
+//
+// Browsers warn about the certificate until it is trusted. Running
+// selfcert again and sending the server SIGHUP swaps in the new one.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"jj/certs"
+)
+
+func main() {
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma-separated host names and IP addresses")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "how long the certificate is valid")
+	certFile := flag.String("cert", "cert.pem", "certificate file to write")
+	keyFile := flag.String("key", "key.pem", "private key file to write")
+	flag.Parse()
+
+	certPEM, keyPEM, err := certs.SelfSigned(*validFor, strings.Split(*hosts, ",")...)
+	if err != nil {
+		log.Fatalf("Failed to generate certificate: %v", err)
+	}
+	if err := os.WriteFile(*certFile, certPEM, 0o644); err != nil {
+		log.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(*keyFile, keyPEM, 0o600); err != nil {
+		log.Fatalf("Failed to write key: %v", err)
+	}
+	log.Printf("Wrote %s and %s for %s", *certFile, *keyFile, *hosts)
+}
@@ -4,39 +4,76 @@ import (
 	"database/sql"
 	"fmt"
 	 "log"
-   	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+
+	"jj/config"
+
+   	"github.com/mattn/go-sqlite3"
 
   )
 
 //  DB is the database connection instance.
 var DB *sql.DB
 
+// Writer is the connection the stores write through. On SQLite it is a
+// single connection, so writes queue up in the process instead of
+// retrying against the file lock; on Postgres it is DB.
+var Writer *sql.DB
+
 // InitDB initializes the database connection.
-func InitDB(dataSourceName string) error {
+func InitDB(cfg config.Database) error {
 	var err error
-	DB, err = sql.Open("sqlite3", dataSourceName)
+	Current = Dialect(cfg.Driver)
+	if Current == Postgres {
+		DB, err = sql.Open(postgresDriver, cfg.URL)
+		Writer = DB
+	} else {
+		// Writers take the lock up front so concurrent transactions wait for
+		// busy_timeout instead of failing on lock upgrade. The pragmas are
+		// part of the DSN so every connection of the pool gets them.
+		dataSourceName := fmt.Sprintf("%s?_busy_timeout=%d&_txlock=immediate&_journal_mode=%s&_synchronous=%s&_foreign_keys=on",
+			cfg.Path, cfg.BusyTimeout.D().Milliseconds(), cfg.JournalMode, cfg.Synchronous)
+		DB, err = sql.Open(sqliteDriver, dataSourceName)
+		if err == nil {
+			Writer, err = sql.Open(sqliteDriver, dataSourceName)
+			if err != nil {
+				DB.Close()
+			}
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Enable foreign key support
-	_, err = DB.Exec("PRAGMA foreign_keys = ON")
-	if err != nil {
-		DB.Close()
-		return fmt.Errorf("failed to enable foreign keys: %w", err)
+	DB.SetMaxOpenConns(cfg.MaxOpenConns)
+	DB.SetMaxIdleConns(cfg.MaxIdleConns)
+	DB.SetConnMaxLifetime(cfg.ConnMaxLifetime.D())
+	if Writer != DB {
+		Writer.SetMaxOpenConns(1)
+		Writer.SetMaxIdleConns(1)
+		Writer.SetConnMaxLifetime(cfg.ConnMaxLifetime.D())
 	}
 
-	if err = DB.Ping(); err != nil {
-		DB.Close()
+	if err = DB.Ping(); err == nil {
+		err = Writer.Ping()
+	}
+	if err != nil {
+		CloseDB()
 		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	log.Println("Database connection established successfully.")
+	log.Printf("Database connection established successfully (%s).", Current)
 	return nil
 }
 
 // CloseDB closes the database connection.
 func CloseDB() {
+	if Writer != nil && Writer != DB {
+		if err := Writer.Close(); err != nil {
+			log.Printf("Error closing database writer: %v", err)
+		}
+	}
 	if DB != nil {
 		if err := DB.Close(); err != nil {
 			log.Printf("Error closing database: %v", err)
@@ -46,69 +83,14 @@ func CloseDB() {
 	}
 }
 
-// CreateTables creates all necessary tables in the database.
-func CreateTables() error {
-	tables := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			nickname TEXT UNIQUE NOT NULL,
-			age INTEGER,
-			gender TEXT,
-			first_name TEXT,
-			token TEXT UNIQUE,
-			last_name TEXT,
-			email TEXT UNIQUE NOT NULL,
-			password TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
-			is_online BOOLEAN DEFAULT FALSE
-		)`,
-		`CREATE TABLE IF NOT EXISTS posts (
-			id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			category TEXT,
-			title TEXT,
-			content TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-		)`,
-		`CREATE TABLE IF NOT EXISTS comments (
-			id TEXT PRIMARY KEY,
-			post_id TEXT NOT NULL,
-			user_id TEXT NOT NULL,
-			content TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
-			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-		)`,
-		`CREATE TABLE IF NOT EXISTS private_messages (
-			idss INTEGER PRIMARY KEY AUTOINCREMENT,
-			id TEXT UNIQUE,
-			sender_id TEXT NOT NULL,
-			receiver_id TEXT NOT NULL,
-			content TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			is_read BOOLEAN DEFAULT FALSE,
-			FOREIGN KEY(sender_id) REFERENCES users(id) ON DELETE CASCADE,
-			FOREIGN KEY(receiver_id) REFERENCES users(id) ON DELETE CASCADE
-		)`,
-	}
-
-	for _, table := range tables {
-		_, err := DB.Exec(table)
-		if err != nil {
-			return fmt.Errorf("failed to create table: %w", err)
+// ParseTime parses a timestamp as SQLite returns it from expressions that
+// lose the column's DATETIME type (MAX(), COALESCE(), scalar subqueries).
+func ParseTime(value string) (time.Time, error) {
+	value = strings.TrimSuffix(value, "Z")
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t, nil
 		}
 	}
-	log.Println("Database tables checked/created successfully.")
-	return nil
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", value)
 }
-
-// IsDuplicateKeyError checks if the error is a duplicate key error.
-func IsDuplicateKeyError(err error) bool {
-	if err == nil {
-		return false
-	}
-	return err.Error() == "UNIQUE constraint failed: users.nickname" ||
-		err.Error() == "UNIQUE constraint failed: users.email"
-}
\ No newline at end of file
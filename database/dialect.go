@@ -0,0 +1,81 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect is the SQL flavour of a database backend.
+//
+// Queries are written once with ? placeholders and SQL both backends
+// accept; Postgres connections rewrite the placeholders (see postgres.go).
+// The few expressions the two spell differently come from the methods below.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// Current is the dialect of DB, set by InitDB.
+var Current = SQLite
+
+// SecondsFromNow returns an expression for the current time plus the number
+// of seconds the SQL expression seconds evaluates to, which may be negative.
+func (d Dialect) SecondsFromNow(seconds string) string {
+	if d == Postgres {
+		return "(CURRENT_TIMESTAMP + (" + seconds + ") * INTERVAL '1 second')"
+	}
+	return "datetime('now', (" + seconds + ") || ' seconds')"
+}
+
+// ILike returns the case-insensitive LIKE operator; SQLite's LIKE already
+// ignores ASCII case.
+func (d Dialect) ILike() string {
+	if d == Postgres {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
+
+// IsUniqueViolation reports whether err comes from a UNIQUE or PRIMARY KEY
+// constraint.
+func (d Dialect) IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	if d == Postgres {
+		return strings.Contains(err.Error(), "duplicate key value violates unique constraint")
+	}
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// Rebind rewrites the ? placeholders of query as $1, $2, ... for Postgres.
+// Question marks inside quoted literals and identifiers are left alone.
+func Rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
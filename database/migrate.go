@@ -0,0 +1,341 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationFiles holds the schema migrations, in one directory per dialect.
+// Each one is a pair of files named NNNN_name.up.sql and, optionally,
+// NNNN_name.down.sql, applied in order of NNNN. Both dialects get the same
+// migrations under the same numbers. Never edit a migration that has been
+// released; add a new one instead.
+//
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer
+// version of the server than this one.
+var ErrSchemaTooNew = errors.New("database schema is newer than this server")
+
+// Migration is one embedded schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string // empty if the migration can't be rolled back
+}
+
+// MigrationState is a migration and when it was applied, if it was.
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations of the current dialect in order.
+func Migrations() ([]Migration, error) {
+	dir := path.Join("migrations", string(Current))
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate brings the database schema up to date, applying each pending
+// migration in its own transaction. It refuses to touch a database that
+// has migrations this server doesn't know about.
+func Migrate() error {
+	migrations, err := Migrations()
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+	states, err := migrationStates(migrations)
+	if err != nil {
+		return err
+	}
+	legacy, err := isLegacySchema()
+	if err != nil {
+		return err
+	}
+
+	for _, st := range states {
+		if st.AppliedAt != nil {
+			continue
+		}
+		if err := applyMigration(st.Migration, legacy && st.Version == migrations[0].Version); err != nil {
+			return fmt.Errorf("failed to apply migration %04d_%s: %w", st.Version, st.Name, err)
+		}
+		log.Printf("Applied migration %04d_%s", st.Version, st.Name)
+	}
+
+	// The search index depends on whether this SQLite build has FTS5, so it
+	// is set up at every start rather than by a migration
+	if Current == Postgres {
+		log.Println("Message search uses ILIKE on Postgres")
+		FullTextSearch = false
+	} else if err := createSearchIndex(); err != nil {
+		return fmt.Errorf("failed to create search index: %w", err)
+	}
+	log.Println("Database schema is up to date.")
+	return nil
+}
+
+// MigrationStatus reports every embedded migration and whether it has been
+// applied, without changing the database.
+func MigrationStatus() ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	exists, err := tableExists("schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		states := make([]MigrationState, len(migrations))
+		for i, m := range migrations {
+			states[i] = MigrationState{Migration: m}
+		}
+		return states, nil
+	}
+	return migrationStates(migrations)
+}
+
+// CheckSchema returns an error unless every embedded migration, and no
+// newer one, has been applied. Readiness checks run it on each probe.
+func CheckSchema(ctx context.Context) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+	var applied, latest int
+	err = DB.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied, &latest)
+	if err != nil {
+		return fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	if want := migrations[len(migrations)-1].Version; latest > want {
+		return ErrSchemaTooNew
+	} else if latest < want || applied < len(migrations) {
+		return fmt.Errorf("%d of %d migrations applied", applied, len(migrations))
+	}
+	return nil
+}
+
+// MigrateDown rolls back the latest applied migration and returns it.
+func MigrateDown() (Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return Migration{}, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	if err := ensureMigrationsTable(); err != nil {
+		return Migration{}, err
+	}
+	states, err := migrationStates(migrations)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	for i := len(states) - 1; i >= 0; i-- {
+		mig := states[i].Migration
+		if states[i].AppliedAt == nil {
+			continue
+		}
+		if mig.Down == "" {
+			return mig, fmt.Errorf("migration %04d_%s can't be rolled back", mig.Version, mig.Name)
+		}
+		tx, err := DB.Begin()
+		if err != nil {
+			return mig, err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(mig.Down); err != nil {
+			return mig, fmt.Errorf("failed to roll back migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, mig.Version); err != nil {
+			return mig, err
+		}
+		return mig, tx.Commit()
+	}
+	return Migration{}, errors.New("no migration has been applied")
+}
+
+func ensureMigrationsTable() error {
+	timestamp := "DATETIME"
+	if Current == Postgres {
+		timestamp = "TIMESTAMPTZ"
+	}
+	_, err := DB.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at ` + timestamp + ` DEFAULT CURRENT_TIMESTAMP
+        )`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+// migrationStates pairs migrations with the schema_migrations rows, and
+// fails with ErrSchemaTooNew if the database has rows for unknown ones.
+func migrationStates(migrations []Migration) ([]MigrationState, error) {
+	rows, err := DB.Query(`SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	known := make(map[int]int, len(migrations))
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		known[m.Version] = i
+		states[i] = MigrationState{Migration: m}
+	}
+	for rows.Next() {
+		var version int
+		var name string
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &name, &appliedAt); err != nil {
+			return nil, err
+		}
+		i, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: it has migration %04d_%s", ErrSchemaTooNew, version, name)
+		}
+		states[i].AppliedAt = &appliedAt
+	}
+	return states, rows.Err()
+}
+
+// applyMigration runs mig and records it in one transaction. adopt marks
+// the first migration being run over a database created before migrations
+// existed, whose tables may lack columns added since.
+func applyMigration(mig Migration, adopt bool) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if adopt {
+		if err := addLegacyColumns(tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(mig.Up); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, mig.Version, mig.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isLegacySchema reports whether the database has tables but no migration
+// recorded, i.e. is a SQLite file created before migrations existed.
+func isLegacySchema() (bool, error) {
+	if Current != SQLite {
+		return false, nil
+	}
+	var applied int
+	if err := DB.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		return false, err
+	}
+	users, err := tableExists("users")
+	return applied == 0 && users, err
+}
+
+// tableExists reports whether the database has a table called name.
+func tableExists(name string) (bool, error) {
+	query := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`
+	if Current == Postgres {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`
+	}
+	var n int
+	err := DB.QueryRow(query, name).Scan(&n)
+	return n > 0, err
+}
+
+// legacyColumns lists the columns that were added to existing tables before
+// migrations existed, when CREATE TABLE IF NOT EXISTS left older database
+// files without them. New columns belong in a migration.
+var legacyColumns = []struct {
+	table, name, definition string
+}{
+	{"private_messages", "edited_at", "DATETIME"},
+	{"private_messages", "is_deleted", "BOOLEAN DEFAULT FALSE"},
+	{"private_messages", "expires_at", "DATETIME"},
+	{"private_messages", "is_encrypted", "BOOLEAN DEFAULT FALSE"},
+	{"conversation_settings", "encrypted", "BOOLEAN NOT NULL DEFAULT FALSE"},
+}
+
+// addLegacyColumns adds any of legacyColumns that an existing table lacks.
+// Missing tables are left to the initial migration.
+func addLegacyColumns(tx *sql.Tx) error {
+	for _, col := range legacyColumns {
+		var columns, n int
+		err := tx.QueryRow(`
+            SELECT COUNT(*), COUNT(CASE WHEN name = ? THEN 1 END) FROM pragma_table_info(?)`,
+			col.name, col.table).Scan(&columns, &n)
+		if err != nil {
+			return fmt.Errorf("failed to inspect table %s: %w", col.table, err)
+		}
+		if columns == 0 || n > 0 {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.name, col.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", col.table, col.name, err)
+		}
+		log.Printf("Added column %s.%s", col.table, col.name)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+-- The Postgres schema matching the SQLite one as of 0001_initial. Types
+-- differ where SQLite is loose: TIMESTAMPTZ for DATETIME, identity columns
+-- for AUTOINCREMENT and BIGINT for row IDs, sizes and durations.
+
+CREATE TABLE users (
+    id TEXT PRIMARY KEY,
+    nickname TEXT UNIQUE NOT NULL,
+    age INTEGER,
+    gender TEXT,
+    first_name TEXT,
+    token TEXT UNIQUE,
+    last_name TEXT,
+    email TEXT UNIQUE NOT NULL,
+    password TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    last_seen TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    is_online BOOLEAN DEFAULT FALSE
+);
+
+CREATE TABLE posts (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    category TEXT,
+    title TEXT,
+    content TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE comments (
+    id TEXT PRIMARY KEY,
+    post_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    content TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE private_messages (
+    idss BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    id TEXT UNIQUE,
+    sender_id TEXT NOT NULL,
+    receiver_id TEXT NOT NULL,
+    content TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    is_read BOOLEAN DEFAULT FALSE,
+    edited_at TIMESTAMPTZ,
+    is_deleted BOOLEAN DEFAULT FALSE,
+    expires_at TIMESTAMPTZ,
+    is_encrypted BOOLEAN DEFAULT FALSE,
+    FOREIGN KEY(sender_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(receiver_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE conversation_settings (
+    user_a TEXT NOT NULL,
+    user_b TEXT NOT NULL,
+    retention_seconds BIGINT NOT NULL DEFAULT 0,
+    disappearing_seconds BIGINT NOT NULL DEFAULT 0,
+    encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_by TEXT,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY(user_a, user_b),
+    CHECK (user_a < user_b),
+    FOREIGN KEY(user_a) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_b) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE conversations (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE conversation_members (
+    conversation_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    joined_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    last_read_idss BIGINT DEFAULT 0,
+    PRIMARY KEY(conversation_id, user_id),
+    FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE group_messages (
+    idss BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    id TEXT UNIQUE,
+    conversation_id TEXT NOT NULL,
+    sender_id TEXT NOT NULL,
+    content TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY(sender_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE private_message_edits (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    message_id TEXT NOT NULL,
+    content TEXT,
+    edited_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(message_id) REFERENCES private_messages(id) ON DELETE CASCADE
+);
+
+CREATE TABLE attachments (
+    id TEXT PRIMARY KEY,
+    uploader_id TEXT NOT NULL,
+    message_id TEXT,
+    file_name TEXT,
+    content_type TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    storage_key TEXT NOT NULL,
+    thumbnail_key TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(uploader_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(message_id) REFERENCES private_messages(id) ON DELETE CASCADE
+);
+
+CREATE TABLE message_reactions (
+    message_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY(message_id, user_id, emoji),
+    FOREIGN KEY(message_id) REFERENCES private_messages(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE user_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    public_key TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMPTZ,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX idx_user_keys_active ON user_keys(user_id, device_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE message_key_envelopes (
+    message_id TEXT NOT NULL,
+    key_id TEXT NOT NULL,
+    envelope TEXT NOT NULL,
+    PRIMARY KEY(message_id, key_id),
+    FOREIGN KEY(message_id) REFERENCES private_messages(id) ON DELETE CASCADE,
+    FOREIGN KEY(key_id) REFERENCES user_keys(id) ON DELETE CASCADE
+);
+
+CREATE TABLE user_blocks (
+    blocker_id TEXT NOT NULL,
+    blocked_id TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('block', 'mute')),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY(blocker_id, blocked_id, kind),
+    FOREIGN KEY(blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(blocked_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE broker_events (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    origin TEXT NOT NULL,
+    message TEXT NOT NULL,
+    created_at BIGINT NOT NULL
+);
+
+CREATE TABLE broker_instances (
+    id TEXT PRIMARY KEY,
+    heartbeat_at BIGINT NOT NULL
+);
+
+CREATE TABLE presence_instances (
+    instance_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    connections INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY(instance_id, user_id)
+);
+
+CREATE INDEX idx_user_blocks_blocked ON user_blocks(blocked_id, kind);
+
+CREATE INDEX idx_attachments_message ON attachments(message_id);
+
+CREATE INDEX idx_private_messages_pair ON private_messages(sender_id, receiver_id, idss);
+
+CREATE INDEX idx_private_messages_unread ON private_messages(receiver_id, is_read);
+
+CREATE INDEX idx_conversation_members_user ON conversation_members(user_id);
+
+CREATE INDEX idx_group_messages_conversation ON group_messages(conversation_id, idss);
+
+CREATE INDEX idx_broker_events_created ON broker_events(created_at);
+
+CREATE INDEX idx_presence_instances_user ON presence_instances(user_id);
+
+CREATE INDEX idx_private_messages_expires ON private_messages(expires_at);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_private_messages_created;
@@ -0,0 +1,3 @@
+-- Lets the retention job find messages older than the retention period
+-- without scanning the whole table.
+CREATE INDEX IF NOT EXISTS idx_private_messages_created ON private_messages(created_at);
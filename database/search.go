@@ -0,0 +1,89 @@
+package database
+
+import (
+	"log"
+	"strings"
+)
+
+// FullTextSearch reports whether private messages are indexed with FTS5.
+// It needs a driver built with the sqlite_fts5 tag (go build -tags
+// sqlite_fts5); without it searches fall back to LIKE scans.
+var FullTextSearch bool
+
+// searchIndexStatements keep private_messages_fts in sync with the content
+// of private_messages, keyed by idss.
+var searchIndexStatements = []string{
+	`CREATE TRIGGER IF NOT EXISTS private_messages_fts_insert AFTER INSERT ON private_messages BEGIN
+		INSERT INTO private_messages_fts(rowid, content) VALUES (new.idss, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS private_messages_fts_delete AFTER DELETE ON private_messages BEGIN
+		INSERT INTO private_messages_fts(private_messages_fts, rowid, content) VALUES ('delete', old.idss, old.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS private_messages_fts_update AFTER UPDATE OF content ON private_messages BEGIN
+		INSERT INTO private_messages_fts(private_messages_fts, rowid, content) VALUES ('delete', old.idss, old.content);
+		INSERT INTO private_messages_fts(rowid, content) VALUES (new.idss, new.content);
+	END`,
+}
+
+// createSearchIndex sets up the FTS5 index over private message content if
+// the driver supports it. The index is rebuilt whenever its triggers were
+// missing, which covers new databases as well as ones last opened by a
+// build without FTS5.
+func createSearchIndex() error {
+	var synced int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'private_messages_fts_insert'`).Scan(&synced)
+	if err != nil {
+		return err
+	}
+
+	var available bool
+	if err := DB.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&available); err != nil {
+		return err
+	}
+	if !available {
+		// Triggers left by an FTS5 build would make every message insert fail
+		for _, name := range []string{"private_messages_fts_insert", "private_messages_fts_delete", "private_messages_fts_update"} {
+			if _, err := DB.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return err
+			}
+		}
+		log.Println("FTS5 is not available, message search falls back to LIKE")
+		FullTextSearch = false
+		return nil
+	}
+
+	_, err = DB.Exec(`
+        CREATE VIRTUAL TABLE IF NOT EXISTS private_messages_fts
+        USING fts5(content, content='private_messages', content_rowid='idss')`)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range searchIndexStatements {
+		if _, err := DB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if synced == 0 {
+		if _, err := DB.Exec(`INSERT INTO private_messages_fts(private_messages_fts) VALUES ('rebuild')`); err != nil {
+			return err
+		}
+	}
+	FullTextSearch = true
+	return nil
+}
+
+// FTSQuery turns user input into an FTS5 query matching messages that
+// contain every term, the last one as a prefix.
+func FTSQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ") + "*"
+}
+
+// LikePattern escapes a term for use in LIKE ... ESCAPE '\'.
+func LikePattern(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(term) + "%"
+}
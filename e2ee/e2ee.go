@@ -0,0 +1,202 @@
+// Package e2ee defines the format of end-to-end encrypted private messages.
+//
+// The server never sees plaintext or private keys. It only checks that what
+// clients send is well formed, using the functions in this file; the rest of
+// the package is a reference implementation of the client side that Go code
+// can use to produce and read real messages.
+//
+// Every device publishes a P-256 public key, encoded as the base64 (standard
+// alphabet) of its uncompressed point, the format WebCrypto exports as "raw".
+//
+// A message is encrypted once with a fresh 256-bit AES-GCM content key:
+//
+//	ciphertext = base64(nonce[12] || AES-GCM(contentKey, nonce, plaintext))
+//
+// The content key is then wrapped for every device of both participants,
+// the sender's own devices included:
+//
+//	kek      = SHA-256(ECDH(ephemeralPrivate, devicePublic))
+//	envelope = base64(ephemeralPublic[65] || nonce[12] || AES-GCM(kek, nonce, contentKey))
+package e2ee
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// Sizes of the encoded parts, in bytes before base64.
+const (
+	publicKeySize  = 65 // uncompressed P-256 point
+	nonceSize      = 12
+	tagSize        = 16
+	contentKeySize = 32
+
+	// EnvelopeSize is the decoded size of every key envelope.
+	EnvelopeSize = publicKeySize + nonceSize + contentKeySize + tagSize
+)
+
+var (
+	// ErrInvalidKey is returned for a public key that is not a P-256 point.
+	ErrInvalidKey = errors.New("invalid public key")
+	// ErrInvalidCiphertext is returned for malformed or oversized ciphertext.
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+	// ErrInvalidEnvelope is returned for a malformed key envelope.
+	ErrInvalidEnvelope = errors.New("invalid key envelope")
+)
+
+var encoding = base64.StdEncoding
+
+// ParsePublicKey decodes a published device key.
+func ParsePublicKey(encoded string) (*ecdh.PublicKey, error) {
+	raw, err := encoding.DecodeString(encoded)
+	if err != nil || len(raw) != publicKeySize {
+		return nil, ErrInvalidKey
+	}
+	key, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// EncodePublicKey encodes a device key for publishing.
+func EncodePublicKey(key *ecdh.PublicKey) string {
+	return encoding.EncodeToString(key.Bytes())
+}
+
+// ValidateCiphertext checks that encoded could be a message produced by
+// Encrypt from at most maxPlaintext bytes; zero or less means no limit.
+func ValidateCiphertext(encoded string, maxPlaintext int) error {
+	raw, err := encoding.DecodeString(encoded)
+	if err != nil || len(raw) < nonceSize+tagSize+1 || (maxPlaintext > 0 && len(raw) > nonceSize+tagSize+maxPlaintext) {
+		return ErrInvalidCiphertext
+	}
+	return nil
+}
+
+// ValidateEnvelope checks that encoded has the shape of a key envelope
+// with a valid ephemeral public key.
+func ValidateEnvelope(encoded string) error {
+	raw, err := encoding.DecodeString(encoded)
+	if err != nil || len(raw) != EnvelopeSize {
+		return ErrInvalidEnvelope
+	}
+	if _, err := ecdh.P256().NewPublicKey(raw[:publicKeySize]); err != nil {
+		return ErrInvalidEnvelope
+	}
+	return nil
+}
+
+// GenerateKey creates a device key pair.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.P256().GenerateKey(rand.Reader)
+}
+
+// Encrypt encrypts plaintext with a new content key and wraps that key for
+// each of the given device keys, keyed like devices.
+func Encrypt(plaintext []byte, devices map[string]*ecdh.PublicKey) (string, map[string]string, error) {
+	if len(plaintext) == 0 {
+		return "", nil, ErrInvalidCiphertext
+	}
+	contentKey := make([]byte, contentKeySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return "", nil, err
+	}
+	sealed, err := seal(contentKey, plaintext)
+	if err != nil {
+		return "", nil, err
+	}
+
+	envelopes := make(map[string]string, len(devices))
+	for id, device := range devices {
+		ephemeral, err := GenerateKey()
+		if err != nil {
+			return "", nil, err
+		}
+		kek, err := keyEncryptionKey(ephemeral, device)
+		if err != nil {
+			return "", nil, err
+		}
+		wrapped, err := seal(kek, contentKey)
+		if err != nil {
+			return "", nil, err
+		}
+		envelopes[id] = encoding.EncodeToString(append(ephemeral.PublicKey().Bytes(), wrapped...))
+	}
+	return encoding.EncodeToString(sealed), envelopes, nil
+}
+
+// Decrypt opens a message with the envelope addressed to device.
+func Decrypt(ciphertext, envelope string, device *ecdh.PrivateKey) ([]byte, error) {
+	if err := ValidateEnvelope(envelope); err != nil {
+		return nil, err
+	}
+	rawEnvelope, _ := encoding.DecodeString(envelope)
+	ephemeral, _ := ecdh.P256().NewPublicKey(rawEnvelope[:publicKeySize])
+	kek, err := keyEncryptionKey(device, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := open(kek, rawEnvelope[publicKeySize:])
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	if err := ValidateCiphertext(ciphertext, 0); err != nil {
+		return nil, err
+	}
+	raw, _ := encoding.DecodeString(ciphertext)
+	plaintext, err := open(contentKey, raw)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+// keyEncryptionKey derives the key that wraps a content key for one device.
+func keyEncryptionKey(private *ecdh.PrivateKey, public *ecdh.PublicKey) ([]byte, error) {
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	kek := sha256.Sum256(secret)
+	return kek[:], nil
+}
+
+// seal encrypts data with AES-GCM under key, prefixed with a random nonce.
+func seal(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// open reverses seal.
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < nonceSize+tagSize {
+		return nil, ErrInvalidCiphertext
+	}
+	return gcm.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,164 @@
+package e2ee
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// devices generates a key pair for each of the given device IDs.
+func devices(t *testing.T, ids ...string) (map[string]*ecdh.PrivateKey, map[string]*ecdh.PublicKey) {
+	t.Helper()
+	private := make(map[string]*ecdh.PrivateKey)
+	public := make(map[string]*ecdh.PublicKey)
+	for _, id := range ids {
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keys go through their published form, as they do between clients
+		parsed, err := ParsePublicKey(EncodePublicKey(key.PublicKey()))
+		if err != nil {
+			t.Fatalf("ParsePublicKey(EncodePublicKey(%s)): %v", id, err)
+		}
+		private[id], public[id] = key, parsed
+	}
+	return private, public
+}
+
+// flip returns encoded with one bit of its decoded byte at index i changed.
+func flip(t *testing.T, encoded string, i int) string {
+	t.Helper()
+	raw, err := encoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[i] ^= 1
+	return encoding.EncodeToString(raw)
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	private, public := devices(t, "alice-laptop", "bob-phone", "bob-tablet")
+	plaintext := []byte("meet at noon")
+
+	ciphertext, envelopes, err := Encrypt(plaintext, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envelopes) != len(public) {
+		t.Fatalf("got %d envelopes for %d devices", len(envelopes), len(public))
+	}
+	if err := ValidateCiphertext(ciphertext, len(plaintext)); err != nil {
+		t.Errorf("ValidateCiphertext: %v", err)
+	}
+	for id, envelope := range envelopes {
+		if err := ValidateEnvelope(envelope); err != nil {
+			t.Errorf("ValidateEnvelope(%s): %v", id, err)
+		}
+		got, err := Decrypt(ciphertext, envelope, private[id])
+		if err != nil {
+			t.Errorf("Decrypt for %s: %v", id, err)
+		} else if !bytes.Equal(got, plaintext) {
+			t.Errorf("Decrypt for %s = %q, want %q", id, got, plaintext)
+		}
+	}
+
+	// An envelope only opens for the device it was wrapped for
+	if _, err := Decrypt(ciphertext, envelopes["bob-phone"], private["alice-laptop"]); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("Decrypt with another device's key: %v, want %v", err, ErrInvalidEnvelope)
+	}
+}
+
+func TestEncryptEmpty(t *testing.T) {
+	_, public := devices(t, "laptop")
+	if _, _, err := Encrypt(nil, public); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Errorf("Encrypt(nil) = %v, want %v", err, ErrInvalidCiphertext)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	private, public := devices(t, "laptop")
+	ciphertext, envelopes, err := Encrypt([]byte("hello"), public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := envelopes["laptop"]
+
+	// Past the ephemeral key, any change fails authentication
+	if _, err := Decrypt(flip(t, ciphertext, nonceSize), envelope, private["laptop"]); !errors.Is(err, ErrInvalidCiphertext) {
+		t.Errorf("tampered ciphertext: %v, want %v", err, ErrInvalidCiphertext)
+	}
+	if _, err := Decrypt(ciphertext, flip(t, envelope, EnvelopeSize-1), private["laptop"]); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("tampered envelope: %v, want %v", err, ErrInvalidEnvelope)
+	}
+}
+
+func TestValidateEnvelope(t *testing.T) {
+	_, public := devices(t, "laptop")
+	_, envelopes, err := Encrypt([]byte("hello"), public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := envelopes["laptop"]
+	raw, _ := encoding.DecodeString(valid)
+
+	tests := []struct {
+		name     string
+		envelope string
+	}{
+		{"empty", ""},
+		{"not base64", "not base64!"},
+		{"truncated", encoding.EncodeToString(raw[:EnvelopeSize-1])},
+		{"oversized", encoding.EncodeToString(append(raw, 0))},
+		{"ephemeral key not on the curve", flip(t, valid, 1)},
+	}
+	for _, tt := range tests {
+		if err := ValidateEnvelope(tt.envelope); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Errorf("%s: ValidateEnvelope = %v, want %v", tt.name, err, ErrInvalidEnvelope)
+		}
+	}
+}
+
+func TestValidateCiphertext(t *testing.T) {
+	_, public := devices(t, "laptop")
+	ciphertext, _, err := Encrypt([]byte(strings.Repeat("x", 100)), public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateCiphertext(ciphertext, 100); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+	if err := ValidateCiphertext(ciphertext, 0); err != nil {
+		t.Errorf("without a limit: %v", err)
+	}
+	tests := []struct {
+		name       string
+		ciphertext string
+		max        int
+	}{
+		{"oversized", ciphertext, 99},
+		{"empty", "", 0},
+		{"not base64", "%%%", 0},
+		{"nonce and tag only", encoding.EncodeToString(make([]byte, nonceSize+tagSize)), 0},
+	}
+	for _, tt := range tests {
+		if err := ValidateCiphertext(tt.ciphertext, tt.max); !errors.Is(err, ErrInvalidCiphertext) {
+			t.Errorf("%s: ValidateCiphertext = %v, want %v", tt.name, err, ErrInvalidCiphertext)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"AAAA",
+		encoding.EncodeToString(make([]byte, publicKeySize)), // the point at infinity is not a key
+	} {
+		if _, err := ParsePublicKey(encoded); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("ParsePublicKey(%q) = %v, want %v", encoded, err, ErrInvalidKey)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Package logging writes the server's logs as JSON through log/slog and
+// carries a logger with request, user and connection attributes in
+// contexts, so every line logged while serving a request can be traced
+// back to it.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// Setup makes a JSON handler writing to w the default logger, for slog and
+// for the log package alike.
+func Setup(w io.Writer, level slog.Level) {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestKey
+)
+
+// WithLogger returns a copy of ctx carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger of ctx: the one set by WithLogger, the
+// request's logger inside Middleware, or else the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		return req.logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,149 @@
+package logging
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxRequestIDLength bounds request IDs taken from clients.
+const maxRequestIDLength = 128
+
+// request is what Middleware learns about a request while it is served.
+type request struct {
+	id     string
+	userID string
+	logger *slog.Logger
+}
+
+// Middleware logs one line per request with its ID, method, path, status,
+// size and latency, and the user once a handler has called SetUser.
+//
+// The request ID is the client's X-Request-ID header, or a new one when
+// there is none. It is echoed in the response and added to every line
+// logged through FromContext while the request is served.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		req := &request{id: id, logger: slog.Default().With("request_id", id)}
+		rec := RecordStatus(w)
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestKey, req)))
+
+		status := rec.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("bytes", rec.Bytes()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+		}
+		req.logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// RequestID returns the ID of the request ctx belongs to, or "".
+func RequestID(ctx context.Context) string {
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		return req.id
+	}
+	return ""
+}
+
+// SetUser attributes the request ctx belongs to to userID: the request's
+// log line and everything logged through FromContext afterwards carry it.
+func SetUser(ctx context.Context, userID string) {
+	req, ok := ctx.Value(requestKey).(*request)
+	if !ok || req.userID == userID {
+		return
+	}
+	req.userID = userID
+	req.logger = slog.Default().With("request_id", req.id, "user_id", userID)
+}
+
+// StatusRecorder remembers the status and size of a response. It passes
+// Flush and Hijack through, so streamed exports and websocket upgrades
+// keep working behind the middleware that use it.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// RecordStatus wraps w in a StatusRecorder. When w already is one, such as
+// when the metrics middleware runs inside Middleware, it is returned as is
+// so each response is wrapped only once.
+func RecordStatus(w http.ResponseWriter) *StatusRecorder {
+	if rec, ok := w.(*StatusRecorder); ok {
+		return rec
+	}
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+// Status returns the status sent, 200 when the handler wrote nothing and
+// 101 after a websocket upgrade.
+func (w *StatusRecorder) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Bytes returns the size of the body written so far.
+func (w *StatusRecorder) Bytes() int64 {
+	return w.bytes
+}
+
+func (w *StatusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *StatusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("logging: response does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *StatusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
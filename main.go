@@ -2,36 +2,156 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"jj/api"
+	"jj/broker"
+	"jj/certs"
+	"jj/config"
 	"jj/database"
+	"jj/logging"
+	"jj/metrics"
+	"jj/storage"
+	"jj/store/sqlstore"
 	"jj/websocket"
+
+	"github.com/google/uuid"
 )
 
+// readHeaderTimeout bounds how long a client may take to send its request
+// headers, so slow clients can't hold connections open.
+const readHeaderTimeout = 10 * time.Second
+
 func main() {
+	// Settings come from defaults, an optional --config file, FORUM_*
+	// environment variables and flags, in increasing priority
+	cfg, opts, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if opts.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
+	// Everything, the log package included, logs JSON lines to stderr
+	logging.Setup(os.Stderr, cfg.Level())
+	api.Configure(cfg)
+	websocket.Configure(cfg)
+
 	// Initialize Database
-	err := database.InitDB("./forum.db")
+	err = database.InitDB(cfg.Database)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.CloseDB() // Ensure database connection is closed
 
-	// Create tables
-	err = database.CreateTables()
+	if opts.Migrate != "" {
+		if err := runMigrateCommand(opts.Migrate); err != nil {
+			log.Fatalf("Migration %s failed: %v", opts.Migrate, err)
+		}
+		return
+	}
+
+	// Bring the schema up to date; a database migrated by a newer server
+	// is left alone and stops this one from starting
+	err = database.Migrate()
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	// Handlers and the websocket hub reach users, sessions, posts and
+	// private messages through the stores of the configured backend
+	stores, err := sqlstore.New(database.DB, database.Writer, database.Current)
+	if err != nil {
+		log.Fatalf("Failed to prepare database statements: %v", err)
+	}
+	api.Stores = stores
+	websocket.Stores = stores
+
+	// Realtime events stay in this process unless the sqlite broker is
+	// configured, which lets several instances on this host share them
+	// through the database
+	b, presence, err := newBroker(cfg.Broker)
 	if err != nil {
-		log.Fatalf("Failed to create database tables: %v", err)
+		log.Fatalf("Failed to initialize broker: %v", err)
+	}
+	websocket.UseBroker(b, presence)
+
+	// Clear online flags left behind by a crash; users connected to other
+	// instances keep theirs
+	if err := websocket.ReconcilePresence(context.Background()); err != nil {
+		log.Fatalf("Failed to reconcile presence: %v", err)
 	}
 
+	// Without storage the attachment endpoints answer 503
+	if cfg.Features.Attachments {
+		files, err := storage.NewLocal(cfg.Uploads)
+		if err != nil {
+			log.Fatalf("Failed to initialize attachment storage: %v", err)
+		}
+		api.Files = files
+	}
+
+	// Let HTTP handlers push realtime events through the websocket hub
+	api.NotifyUsers = websocket.NotifyUsers
+
+	// Private messages are kept forever unless a retention is configured;
+	// expired ones are purged or redacted
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go api.RunRetention(jobs, cfg.Retention.PurgeInterval.D())
+
+	// Every request context derives from base, so cancelling it on
+	// shutdown reaches the websocket connections Shutdown does not track
+	base, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	// Requests are bounded by the request timeout, measured under the
+	// route they match and logged
+	var handler http.Handler = http.DefaultServeMux
+	handler = requestTimeout(handler, cfg.Timeouts.Request.D())
+	handler = hsts(handler, cfg.TLS.HSTSMaxAge.D())
+	handler = metrics.Middleware(http.DefaultServeMux, handler)
+	handler = logging.Middleware(handler)
+
 	// Set up HTTP server
 	server := &http.Server{
-		Addr: "0.0.0.0:8080",
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return base },
+	}
+
+	// With a certificate the server speaks HTTPS, and HTTP/2 to clients
+	// that offer it; SIGHUP reloads the certificate files
+	scheme := "http"
+	if cfg.TLS.Enabled() {
+		reloader, err := certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+		go reloadOnHangup(reloader)
+		scheme = "https"
 	}
 
 	// Static file server
@@ -39,21 +159,44 @@ func main() {
 	// http.Handle("/static/", http.StripPrefix("/static/", fs))
 
 	// API Routes
-	http.HandleFunc("/api/register", api.RateLimitMiddleware(api.RegisterHandler, 5, time.Minute))
-	http.HandleFunc("/api/login", api.RateLimitMiddleware(api.LoginHandler, 5, time.Minute))
+	http.HandleFunc("/api/register", rateLimited(api.RegisterHandler, cfg.RateLimits.Register))
+	http.HandleFunc("/api/login", rateLimited(api.LoginHandler, cfg.RateLimits.Login))
 	http.HandleFunc("/api/logout", api.LogoutHandler)
 	http.HandleFunc("/api/user/me", api.GetCurrentUserHandler)
 	http.HandleFunc("/api/users", api.GetUsersHandler)
+	http.HandleFunc("/api/users/blocked", api.GetBlockedUsersHandler)
+	http.HandleFunc("/api/users/block", api.BlockUserHandler)
+	http.HandleFunc("/api/users/unblock", api.UnblockUserHandler)
+	http.HandleFunc("/api/users/mute", api.MuteUserHandler)
+	http.HandleFunc("/api/users/unmute", api.UnmuteUserHandler)
+	http.HandleFunc("/api/keys", api.GetKeysHandler)
+	http.HandleFunc("/api/keys/publish", api.PublishKeyHandler)
+	http.HandleFunc("/api/keys/revoke", api.RevokeKeyHandler)
 	http.HandleFunc("/api/posts", api.GetPostsHandler)
-	http.HandleFunc("/api/posts/create", api.RateLimitMiddleware(api.CreatePostHandler, 5, time.Minute))
+	http.HandleFunc("/api/posts/create", rateLimited(api.CreatePostHandler, cfg.RateLimits.CreatePost))
 	http.HandleFunc("/api/posts/{id}", api.GetPostHandler)
 	http.HandleFunc("/api/getcomments", api.GetCommentsHandler)
-	http.HandleFunc("/api/comments", api.RateLimitMiddleware(api.CreateCommentHandler, 5, time.Minute))
+	http.HandleFunc("/api/comments", rateLimited(api.CreateCommentHandler, cfg.RateLimits.CreateComment))
 	http.HandleFunc("/api/messages", api.GetMessagesHandler)
+	http.HandleFunc("/api/messages/unread", api.GetUnreadHandler)
+	http.HandleFunc("/api/messages/search", enabled(cfg.Features.Search, api.SearchMessagesHandler))
+	http.HandleFunc("/api/messages/export", enabled(cfg.Features.Export, api.ExportMessagesHandler))
 	http.HandleFunc("/api/posts/forcreate", api.GetPostsHandlerfor)
+	http.HandleFunc("/api/conversations", api.GetConversationsHandler)
+	http.HandleFunc("/api/conversations/settings", api.ConversationSettingsHandler)
+	http.HandleFunc("/api/groups", api.GetGroupsHandler)
+	http.HandleFunc("/api/groups/create", rateLimited(api.CreateGroupHandler, cfg.RateLimits.CreateGroup))
+	http.HandleFunc("/api/groups/rename", api.RenameGroupHandler)
+	http.HandleFunc("/api/groups/leave", api.LeaveGroupHandler)
+	http.HandleFunc("/api/groups/members", api.AddGroupMemberHandler)
+	http.HandleFunc("/api/attachments", rateLimited(api.UploadAttachmentHandler, cfg.RateLimits.UploadAttachment))
+	http.HandleFunc("/api/attachments/{id}", api.GetAttachmentHandler)
 	http.HandleFunc("/static/", api.StyleHandler)
 
 	http.HandleFunc("/api/auto", api.Auto)
+	http.HandleFunc("/metrics", enabled(cfg.Features.Metrics, metrics.Handler().ServeHTTP))
+	http.HandleFunc("/healthz", api.HealthHandler)
+	http.HandleFunc("/readyz", api.ReadyHandler)
 	http.HandleFunc("/ws", websocket.WsHandler)
 
 	// SPA fallback
@@ -67,12 +210,34 @@ func main() {
 
 	// Start server in a goroutine
 	go func() {
-		fmt.Println("Server started at http://localhost:8080")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Info("Server started", "addr", scheme+"://"+server.Addr)
+		var err error
+		if scheme == "https" {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed: %v", err)
 		}
 	}()
 
+	// Plain HTTP requests are sent over to HTTPS
+	var redirect *http.Server
+	if cfg.TLS.RedirectAddr != "" {
+		redirect = &http.Server{
+			Addr:              cfg.TLS.RedirectAddr,
+			Handler:           redirectToHTTPS(cfg.Addr),
+			ReadHeaderTimeout: readHeaderTimeout,
+		}
+		go func() {
+			slog.Info("Redirecting to HTTPS", "addr", "http://"+redirect.Addr)
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Redirect server failed: %v", err)
+			}
+		}()
+	}
+
 	// Handle OS signals for graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -80,17 +245,189 @@ func main() {
 	<-stop // Wait for signal
 	log.Println("Received shutdown signal, initiating graceful shutdown...")
 
+	// Report not ready at once, and give load balancers the configured
+	// delay to notice before connections are refused
+	api.ShuttingDown()
+	if d := cfg.Timeouts.ShutdownDelay.D(); d > 0 {
+		log.Printf("Serving for another %v before shutting down", d)
+		time.Sleep(d)
+	}
+
 	// Create a context with timeout for shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown.D())
 	defer cancel()
 
+	stopJobs()
+
+	// Ask websocket clients to reconnect elsewhere and let them close, with
+	// half of the shutdown timeout; the rest is left for HTTP requests
+	drain, cancelDrain := context.WithTimeout(ctx, cfg.Timeouts.Shutdown.D()/2)
+	if err := websocket.Shutdown(drain); err != nil {
+		log.Printf("WebSocket drain incomplete: %v", err)
+	}
+	cancelDrain()
+
 	// Perform graceful shutdown
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("Server shutdown error: %v", err)
 	} else {
 		log.Println("Server shut down gracefully")
 	}
+	if redirect != nil {
+		if err := redirect.Shutdown(ctx); err != nil {
+			log.Printf("Redirect server shutdown error: %v", err)
+		}
+	}
+
+	// Hijacked websocket connections outlive Shutdown; close the ones that
+	// didn't drain and let their cleanup finish before the database goes away
+	cancelBase()
+	if err := websocket.Wait(ctx); err != nil {
+		log.Printf("WebSocket shutdown error: %v", err)
+	}
+
+	if err := b.Close(); err != nil {
+		log.Printf("Broker shutdown error: %v", err)
+	}
 
 	// Database is closed via defer database.CloseDB()
 	log.Println("Program exiting")
 }
+
+// newBroker creates the realtime broker and presence registry of the given kind.
+func newBroker(cfg config.Broker) (broker.Broker, broker.Presence, error) {
+	switch cfg.Kind {
+	case "local":
+		return broker.NewLocal(), broker.NewLocalPresence(), nil
+	case "sqlite":
+		instanceID := cfg.InstanceID
+		if instanceID == "" {
+			instanceID = uuid.New().String()
+		}
+		b, err := broker.NewSQLite(database.DB, instanceID)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Sharing realtime events through the database as instance %s", b.InstanceID())
+		return b, b, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown broker %q", cfg.Kind)
+	}
+}
+
+// runMigrateCommand shows or rolls back schema migrations for --migrate.
+func runMigrateCommand(command string) error {
+	if command == "down" {
+		mig, err := database.MigrateDown()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Rolled back %04d_%s\n", mig.Version, mig.Name)
+		return nil
+	}
+
+	states, err := database.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, st := range states {
+		if st.AppliedAt != nil {
+			if command == "status" {
+				fmt.Printf("%04d_%s\tapplied %s\n", st.Version, st.Name, st.AppliedAt.Format(time.RFC3339))
+			}
+			continue
+		}
+		pending++
+		if command == "status" {
+			fmt.Printf("%04d_%s\tpending\n", st.Version, st.Name)
+		} else {
+			fmt.Printf("-- %04d_%s\n%s\n", st.Version, st.Name, st.Up)
+		}
+	}
+	if command == "dry-run" && pending == 0 {
+		fmt.Println("-- no pending migrations")
+	}
+	return nil
+}
+
+// rateLimited applies a configured rate limit to handler.
+func rateLimited(handler http.HandlerFunc, limit config.RateLimit) http.HandlerFunc {
+	return api.RateLimitMiddleware(handler, limit.Requests, limit.Window.D())
+}
+
+// enabled serves handler only while its feature is switched on, and
+// answers 404 otherwise.
+func enabled(on bool, handler http.HandlerFunc) http.HandlerFunc {
+	if on {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		api.RespondWithError(w, http.StatusNotFound, "This feature is disabled")
+	}
+}
+
+// requestTimeout bounds the context of each request, and so the database
+// queries made for it, by timeout. Websocket connections and exports run
+// for as long as the client stays and bound their own work instead.
+func requestTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" || r.URL.Path == "/api/messages/export" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// hsts tells browsers to use HTTPS only for maxAge, on responses served
+// over TLS.
+func hsts(handler http.Handler, maxAge time.Duration) http.Handler {
+	if maxAge <= 0 {
+		return handler
+	}
+	value := "max-age=" + strconv.Itoa(int(maxAge/time.Second))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends every request to the same host and path on the
+// HTTPS server listening on addr, keeping the method with a 308.
+func redirectToHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// reloadOnHangup reloads the TLS certificate whenever the process gets
+// SIGHUP, such as after a renewal.
+func reloadOnHangup(reloader *certs.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloader.Reload(); err != nil {
+			log.Printf("Failed to reload TLS certificate: %v", err)
+			continue
+		}
+		log.Println("Reloaded TLS certificate")
+	}
+}
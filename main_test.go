@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"jj/certs"
+)
+
+// tlsServer starts an HTTPS server for handler with a self-signed
+// certificate, the way the server runs with -tls-cert and -tls-key.
+func tlsServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM, err := certs.SelfSigned(time.Hour, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(handler)
+	s.TLS = &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHSTSOnlyOverTLS(t *testing.T) {
+	handler := hsts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 24*time.Hour)
+
+	secure := tlsServer(t, handler)
+	resp, err := secure.Client().Get(secure.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("negotiated %s, want HTTP/2", resp.Proto)
+	}
+	if got, want := resp.Header.Get("Strict-Transport-Security"), "max-age=86400"; got != want {
+		t.Errorf("over TLS: Strict-Transport-Security %q, want %q", got, want)
+	}
+
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	resp, err = plain.Client().Get(plain.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("over plain HTTP: Strict-Transport-Security %q, want none", got)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		addr, target, want string
+	}{
+		{":8443", "http://example.com:8080/api/users?x=1", "https://example.com:8443/api/users?x=1"},
+		{":8443", "http://example.com/", "https://example.com:8443/"},
+		{":443", "http://example.com:8080/login", "https://example.com/login"},
+		{"", "http://example.com:8080/", "https://example.com/"},
+		{":8443", "http://[::1]:8080/chat", "https://[::1]:8443/chat"},
+		{":443", "http://[::1]:8080/chat", "https://[::1]/chat"},
+		{":443", "http://[::1]/chat", "https://[::1]/chat"},
+		{"[::1]:8443", "http://[fe80::1]/", "https://[fe80::1]:8443/"},
+	}
+	for _, tt := range tests {
+		// POST checks that the method survives: 308, not 301
+		r := httptest.NewRequest("POST", tt.target, nil)
+		w := httptest.NewRecorder()
+		redirectToHTTPS(tt.addr).ServeHTTP(w, r)
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s to %s: status %d, want %d", tt.target, tt.addr, w.Code, http.StatusPermanentRedirect)
+		}
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("%s to %s: Location %q, want %q", tt.target, tt.addr, got, tt.want)
+		}
+	}
+}
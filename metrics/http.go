@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"jj/logging"
+)
+
+var (
+	httpRequests = NewCounter("forum_http_requests_total",
+		"HTTP requests served, by route pattern, method and status.", "route", "method", "status")
+	httpDuration = NewHistogram("forum_http_request_duration_seconds",
+		"Time to serve HTTP requests, by route pattern. Websocket upgrades are not included.", DefBuckets, "route")
+)
+
+// Middleware counts and times the requests next serves, labelled with the
+// pattern mux routes them to so that paths with IDs share a series.
+func Middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		rec := logging.RecordStatus(w)
+		next.ServeHTTP(rec, r)
+
+		status := rec.Status()
+		httpRequests.Inc(route, r.Method, strconv.Itoa(status))
+		// A websocket's duration is how long the client stayed connected
+		if status != http.StatusSwitchingProtocols {
+			httpDuration.Observe(time.Since(start).Seconds(), route)
+		}
+	})
+}
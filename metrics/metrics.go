@@ -0,0 +1,307 @@
+// Package metrics keeps counters, gauges and histograms in memory and
+// serves them in the Prometheus text exposition format.
+//
+// Metrics are declared as package variables where they are measured, and
+// register themselves with Default:
+//
+//	var sent = metrics.NewCounter("forum_messages_sent_total", "Messages sent.", "kind")
+//	...
+//	sent.Inc("private")
+//
+// Label values are passed in the order the label names were declared.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are histogram buckets, in seconds, suited to request latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry is a set of metrics served together.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+// Default is the registry the New functions register with.
+var Default = &Registry{}
+
+// family is a named metric with all its label combinations.
+type family interface {
+	write(w io.Writer, name string)
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.families == nil {
+		r.families = map[string]family{}
+	}
+	if _, dup := r.families[name]; dup {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.families[name] = f
+}
+
+// Write writes every metric of r in the text exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.families[name].write(w, name)
+	}
+}
+
+// Handler serves the metrics of Default.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Write(w)
+	})
+}
+
+// vec holds the series of a family, keyed by their label values.
+type vec[T any] struct {
+	mu     sync.Mutex
+	help   string
+	kind   string
+	labels []string
+	series map[string]*labelled[T]
+	zero   func() *T
+}
+
+type labelled[T any] struct {
+	values []string
+	s      T
+}
+
+func newVec[T any](help, kind string, labels []string, zero func() *T) *vec[T] {
+	return &vec[T]{help: help, kind: kind, labels: labels, series: map[string]*labelled[T]{}, zero: zero}
+}
+
+// with returns the series for values, creating it on first use. The
+// caller must hold v.mu.
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for %d labels", len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	l, ok := v.series[key]
+	if !ok {
+		l = &labelled[T]{values: append([]string(nil), values...), s: *v.zero()}
+		v.series[key] = l
+	}
+	return &l.s
+}
+
+// each calls f for every series in label order. The caller must hold v.mu.
+func (v *vec[T]) each(f func(labels string, s *T)) {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l := v.series[key]
+		f(formatLabels(v.labels, l.values), &l.s)
+	}
+}
+
+func (v *vec[T]) header(w io.Writer, name string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, v.kind)
+}
+
+// formatLabels renders name="value" pairs without the braces.
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a value that only goes up, such as a number of requests.
+type Counter struct {
+	v *vec[float64]
+}
+
+// NewCounter registers a counter with Default.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(help, "counter", labels, func() *float64 { return new(float64) })}
+	Default.register(name, c)
+	return c
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the series with the
+// given label values.
+func (c *Counter) Add(delta float64, values ...string) {
+	c.v.mu.Lock()
+	*c.v.with(values) += delta
+	c.v.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	c.v.header(w, name)
+	c.v.each(func(labels string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(*v))
+	})
+}
+
+// Gauge is a value that goes up and down, such as open connections.
+type Gauge struct {
+	v *vec[float64]
+}
+
+// NewGauge registers a gauge with Default.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(help, "gauge", labels, func() *float64 { return new(float64) })}
+	Default.register(name, g)
+	return g
+}
+
+// Set sets the series with the given label values to value.
+func (g *Gauge) Set(value float64, values ...string) {
+	g.v.mu.Lock()
+	*g.v.with(values) = value
+	g.v.mu.Unlock()
+}
+
+// Add adds delta to the series with the given label values.
+func (g *Gauge) Add(delta float64, values ...string) {
+	g.v.mu.Lock()
+	*g.v.with(values) += delta
+	g.v.mu.Unlock()
+}
+
+// Inc adds one to the series with the given label values.
+func (g *Gauge) Inc(values ...string) { g.Add(1, values...) }
+
+// Dec subtracts one from the series with the given label values.
+func (g *Gauge) Dec(values ...string) { g.Add(-1, values...) }
+
+func (g *Gauge) write(w io.Writer, name string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.header(w, name)
+	g.v.each(func(labels string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", name, braces(labels), formatFloat(*v))
+	})
+}
+
+// gaugeFunc is a gauge read when the metrics are served.
+type gaugeFunc struct {
+	help string
+	f    func() float64
+}
+
+// NewGaugeFunc registers with Default a gauge whose value f returns at
+// each scrape.
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.register(name, &gaugeFunc{help: help, f: f})
+}
+
+func (g *gaugeFunc) write(w io.Writer, name string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(g.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(g.f()))
+}
+
+// Histogram counts observations, such as latencies, in buckets.
+type Histogram struct {
+	v       *vec[histogram]
+	buckets []float64
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers with Default a histogram with the given upper
+// bucket bounds, in increasing order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{buckets: buckets}
+	h.v = newVec(help, "histogram", labels, func() *histogram {
+		return &histogram{counts: make([]uint64, len(buckets)+1)}
+	})
+	Default.register(name, h)
+	return h
+}
+
+// Observe records value in the series with the given label values.
+func (h *Histogram) Observe(value float64, values ...string) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.v.mu.Lock()
+	s := h.v.with(values)
+	s.counts[i]++
+	s.sum += value
+	s.count++
+	h.v.mu.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+	h.v.header(w, name)
+	h.v.each(func(labels string, s *histogram) {
+		sep := ""
+		if labels != "" {
+			sep = ","
+		}
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatFloat(h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), s.count)
+	})
+}
@@ -14,8 +14,11 @@ type User struct {
 
 // Client represents a connected WebSocket client.
 type Client struct {
-	Conn   *websocket.Conn
-	UserID string
+	ID      string // connection ID, keys the connection's log lines
+	Conn    *websocket.Conn
+	UserID  string
+	Token   string // session token the connection was opened with
+	Version int    // negotiated websocket protocol version
 }
 
 func Skip(str string) string {
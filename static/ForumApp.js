@@ -2,6 +2,7 @@
 import { AuthManager } from './managers/AuthManager.js';
 import { PostManager } from './managers/PostManager.js';
 import { ChatManager } from './managers/ChatManager.js';
+import { CryptoManager } from './managers/CryptoManager.js';
 import { UIManager } from './ui/UIManager.js';
 
 export class ForumApp {
@@ -16,6 +17,7 @@ export class ForumApp {
         this.authManager = new AuthManager(this);
         this.postManager = new PostManager(this);
         this.chatManager = new ChatManager(this);
+        this.cryptoManager = new CryptoManager(this);
 
         this.initialize();
     }
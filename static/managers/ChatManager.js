@@ -6,6 +6,11 @@ export class ChatManager {
         this.isLoadingMessages = false; // Prevent multiple simultaneous fetches
         this.id = null;
         this.offset = 0; // New: Track the current offset for pagination
+        this.protocolVersion = 2;
+        this.nextRequestId = 0;
+        this.reconnectAttempt = 0; // Attempts since the server asked us to reconnect
+        this.reconnectDelay = 2000;
+        this.reconnectTimer = null;
     }
 
     initWebSocket() {
@@ -13,29 +18,31 @@ export class ChatManager {
             console.log('WebSocket already connected.');
             return;
         }
-        this.socket = new WebSocket('ws://localhost:8080/ws');
+        // Offer protocol version 2; see websocket/protocol.go for the frame format
+        this.socket = new WebSocket(`${location.protocol === 'https:' ? 'wss' : 'ws'}://${location.host}/ws`, ['forum.v2']);
         this.app.socket = this.socket; // Link the app's socket to this manager's socket
         this.socket.onopen = () => {
             console.log('WebSocket connected');
+            this.reconnectAttempt = 0;
             this.loadUsers(); // Load users once connected
         };
         this.socket.onmessage = (event) => {
             if (!event.data) return;
             const message = JSON.parse(event.data);
             switch (message.type) {
-                case 'offset':
-                    if ((message.payload.receiverId == this.app.currentUser.id && message.pyload.senderId == this.app.currentConversation) || (message.payload.senderId == this.app.currentUser.id && message.payload.receiverId == this.app.currentConversation)) {
-
-
-                        this.offset++
-                        console.log(this.offset);
-
-                    }
-                    break
-
+                case 'hello':
+                    this.protocolVersion = message.payload.version;
+                    break;
+                case 'ack':
+                    break;
                 case 'online_users':
+                case 'blocks_updated':
                     this.loadUsers();
                     break;
+                case 'user_online':
+                case 'user_offline':
+                    this.updateUserStatus(message.payload.id, message.type === 'user_online');
+                    break;
                 case 'private_message':
                     this.handlePrivateMessage(message.payload);
                     break;
@@ -45,35 +52,105 @@ export class ChatManager {
                 case 'message_read':
                     this.handleMessageRead(message.payload);
                     break;
+                case 'messages_read':
+                    this.handleMessagesRead(message.payload);
+                    break;
+                case 'unread_summary':
+                    this.handleUnreadSummary(message.payload);
+                    break;
+                case 'message_reaction':
+                    this.handleMessageReaction(message.payload);
+                    break;
+                case 'message_edited':
+                    this.handleMessageEdited(message.payload);
+                    break;
+                case 'message_deleted':
+                    this.handleMessageDeleted(message.payload);
+                    break;
+                case 'messages_expired':
+                    this.handleMessagesExpired(message.payload);
+                    break;
+                case 'conversation_settings_updated':
+                    this.handleConversationSettings(message.payload);
+                    break;
+                case 'keys_updated':
+                    // Our own key may have been rotated or revoked from another tab
+                    if (message.payload.userId === this.app.currentUser.id) {
+                        this.app.cryptoManager.device = null;
+                    }
+                    break;
                 case 'typing':
                     this.handleTypingIndicator(message.payload);
                     break;
                 case 'stop_typing':
                     this.handleStopTyping(message.payload);
                     break;
-                case 'eroor':
-                    let b = document.getElementById('not')
-                    b.textContent = message.payload.eroor
-                    b.classList.add('show');
-                    this.id = setTimeout(() => {
-                        b.textContent = ""
-                        not.classList.remove('show');
-                    }, 2000)
+                case 'error':
+                    this.handleProtocolError(message.payload);
                     break
             }
         };
-        this.socket.onclose = () => {
+        this.socket.onclose = (event) => {
             console.log('WebSocket disconnected');
             const typingIndicator = document.querySelectorAll('.typing-indicator');
             typingIndicator.forEach((id) => {
 
                 id.textContent = '';
             })
+            // 1012: the server is restarting; come back after the hinted
+            // delay, and keep trying until it is back up
+            if (event.code === 1012) {
+                const hint = /retry after (\d+)s/.exec(event.reason);
+                this.reconnectDelay = (hint ? Number(hint[1]) : 2) * 1000;
+                this.reconnectAttempt = 0;
+                this.scheduleReconnect();
+            } else if (this.reconnectAttempt > 0) {
+                this.scheduleReconnect();
+            }
         };
         this.socket.onerror = (error) => {
             console.error('WebSocket error:', error);
         };
     }
+    // scheduleReconnect opens a new connection after a delay that doubles
+    // with every failed attempt, up to 30s, spread out so every client
+    // doesn't reconnect at once. It gives up once the user has logged out.
+    scheduleReconnect() {
+        if (!this.app.currentUser) return;
+        const delay = Math.min(this.reconnectDelay * 2 ** this.reconnectAttempt, 30000);
+        this.reconnectAttempt++;
+        clearTimeout(this.reconnectTimer);
+        this.reconnectTimer = setTimeout(() => this.initWebSocket(), delay * (1 + Math.random()));
+    }
+
+    send(type, payload) {
+        this.nextRequestId++;
+        this.socket.send(JSON.stringify({
+            v: this.protocolVersion,
+            type,
+            id: `r${this.nextRequestId}`,
+            payload,
+        }));
+    }
+
+    handleProtocolError(payload) {
+        if (payload.code === 'unauthorized') {
+            this.app.authManager.handleLogout()
+            return
+        }
+        if (payload.code === 'rate_limited' && (payload.type === 'typing' || payload.type === 'stop_typing')) {
+            return
+        }
+        clearTimeout(this.id)
+        let b = document.getElementById('not')
+        b.textContent = payload.message
+        b.classList.add('show');
+        this.id = setTimeout(() => {
+            b.textContent = ""
+            b.classList.remove('show');
+        }, 2000)
+    }
+
     getCookie(name) {
         return document.cookie
             .split('; ')
@@ -83,43 +160,12 @@ export class ChatManager {
 
     async loadUsers() {
         try {
-            const response = await fetch('/api/users');
+            // One request returns every user with their last message and
+            // unread count, already sorted by most recent conversation.
+            const response = await fetch('/api/conversations');
             if (!response.ok) throw new Error('Failed to load users');
             const users = await response.json();
-            const usersWithMessages = await Promise.all(
-                users
-                    .filter(user => this.app.currentUser && user.id !== this.app.currentUser.id)
-                    .map(async user => {
-                        try {
-                            const msgResponse = await fetch(`/api/messages?with=${user.id}`);
-
-                            if (!msgResponse.ok) throw new Error('Failed to fetch messages');
-                            const messages = await msgResponse.json();
-
-
-                            const latestMessage = messages
-                                .sort((a, b) => new Date(b.timestamp) - new Date(a.timestamp))[0]?.timestamp || null;
-
-                            return { ...user, latestMessage };
-                        } catch (error) {
-                            console.error(`Error fetching messages for user ${user.id}:`, error);
-                            return { ...user, latestMessage: null };
-                        }
-                    })
-            );
-
-
-            const sortedUsers = usersWithMessages.sort((a, b) => {
-                const timeA = a.latestMessage ? new Date(a.latestMessage) : null;
-                const timeB = b.latestMessage ? new Date(b.latestMessage) : null;
-                if (timeA && timeB) return timeB - timeA;
-                if (timeA) return -1;
-                if (timeB) return 1;
-                // if (a.isOnline && !b.isOnline) return -1;
-                // if (!a.isOnline && b.isOnline) return 1;
-                return a.nickname.toLowerCase().localeCompare(b.nickname.toLowerCase());
-            });
-            this.renderUsers(sortedUsers);
+            this.renderUsers(users);
         } catch (error) {
             console.error('Error loading users:', error);
             const container = document.getElementById('users-list');
@@ -142,6 +188,7 @@ export class ChatManager {
 
                     <span class="status ${user.isOnline ? 'online' : 'offline'}"></span>
                     <div id = 'username'>${user.nickname}</div>
+                    ${user.unreadCount ? `<span class="unread-badge">${user.unreadCount}</span>` : ''}
                 </div>
             `).join('');
         document.querySelectorAll('.user[data-user-id]').forEach(item => {
@@ -156,18 +203,24 @@ export class ChatManager {
         });
     }
 
-    // updateUserStatus(userId, isOnline) {
-    //     const userElement = document.querySelector(`.user[data-user-id="${userId}"]`);
-    //     if (userElement) {
-    //         userElement.classList.toggle('online', isOnline);
-    //         userElement.classList.toggle('offline', !isOnline);
-    //         const statusElement = userElement.querySelector('.status');
-    //         if (statusElement) {
-    //             statusElement.classList.toggle('online', isOnline);
-    //             statusElement.classList.toggle('offline', !isOnline);
-    //         }
-    //     }
-    // }
+    // updateUserStatus applies a presence change to the rendered list. Only
+    // a user the list doesn't have yet, such as one who just registered,
+    // needs the full list again.
+    updateUserStatus(userId, isOnline) {
+        if (userId === this.app.currentUser.id || !document.getElementById('users-list')) return;
+        const userElement = document.querySelector(`.user[data-user-id="${userId}"]`);
+        if (!userElement) {
+            this.loadUsers();
+            return;
+        }
+        userElement.classList.toggle('online', isOnline);
+        userElement.classList.toggle('offline', !isOnline);
+        const statusElement = userElement.querySelector('.status');
+        if (statusElement) {
+            statusElement.classList.toggle('online', isOnline);
+            statusElement.classList.toggle('offline', !isOnline);
+        }
+    }
 
     async startConversation(userId, userName) {
         // this.app.initWebSocket()
@@ -199,6 +252,9 @@ export class ChatManager {
         // Load initial 10 messages
         await this.loadMessages(userId);
         await this.markMessagesAsRead(userId);
+        this.setupMessageSearch(userId);
+        this.setupConversationSettings(userId);
+        this.setupExport(userId);
         const newForm = form.cloneNode(true);
         form.parentNode.replaceChild(newForm, form);
         if (this.typingTimeout) {
@@ -207,30 +263,21 @@ export class ChatManager {
         const newMessageInput = document.getElementById('message-content');
         newMessageInput.addEventListener('input', () => {
             clearTimeout(this.typingTimeout);
-            this.socket.send(JSON.stringify({
-                type: 'typing',
-                payload: {
-                    receiverId: userId,
-                },
-            }));
+            this.send('typing', {
+                receiverId: userId,
+            });
             this.typingTimeout = setTimeout(() => {
-                this.socket.send(JSON.stringify({
-                    type: 'stop_typing',
-                    payload: {
-                        receiverId: userId,
-                    },
-                }));
+                this.send('stop_typing', {
+                    receiverId: userId,
+                });
             }, 1000);
         });
         newForm.addEventListener('submit', (e) => {
             e.preventDefault();
             this.sendMessage(userId);
-            this.socket.send(JSON.stringify({
-                type: 'stop_typing',
-                payload: {
-                    receiverId: userId,
-                },
-            }));
+            this.send('stop_typing', {
+                receiverId: userId,
+            });
         });
         // Add throttled scroll event listener
         const messagesContainer = document.getElementById('messages-container');
@@ -290,14 +337,21 @@ export class ChatManager {
                 <div class="message ${message.senderId === this.app.currentUser.id ? 'sent' : 'received'}" data-message-id="${message.id}">
                     <div class="message-meta">
                         <span>${new Date(message.timestamp).toLocaleString()}</span>
+                        ${message.expiresAt ? '<span class="expiry" title="Disappearing message">⏱</span>' : ''}
                         ${message.senderId === this.app.currentUser.id ? `<span class="read-status">${message.isRead ? '✓✓' : '✓'}</span>` : ''}
                     </div>
-                    <div class="message-content">${message.content}</div>
+                    <div class="message-content">${message.isDeleted ? '<em>message deleted</em>' : message.isEncrypted ? '<em>🔒 encrypted message</em>' : message.content}${message.editedAt ? ' <small>(edited)</small>' : ''}</div>
+                    ${this.renderAttachments(message.attachments)}
+                    <div class="message-reactions">${this.renderReactions(message.reactions)}</div>
                 </div>
             `).join('');
 
             // Note: with offset-based pagination, we always prepend older messages
             container.insertAdjacentHTML('afterbegin', messageHtml);
+            messages.forEach(message => {
+                this.scheduleExpiry(message.id, message.expiresAt);
+                this.decryptMessage(message.id, message);
+            });
 
         } catch (error) {
             console.error('Error loading messages:', error);
@@ -323,6 +377,60 @@ export class ChatManager {
         messagesContainer.scrollTop = messagesContainer.scrollHeight - oldScrollHeight;
     }
 
+    setupMessageSearch(userId) {
+        const form = document.getElementById('message-search-form');
+        if (!form) return
+        const newForm = form.cloneNode(true);
+        form.parentNode.replaceChild(newForm, form);
+        const results = document.getElementById('message-search-results');
+        results.innerHTML = '';
+        results.classList.add('hidden');
+
+        newForm.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const q = document.getElementById('message-search').value.trim();
+            if (q.length < 2) return
+            try {
+                const response = await fetch(`/api/messages/search?with=${userId}&q=${encodeURIComponent(q)}`);
+                if (!response.ok) throw new Error('Failed to search messages');
+                const matches = await response.json();
+                results.innerHTML = matches.length === 0
+                    ? '<div class="search-empty">No messages found</div>'
+                    : matches.map(match => `
+                        <div class="search-result" data-message-id="${match.id}" data-offset="${match.offset}">
+                            <span class="search-meta">${match.sender} · ${new Date(match.timestamp).toLocaleString()}</span>
+                            <div>${match.content}</div>
+                        </div>
+                    `).join('');
+                results.classList.remove('hidden');
+                results.querySelectorAll('.search-result').forEach(el => {
+                    el.addEventListener('click', () => {
+                        results.classList.add('hidden');
+                        this.jumpToMessage(userId, el.dataset.messageId, Number(el.dataset.offset));
+                    });
+                });
+            } catch (error) {
+                console.error('Error searching messages:', error);
+            }
+        });
+    }
+
+    // jumpToMessage pages back through the history until the message at
+    // offset (as returned by the search endpoint) is loaded, then shows it.
+    async jumpToMessage(userId, messageId, offset) {
+        const find = () => document.querySelector(`#messages-container .message[data-message-id="${messageId}"]`);
+        while (!find() && this.offset <= offset) {
+            const before = this.offset;
+            await this.loadMoreMessages(userId);
+            if (this.offset === before) break
+        }
+        const el = find();
+        if (!el) return
+        el.scrollIntoView({ block: 'center' });
+        el.classList.add('highlight');
+        setTimeout(() => el.classList.remove('highlight'), 2000);
+    }
+
     async handleTypingIndicator(payload) {
         console.log(payload);
 
@@ -393,17 +501,13 @@ export class ChatManager {
             if (!response.ok) throw new Error('Failed to fetch messages');
             const messages = await response.json();
             if (!messages) return
-            for (const message of messages) {
-                if (message.senderId === senderId && !message.isRead) {
-                    this.socket.send(JSON.stringify({
-                        type: 'mark_read',
-                        payload: {
-                            senderId: senderId,
-                            messageId: message.id,
-                        },
-                    }));
-                }
-            }
+            const unread = messages.filter(message => message.senderId === senderId && !message.isRead);
+            if (unread.length === 0) return
+            // Messages come oldest first, so the last one covers everything before it
+            this.send('mark_read_until', {
+                senderId: senderId,
+                messageId: unread[unread.length - 1].id,
+            });
         } catch (error) {
             console.error('Error marking messages as read:', error);
         }
@@ -434,15 +538,27 @@ export class ChatManager {
         const content = document.getElementById('message-content').value;
         const clientMessageId = Date.now().toString() + Math.random().toString(36).substr(2, 9);
 
-
-        this.socket.send(JSON.stringify({
-            type: 'private_message',
-            payload: {
+        if (document.getElementById('encrypt-toggle')?.checked && content.trim()) {
+            try {
+                const { ciphertext, envelopes } = await this.app.cryptoManager.encrypt(content, receiverId);
+                this.send('private_message', {
+                    receiverId,
+                    content: ciphertext,
+                    messageId: clientMessageId,
+                    encrypted: true,
+                    envelopes,
+                });
+            } catch (error) {
+                console.error('Error encrypting message:', error);
+                return
+            }
+        } else {
+            this.send('private_message', {
                 receiverId,
                 content,
                 messageId: clientMessageId,
-            },
-        }));
+            });
+        }
         this.loadUsers();
         document.getElementById('message-content').value = '';
 
@@ -473,6 +589,8 @@ export class ChatManager {
         if (payload.senderId == this.app.currentUser.id && payload.receiverId == this.app.currentConversation) {
 
             this.renderMessage(payload);
+            // Messages pushed live shift the pagination window by one
+            this.offset++
 
 
 
@@ -482,13 +600,11 @@ export class ChatManager {
 
             if (this.app.currentConversation && payload.senderId === this.app.currentConversation) {
                 this.renderMessage(payload);
-                this.socket.send(JSON.stringify({
-                    type: 'mark_read',
-                    payload: {
-                        senderId: payload.senderId,
-                        messageId: payload.messageId,
-                    },
-                }));
+                this.offset++
+                this.send('mark_read_until', {
+                    senderId: payload.senderId,
+                    messageId: payload.messageId,
+                });
                 this.loadUsers();
             } else {
                 clearTimeout(this.id)
@@ -557,12 +673,191 @@ export class ChatManager {
             console.log(err);
 
         }
+        if (payload.receiverId === this.app.currentUser.id) {
+            // Read from another tab of ours: refresh the unread badges
+            this.loadUsers();
+            return
+        }
         const messageElement = document.querySelector(`.message[data-message-id="${payload.messageId}"] .read-status`);
         if (messageElement) {
             messageElement.textContent = '✓✓';
         }
     }
 
+    handleMessagesRead(payload) {
+        if (payload.receiverId === this.app.currentUser.id) {
+            this.loadUsers();
+            return
+        }
+        if (this.app.currentConversation !== payload.receiverId) return
+        // Everything we sent up to and including payload.messageId is read now
+        const sent = [...document.querySelectorAll('.message.sent')];
+        const last = sent.findIndex(el => el.getAttribute('data-message-id') === payload.messageId);
+        sent.slice(0, last + 1).forEach(el => {
+            const status = el.querySelector('.read-status');
+            if (status) status.textContent = '✓✓';
+        });
+    }
+
+    handleUnreadSummary(payload) {
+        if (!payload.total) return;
+        clearTimeout(this.id)
+        let b = document.getElementById('not')
+        b.textContent = `you have ${payload.total} unread message${payload.total > 1 ? 's' : ''}`
+        b.classList.add('show');
+        this.id = setTimeout(() => {
+            b.textContent = ""
+            b.classList.remove('show');
+        }, 2000)
+    }
+
+    handleMessageEdited(payload) {
+        const contentElement = document.querySelector(`.message[data-message-id="${payload.messageId}"] .message-content`);
+        if (contentElement) {
+            contentElement.innerHTML = `${payload.content} <small>(edited)</small>`;
+        }
+    }
+
+    handleMessageDeleted(payload) {
+        const contentElement = document.querySelector(`.message[data-message-id="${payload.messageId}"] .message-content`);
+        if (contentElement) {
+            contentElement.innerHTML = '<em>message deleted</em>';
+        }
+    }
+
+    // scheduleExpiry hides a disappearing message once its timer runs out;
+    // the server stops returning it at that point and purges it soon after.
+    scheduleExpiry(messageId, expiresAt) {
+        if (!expiresAt) return
+        const delay = new Date(expiresAt).getTime() - Date.now();
+        setTimeout(() => {
+            document.querySelector(`.message[data-message-id="${messageId}"]`)?.remove();
+        }, Math.max(delay, 0));
+    }
+
+    handleMessagesExpired(payload) {
+        payload.messageIds.forEach(id => {
+            const el = document.querySelector(`.message[data-message-id="${id}"]`);
+            if (!el) return
+            if (payload.mode === 'redact') {
+                el.querySelector('.message-content').innerHTML = '<em>message expired</em>';
+                el.querySelector('.message-attachments')?.remove();
+                el.querySelector('.message-reactions').innerHTML = '';
+            } else {
+                el.remove();
+            }
+        });
+        this.loadUsers();
+    }
+
+    async setupConversationSettings(userId) {
+        const select = document.getElementById('disappearing-timer');
+        if (!select) return
+        select.onchange = () => {
+            this.send('set_disappearing_timer', {
+                receiverId: userId,
+                seconds: Number(select.value),
+            });
+        };
+        try {
+            const response = await fetch(`/api/conversations/settings?with=${userId}`);
+            if (!response.ok) throw new Error('Failed to load conversation settings');
+            const settings = await response.json();
+            select.value = String(settings.disappearingSeconds);
+            this.applyEncryption(settings.encrypted);
+        } catch (error) {
+            console.error('Error loading conversation settings:', error);
+        }
+    }
+
+    setupExport(userId) {
+        const select = document.getElementById('export-format');
+        if (!select) return
+        select.value = '';
+        select.onchange = async () => {
+            const format = select.value;
+            select.value = '';
+            if (!format) return
+            try {
+                const response = await fetch(`/api/messages/export?with=${userId}&format=${format}`);
+                if (!response.ok) throw new Error('Failed to export conversation');
+                const blob = await response.blob();
+                const link = document.createElement('a');
+                link.href = URL.createObjectURL(blob);
+                link.download = `conversation-${document.getElementById('receiver-name').textContent}.${format}`;
+                link.click();
+                URL.revokeObjectURL(link.href);
+            } catch (error) {
+                console.error('Error exporting conversation:', error);
+            }
+        };
+    }
+
+    // applyEncryption locks the encrypt toggle on once a conversation is
+    // end-to-end encrypted; the server refuses plaintext from then on.
+    applyEncryption(encrypted) {
+        const toggle = document.getElementById('encrypt-toggle');
+        if (!toggle) return
+        toggle.checked = !!encrypted;
+        toggle.disabled = !!encrypted;
+    }
+
+    // decryptMessage replaces the placeholder of an encrypted message with
+    // its plaintext once this device has opened it.
+    async decryptMessage(messageId, message) {
+        if (!message.isEncrypted || message.isDeleted) return
+        const plaintext = await this.app.cryptoManager.decrypt(message.content, message.envelopes);
+        const el = document.querySelector(`.message[data-message-id="${messageId}"] .message-content`);
+        if (!el) return
+        if (plaintext === null) {
+            el.innerHTML = '<em>🔒 encrypted for another device</em>';
+            return
+        }
+        el.textContent = plaintext;
+        el.classList.add('decrypted');
+    }
+
+    handleConversationSettings(payload) {
+        if (this.app.currentConversation !== payload.withUserId) return
+        const select = document.getElementById('disappearing-timer');
+        if (select) select.value = String(payload.disappearingSeconds);
+        if (payload.encrypted) {
+            // Turning on encryption is announced by the message that did it
+            this.applyEncryption(true);
+            return
+        }
+        const option = select?.querySelector(`option[value="${payload.disappearingSeconds}"]`);
+        clearTimeout(this.id)
+        let b = document.getElementById('not')
+        b.textContent = payload.disappearingSeconds
+            ? `messages now ${(option ? option.textContent : `disappear after ${payload.disappearingSeconds}s`).toLowerCase()}`
+            : 'disappearing messages turned off'
+        b.classList.add('show');
+        this.id = setTimeout(() => {
+            b.textContent = ""
+            b.classList.remove('show');
+        }, 2000)
+    }
+
+    renderAttachments(attachments) {
+        if (!attachments || attachments.length === 0) return '';
+        return `<div class="message-attachments">${attachments.map(a => a.thumbnailUrl
+            ? `<a href="${a.url}" target="_blank"><img src="${a.thumbnailUrl}" alt="${a.fileName}"></a>`
+            : `<a href="${a.url}" target="_blank">${a.fileName}</a>`).join('')}</div>`;
+    }
+
+    renderReactions(reactions) {
+        if (!reactions) return '';
+        return reactions.map(r => `<span class="reaction">${r.emoji} ${r.count}</span>`).join('');
+    }
+
+    handleMessageReaction(payload) {
+        const reactionsElement = document.querySelector(`.message[data-message-id="${payload.messageId}"] .message-reactions`);
+        if (reactionsElement) {
+            reactionsElement.innerHTML = this.renderReactions(payload.reactions);
+        }
+    }
+
     renderMessage(message) {
         const container = document.getElementById('messages-container');
         if (!container) return;
@@ -570,13 +865,18 @@ export class ChatManager {
             <div class="message ${message.senderId === this.app.currentUser.id ? 'sent' : 'received'}" data-message-id="${message.messageId}">
                 <div class="message-meta">
                     <span>${new Date(message.timestamp).toLocaleString()}</span>
+                    ${message.expiresAt ? '<span class="expiry" title="Disappearing message">⏱</span>' : ''}
                     ${message.senderId === this.app.currentUser.id ? `<span class="read-status">${message.isRead ? '✓✓' : '✓'}</span>` : ''}
                 </div>
-                <div class="message-content">${message.content}</div>
+                <div class="message-content">${message.isEncrypted ? '<em>🔒 encrypted message</em>' : message.content}</div>
+                ${this.renderAttachments(message.attachments)}
+                <div class="message-reactions"></div>
             </div>
         `;
         container.insertAdjacentHTML('beforeend', messageElement);
         container.scrollTop = container.scrollHeight;
+        this.scheduleExpiry(message.messageId, message.expiresAt);
+        this.decryptMessage(message.messageId, message);
     }
 
     clearMessages() {
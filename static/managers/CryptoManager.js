@@ -0,0 +1,131 @@
+// CryptoManager implements the client side of end-to-end encrypted private
+// messages with WebCrypto. The format is described in e2ee/e2ee.go: P-256
+// device keys, AES-GCM message content, and one envelope per device wrapping
+// the content key under SHA-256 of an ECDH shared secret.
+const ECDH = { name: 'ECDH', namedCurve: 'P-256' };
+
+export class CryptoManager {
+    constructor(app) {
+        this.app = app;
+        this.device = null; // { userId, keyId, privateKey }
+    }
+
+    storageKey() {
+        return `e2ee:${this.app.currentUser.id}`;
+    }
+
+    // ensureDeviceKey returns this browser's device key, generating and
+    // publishing one if it has none or the published one was revoked.
+    async ensureDeviceKey() {
+        if (this.device?.userId === this.app.currentUser.id) return this.device;
+        const stored = JSON.parse(localStorage.getItem(this.storageKey()) || 'null');
+        if (stored) {
+            const keys = await this.fetchKeys(this.app.currentUser.id);
+            if (keys.some(k => k.keyId === stored.keyId)) {
+                this.device = {
+                    userId: this.app.currentUser.id,
+                    keyId: stored.keyId,
+                    privateKey: await crypto.subtle.importKey('jwk', stored.privateKey, ECDH, true, ['deriveBits']),
+                };
+                return this.device;
+            }
+        }
+
+        const pair = await crypto.subtle.generateKey(ECDH, true, ['deriveBits']);
+        const publicKey = this.encode(await crypto.subtle.exportKey('raw', pair.publicKey));
+        const deviceId = stored?.deviceId || crypto.randomUUID();
+        const response = await fetch('/api/keys/publish', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ deviceId, publicKey }),
+        });
+        if (!response.ok) throw new Error('Failed to publish device key');
+        const published = await response.json();
+        localStorage.setItem(this.storageKey(), JSON.stringify({
+            keyId: published.keyId,
+            deviceId,
+            privateKey: await crypto.subtle.exportKey('jwk', pair.privateKey),
+        }));
+        this.device = { userId: this.app.currentUser.id, keyId: published.keyId, privateKey: pair.privateKey };
+        return this.device;
+    }
+
+    async fetchKeys(userId) {
+        const response = await fetch(`/api/keys?user=${userId}`);
+        if (!response.ok) throw new Error('Failed to load device keys');
+        return response.json();
+    }
+
+    // encrypt seals plaintext for every device of both participants.
+    async encrypt(plaintext, receiverId) {
+        await this.ensureDeviceKey();
+        const devices = [
+            ...await this.fetchKeys(receiverId),
+            ...await this.fetchKeys(this.app.currentUser.id),
+        ];
+        const contentKey = crypto.getRandomValues(new Uint8Array(32));
+        const ciphertext = await this.seal(contentKey, new TextEncoder().encode(plaintext));
+
+        const envelopes = {};
+        for (const device of devices) {
+            const publicKey = await crypto.subtle.importKey('raw', this.decode(device.publicKey), ECDH, false, []);
+            const ephemeral = await crypto.subtle.generateKey(ECDH, true, ['deriveBits']);
+            const kek = await this.keyEncryptionKey(ephemeral.privateKey, publicKey);
+            const wrapped = await this.seal(kek, contentKey);
+            const ephemeralPublic = new Uint8Array(await crypto.subtle.exportKey('raw', ephemeral.publicKey));
+            envelopes[device.keyId] = this.encode(this.concat(ephemeralPublic, wrapped));
+        }
+        return { ciphertext: this.encode(ciphertext), envelopes };
+    }
+
+    // decrypt opens a message with this device's envelope, or returns null
+    // if the message was not encrypted for this device.
+    async decrypt(ciphertext, envelopes) {
+        const device = await this.ensureDeviceKey();
+        const envelope = envelopes?.[device.keyId];
+        if (!envelope) return null;
+        try {
+            const raw = this.decode(envelope);
+            const ephemeral = await crypto.subtle.importKey('raw', raw.slice(0, 65), ECDH, false, []);
+            const kek = await this.keyEncryptionKey(device.privateKey, ephemeral);
+            const contentKey = await this.open(kek, raw.slice(65));
+            const plaintext = await this.open(contentKey, this.decode(ciphertext));
+            return new TextDecoder().decode(plaintext);
+        } catch (error) {
+            console.error('Failed to decrypt message:', error);
+            return null;
+        }
+    }
+
+    async keyEncryptionKey(privateKey, publicKey) {
+        const secret = await crypto.subtle.deriveBits({ name: 'ECDH', public: publicKey }, privateKey, 256);
+        return new Uint8Array(await crypto.subtle.digest('SHA-256', secret));
+    }
+
+    async seal(keyBytes, data) {
+        const key = await crypto.subtle.importKey('raw', keyBytes, 'AES-GCM', false, ['encrypt']);
+        const iv = crypto.getRandomValues(new Uint8Array(12));
+        const sealed = new Uint8Array(await crypto.subtle.encrypt({ name: 'AES-GCM', iv }, key, data));
+        return this.concat(iv, sealed);
+    }
+
+    async open(keyBytes, sealed) {
+        const key = await crypto.subtle.importKey('raw', keyBytes, 'AES-GCM', false, ['decrypt']);
+        return new Uint8Array(await crypto.subtle.decrypt({ name: 'AES-GCM', iv: sealed.slice(0, 12) }, key, sealed.slice(12)));
+    }
+
+    concat(a, b) {
+        const out = new Uint8Array(a.length + b.length);
+        out.set(a);
+        out.set(b, a.length);
+        return out;
+    }
+
+    encode(bytes) {
+        return btoa(String.fromCharCode(...new Uint8Array(bytes)));
+    }
+
+    decode(text) {
+        return Uint8Array.from(atob(text), c => c.charCodeAt(0));
+    }
+}
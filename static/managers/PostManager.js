@@ -279,7 +279,7 @@ export class PostManager {
 
 
         const postss = posts.map(post => `
-            <div class="post" data-id="${post.id}">
+            <div class="post ${post.muted ? 'muted' : ''}" data-id="${post.id}">
                 <h3 class="post-title">${post.title}</h3>
                 <div class="post-meta">
                     <span>Posted by ${post.author || 'Unknown'} in ${post.category || 'General'}</span>
@@ -313,7 +313,7 @@ export class PostManager {
 
 
         const postss = `
-            <div class="post" data-id="${posts.id}">
+            <div class="post ${posts.muted ? 'muted' : ''}" data-id="${posts.id}">
                 <h3 class="post-title">${posts.title}</h3>
                 <div class="post-meta">
                     <span>Posted by ${posts.author || 'Unknown'} in ${posts.category || 'General'}</span>
@@ -436,7 +436,7 @@ export class PostManager {
         if (!container) return;
 
         container.innerHTML = comments.map(comment => `
-            <div class="comment">
+            <div class="comment ${comment.muted ? 'muted' : ''}">
                 <div class="comment-meta">
                     <span>${comment.author}</span>
                     <span>${new Date(comment.created_at).toLocaleString()}</span>
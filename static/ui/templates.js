@@ -168,12 +168,31 @@ export const messages = `
         <div class="conversation-header">
             <button id="back-to-users" class="back-button"> CLOSE </button>
             <h2 id="current-chat-user">  <span id="receiver-name"></span></h2>
+            <select id="disappearing-timer" class="disappearing-timer" title="Disappearing messages">
+                <option value="0">Messages don't disappear</option>
+                <option value="3600">Disappear after 1 hour</option>
+                <option value="86400">Disappear after 1 day</option>
+                <option value="604800">Disappear after 1 week</option>
+            </select>
+            <select id="export-format" class="export-format" title="Export conversation">
+                <option value="">Export…</option>
+                <option value="txt">Text</option>
+                <option value="html">HTML</option>
+                <option value="json">JSON</option>
+            </select>
         </div>
+        <form id="message-search-form" class="message-search-form">
+            <input type="search" id="message-search" placeholder="Search this conversation..." minlength="2" maxlength="100">
+        </form>
+        <div id="message-search-results" class="message-search-results hidden"></div>
         <div class="messages-container" id="messages-container"></div>
         <form id="message-form" class="message-form">
             <div class="form-group">
                 <textarea id="message-content" placeholder="Écrivez votre message..." required></textarea>
             </div>
+            <label class="encrypt-toggle" title="End-to-end encrypt this message">
+                <input type="checkbox" id="encrypt-toggle"> 🔒
+            </label>
             <button type="submit">Envoyer</button>
         </form>
     </div>
@@ -0,0 +1,129 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"jj/database"
+	"jj/store"
+)
+
+type attachments struct {
+	db      *sql.DB
+	writer  *sql.DB
+	dialect database.Dialect
+}
+
+func (s *attachments) Create(ctx context.Context, a store.NewAttachment) error {
+	thumbnailKey := sql.NullString{String: a.ThumbnailKey, Valid: a.ThumbnailKey != ""}
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO attachments (id, uploader_id, file_name, content_type, size, storage_key, thumbnail_key)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.UploaderID, a.FileName, a.ContentType, a.Size, a.StorageKey, thumbnailKey)
+	return err
+}
+
+func (s *attachments) Get(ctx context.Context, id, userID string) (store.StoredAttachment, error) {
+	var a store.StoredAttachment
+	var thumbnailKey sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+        SELECT a.file_name, a.content_type, a.storage_key, a.thumbnail_key, a.created_at
+        FROM attachments a
+        LEFT JOIN private_messages m ON m.id = a.message_id
+        WHERE a.id = ? AND (a.uploader_id = ? OR ((m.sender_id = ? OR m.receiver_id = ?) AND `+unexpired+`))`,
+		id, userID, userID, userID).Scan(&a.FileName, &a.ContentType, &a.StorageKey, &thumbnailKey, &a.CreatedAt)
+	a.ThumbnailKey = thumbnailKey.String
+	return a, notFound(err)
+}
+
+func (s *attachments) ForMessages(ctx context.Context, messageIDs []string) (map[string][]store.AttachmentInfo, error) {
+	result := make(map[string][]store.AttachmentInfo)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+	placeholders, args := inList(messageIDs)
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT message_id, id, file_name, content_type, size, thumbnail_key
+        FROM attachments
+        WHERE message_id IN (`+placeholders+`)
+        ORDER BY created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var a store.AttachmentInfo
+		var thumbnailKey sql.NullString
+		if err := rows.Scan(&messageID, &a.ID, &a.FileName, &a.ContentType, &a.Size, &thumbnailKey); err != nil {
+			return nil, err
+		}
+		a.HasThumbnail = thumbnailKey.Valid
+		result[messageID] = append(result[messageID], a)
+	}
+	return result, rows.Err()
+}
+
+func (s *attachments) DeleteForMessage(ctx context.Context, messageID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT storage_key, thumbnail_key FROM attachments WHERE message_id = ?`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		var thumbnailKey sql.NullString
+		if err := rows.Scan(&key, &thumbnailKey); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+		if thumbnailKey.Valid {
+			keys = append(keys, thumbnailKey.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.writer.ExecContext(ctx, `DELETE FROM attachments WHERE message_id = ?`, messageID); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *attachments) DeletePending(ctx context.Context, olderThan time.Duration, limit int) (int, []string, error) {
+	// One statement, so an upload attached meanwhile is neither deleted
+	// nor has its files reported
+	rows, err := s.writer.QueryContext(ctx, `
+        DELETE FROM attachments
+        WHERE message_id IS NULL AND id IN (
+            SELECT id FROM attachments
+            WHERE message_id IS NULL AND created_at <= `+s.dialect.SecondsFromNow("?")+`
+            LIMIT ?)
+        RETURNING storage_key, thumbnail_key`, -int64(olderThan/time.Second), limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	n := 0
+	var keys []string
+	for rows.Next() {
+		var key string
+		var thumbnailKey sql.NullString
+		if err := rows.Scan(&key, &thumbnailKey); err != nil {
+			return 0, nil, err
+		}
+		n++
+		keys = append(keys, key)
+		if thumbnailKey.Valid {
+			keys = append(keys, thumbnailKey.String)
+		}
+	}
+	return n, keys, rows.Err()
+}
@@ -0,0 +1,89 @@
+package sqlstore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/database"
+	"jj/store"
+)
+
+func TestDeletePending(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		err := st.Users.Create(ctx, store.NewUser{ID: id, Nickname: "user-" + id, Email: id + "@example.com", PasswordHash: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := database.DB.Exec(`
+        INSERT INTO private_messages (id, sender_id, receiver_id, content) VALUES ('m', 'a', 'b', 'text')`); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []struct {
+		id, age, message, thumbnail string
+	}{
+		{id: "old", age: "-2 days", thumbnail: "old_thumb"},
+		{id: "older", age: "-3 days"},
+		{id: "recent", age: "-1 hours"},
+		{id: "sent", age: "-2 days", message: "m"},
+	} {
+		var message, thumbnail interface{}
+		if a.message != "" {
+			message = a.message
+		}
+		if a.thumbnail != "" {
+			thumbnail = a.thumbnail
+		}
+		_, err := database.DB.Exec(`
+            INSERT INTO attachments (id, uploader_id, message_id, file_name, content_type, size, storage_key, thumbnail_key, created_at)
+            VALUES (?, 'a', ?, 'f.txt', 'text/plain', 1, ?, ?, datetime('now', ?))`,
+			a.id, message, a.id, thumbnail, a.age)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deletePending := func(limit int) (int, string) {
+		t.Helper()
+		n, keys, err := st.Attachments.DeletePending(ctx, 24*time.Hour, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		return n, strings.Join(keys, ",")
+	}
+
+	if n, keys := deletePending(1); n != 1 || (keys != "old,old_thumb" && keys != "older") {
+		t.Errorf("first batch: %d uploads, keys %q; want one of the old uploads", n, keys)
+	}
+	if n, _ := deletePending(10); n != 1 {
+		t.Errorf("second batch: %d uploads, want the other old one", n)
+	}
+	if n, keys := deletePending(10); n != 0 || keys != "" {
+		t.Errorf("after purging: %d uploads, keys %q; want none", n, keys)
+	}
+
+	// Recent uploads and those sent with a message stay
+	var left []string
+	rows, err := database.DB.Query(`SELECT id FROM attachments ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, id)
+	}
+	if got := strings.Join(left, ","); got != "recent,sent" {
+		t.Errorf("left %q, want %q", got, "recent,sent")
+	}
+}
@@ -0,0 +1,290 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"jj/database"
+	"jj/models"
+	"jj/store"
+)
+
+type groups struct {
+	db     *sql.DB
+	writer *sql.DB
+}
+
+func (s *groups) Create(ctx context.Context, id, name, createdBy string, memberIDs []string) error {
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO conversations (id, name, created_by) VALUES (?, ?, ?)`,
+		id, name, createdBy); err != nil {
+		return err
+	}
+	for _, userID := range memberIDs {
+		if _, err := tx.ExecContext(ctx, `
+            INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?)`,
+			id, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *groups) Get(ctx context.Context, id, viewerID string) (store.Group, error) {
+	var g store.Group
+	var lastMessageAt sql.NullString
+	err := s.db.QueryRowContext(ctx, `
+        SELECT c.id, c.name, c.created_by, c.created_at,
+               (SELECT COUNT(*) FROM group_messages gm
+                WHERE gm.conversation_id = c.id AND gm.sender_id != ? AND gm.idss > COALESCE(me.last_read_idss, 0)),
+               (SELECT MAX(gm.created_at) FROM group_messages gm WHERE gm.conversation_id = c.id)
+        FROM conversations c
+        LEFT JOIN conversation_members me ON me.conversation_id = c.id AND me.user_id = ?
+        WHERE c.id = ?`,
+		viewerID, viewerID, id).Scan(&g.ID, &g.Name, &g.CreatedBy, &g.CreatedAt, &g.UnreadCount, &lastMessageAt)
+	if err != nil {
+		return g, notFound(err)
+	}
+	if lastMessageAt.Valid {
+		if t, err := database.ParseTime(lastMessageAt.String); err == nil {
+			g.LastMessageAt = &t
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT u.id, u.nickname
+        FROM conversation_members m
+        JOIN users u ON u.id = m.user_id
+        WHERE m.conversation_id = ?
+        ORDER BY m.joined_at, u.nickname`, id)
+	if err != nil {
+		return g, err
+	}
+	defer rows.Close()
+
+	g.Members = []models.User{}
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.Nickname); err != nil {
+			return g, err
+		}
+		g.Members = append(g.Members, u)
+	}
+	return g, rows.Err()
+}
+
+func (s *groups) List(ctx context.Context, userID string) ([]store.Group, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT c.id, c.name, c.created_by, c.created_at,
+               (SELECT COUNT(*) FROM group_messages gm
+                WHERE gm.conversation_id = c.id AND gm.sender_id != ? AND gm.idss > me.last_read_idss),
+               (SELECT MAX(gm.created_at) FROM group_messages gm WHERE gm.conversation_id = c.id)
+        FROM conversation_members me
+        JOIN conversations c ON c.id = me.conversation_id
+        WHERE me.user_id = ?
+        ORDER BY COALESCE((SELECT MAX(gm.idss) FROM group_messages gm WHERE gm.conversation_id = c.id), 0) DESC,
+                 me.joined_at DESC`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []store.Group{}
+	index := make(map[string]int)
+	for rows.Next() {
+		g := store.Group{Members: []models.User{}}
+		var lastMessageAt sql.NullString
+		if err := rows.Scan(&g.ID, &g.Name, &g.CreatedBy, &g.CreatedAt, &g.UnreadCount, &lastMessageAt); err != nil {
+			return nil, err
+		}
+		if lastMessageAt.Valid {
+			if t, err := database.ParseTime(lastMessageAt.String); err == nil {
+				g.LastMessageAt = &t
+			}
+		}
+		index[g.ID] = len(list)
+		list = append(list, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// The members of every group at once
+	rows, err = s.db.QueryContext(ctx, `
+        SELECT m.conversation_id, u.id, u.nickname
+        FROM conversation_members me
+        JOIN conversation_members m ON m.conversation_id = me.conversation_id
+        JOIN users u ON u.id = m.user_id
+        WHERE me.user_id = ?
+        ORDER BY m.joined_at, u.nickname`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var u models.User
+		if err := rows.Scan(&id, &u.ID, &u.Nickname); err != nil {
+			return nil, err
+		}
+		// A group joined between the two queries is left out
+		if i, ok := index[id]; ok {
+			list[i].Members = append(list[i].Members, u)
+		}
+	}
+	return list, rows.Err()
+}
+
+func (s *groups) Rename(ctx context.Context, id, name string) error {
+	_, err := s.writer.ExecContext(ctx, `UPDATE conversations SET name = ? WHERE id = ?`, name, id)
+	return err
+}
+
+func (s *groups) IsMember(ctx context.Context, id, userID string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM conversation_members
+        WHERE conversation_id = ? AND user_id = ?`,
+		id, userID).Scan(&n)
+	return n > 0, err
+}
+
+func (s *groups) MemberIDs(ctx context.Context, id string) ([]string, error) {
+	return queryStrings(ctx, s.db, `
+        SELECT user_id FROM conversation_members WHERE conversation_id = ?`, id)
+}
+
+func (s *groups) AddMember(ctx context.Context, id, userID string) error {
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO conversation_members (conversation_id, user_id) VALUES (?, ?)
+        ON CONFLICT DO NOTHING`,
+		id, userID)
+	return err
+}
+
+func (s *groups) RemoveMember(ctx context.Context, id, userID string) error {
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+        DELETE FROM conversation_members WHERE conversation_id = ? AND user_id = ?`,
+		id, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+        DELETE FROM conversations
+        WHERE id = ? AND NOT EXISTS (SELECT 1 FROM conversation_members WHERE conversation_id = ?)`,
+		id, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *groups) ReadPositions(ctx context.Context, id string) (map[string]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT user_id, last_read_idss FROM conversation_members WHERE conversation_id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	positions := make(map[string]int64)
+	for rows.Next() {
+		var userID string
+		var lastRead int64
+		if err := rows.Scan(&userID, &lastRead); err != nil {
+			return nil, err
+		}
+		positions[userID] = lastRead
+	}
+	return positions, rows.Err()
+}
+
+func (s *groups) Messages(ctx context.Context, id string, limit, offset int) ([]store.GroupMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT m.idss, m.id, m.sender_id, m.content, m.created_at, u.nickname
+        FROM group_messages m
+        JOIN users u ON m.sender_id = u.id
+        WHERE m.conversation_id = ?
+        ORDER BY m.idss DESC
+        LIMIT ? OFFSET ?`, id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []store.GroupMessage
+	for rows.Next() {
+		msg := store.GroupMessage{ConversationID: id}
+		if err := rows.Scan(&msg.Seq, &msg.ID, &msg.SenderID, &msg.Content, &msg.CreatedAt, &msg.Sender); err != nil {
+			return nil, err
+		}
+		list = append(list, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+}
+
+func (s *groups) Send(ctx context.Context, m store.GroupMessage) error {
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO group_messages (id, conversation_id, sender_id, content)
+        VALUES (?, ?, ?, ?)`,
+		m.ID, m.ConversationID, m.SenderID, m.Content)
+	return err
+}
+
+func (s *groups) MarkRead(ctx context.Context, id, userID, messageID string) (bool, error) {
+	res, err := s.writer.ExecContext(ctx, `
+        UPDATE conversation_members
+        SET last_read_idss = (SELECT idss FROM group_messages WHERE id = ? AND conversation_id = ?)
+        WHERE conversation_id = ? AND user_id = ?
+          AND last_read_idss < (SELECT idss FROM group_messages WHERE id = ? AND conversation_id = ?)`,
+		messageID, id, id, userID, messageID, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *groups) Unread(ctx context.Context, userID string) ([]store.UnreadGroup, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT c.id, c.name, COUNT(gm.idss)
+        FROM conversation_members me
+        JOIN conversations c ON c.id = me.conversation_id
+        JOIN group_messages gm ON gm.conversation_id = c.id
+        WHERE me.user_id = ? AND gm.sender_id != ? AND gm.idss > me.last_read_idss
+        GROUP BY c.id, c.name
+        ORDER BY MAX(gm.idss) DESC`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []store.UnreadGroup{}
+	for rows.Next() {
+		var g store.UnreadGroup
+		if err := rows.Scan(&g.ConversationID, &g.Name, &g.Count); err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,69 @@
+package sqlstore
+
+import (
+	"context"
+	"testing"
+
+	"jj/store"
+)
+
+func TestGroupsList(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b", "c"} {
+		err := st.Users.Create(ctx, store.NewUser{ID: id, Nickname: "user-" + id, Email: id + "@example.com", PasswordHash: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := st.Groups.Create(ctx, "quiet", "quiet", "a", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Groups.Create(ctx, "busy", "busy", "a", []string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Groups.Send(ctx, store.GroupMessage{ID: "m1", ConversationID: "busy", SenderID: "c", Content: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := st.Groups.List(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "busy" || list[1].ID != "quiet" {
+		t.Fatalf("List = %+v, want busy then quiet", list)
+	}
+	if got := len(list[0].Members); got != 3 {
+		t.Errorf("busy has %d members, want 3", got)
+	}
+	if got := len(list[1].Members); got != 2 {
+		t.Errorf("quiet has %d members, want 2", got)
+	}
+	if list[0].UnreadCount != 1 || list[0].LastMessageAt == nil {
+		t.Errorf("busy: unread %d, last message %v; want 1 and a time", list[0].UnreadCount, list[0].LastMessageAt)
+	}
+	// List agrees with Get, one group at a time
+	for _, g := range list {
+		one, err := st.Groups.Get(ctx, g.ID, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if one.Name != g.Name || one.UnreadCount != g.UnreadCount || len(one.Members) != len(g.Members) {
+			t.Errorf("List %+v, Get %+v", g, one)
+		}
+	}
+
+	// The group goes with its last member
+	for _, id := range []string{"a", "b"} {
+		if err := st.Groups.RemoveMember(ctx, "quiet", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.Groups.Get(ctx, "quiet", "a"); err != store.ErrNotFound {
+		t.Errorf("Get of an empty group: %v, want %v", err, store.ErrNotFound)
+	}
+	if list, _ := st.Groups.List(ctx, "a"); len(list) != 1 {
+		t.Errorf("after leaving quiet, List has %d groups, want 1", len(list))
+	}
+}
@@ -0,0 +1,100 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"jj/store"
+)
+
+type keys struct {
+	db     *sql.DB
+	writer *sql.DB
+}
+
+func (s *keys) Active(ctx context.Context, userID string) ([]store.DeviceKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, user_id, device_id, public_key, created_at
+        FROM user_keys
+        WHERE user_id = ? AND revoked_at IS NULL
+        ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []store.DeviceKey{}
+	for rows.Next() {
+		var k store.DeviceKey
+		if err := rows.Scan(&k.ID, &k.UserID, &k.DeviceID, &k.PublicKey, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+	}
+	return list, rows.Err()
+}
+
+func (s *keys) Publish(ctx context.Context, k store.DeviceKey) (store.DeviceKey, error) {
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return k, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE user_keys SET revoked_at = CURRENT_TIMESTAMP
+        WHERE user_id = ? AND device_id = ? AND revoked_at IS NULL`, k.UserID, k.DeviceID); err != nil {
+		return k, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO user_keys (id, user_id, device_id, public_key) VALUES (?, ?, ?, ?)`,
+		k.ID, k.UserID, k.DeviceID, k.PublicKey); err != nil {
+		return k, err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT created_at FROM user_keys WHERE id = ?`, k.ID).Scan(&k.CreatedAt); err != nil {
+		return k, err
+	}
+	return k, tx.Commit()
+}
+
+func (s *keys) Revoke(ctx context.Context, keyID, userID string) error {
+	res, err := s.writer.ExecContext(ctx, `
+        UPDATE user_keys SET revoked_at = CURRENT_TIMESTAMP
+        WHERE id = ? AND user_id = ? AND revoked_at IS NULL`, keyID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (s *keys) Envelopes(ctx context.Context, messageIDs []string, userID string) (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+	placeholders, args := inList(messageIDs)
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT e.message_id, e.key_id, e.envelope
+        FROM message_key_envelopes e
+        JOIN user_keys k ON k.id = e.key_id
+        WHERE e.message_id IN (`+placeholders+`) AND k.user_id = ?`, append(args, userID)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, keyID, envelope string
+		if err := rows.Scan(&messageID, &keyID, &envelope); err != nil {
+			return nil, err
+		}
+		if result[messageID] == nil {
+			result[messageID] = make(map[string]string)
+		}
+		result[messageID][keyID] = envelope
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,593 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"jj/database"
+	"jj/store"
+)
+
+type messages struct {
+	db      *sql.DB
+	writer  *sql.DB
+	dialect database.Dialect
+	stmts   *statements
+}
+
+// unexpired hides messages past their disappearing timer until they are
+// expired for good. It expects the messages table to be aliased as m.
+const unexpired = "(m.expires_at IS NULL OR m.expires_at > CURRENT_TIMESTAMP)"
+
+func (s *messages) SendPrivate(ctx context.Context, m store.NewPrivateMessage) (store.SentPrivateMessage, error) {
+	var sent store.SentPrivateMessage
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return sent, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.StmtContext(ctx, s.stmts.insertMessage).ExecContext(ctx,
+		m.ID, m.SenderID, m.ReceiverID, m.Content, m.DisappearingSeconds, m.DisappearingSeconds, m.Encrypted)
+	if err != nil {
+		return sent, err
+	}
+	if m.Encrypted {
+		for keyID, envelope := range m.Envelopes {
+			_, err := tx.ExecContext(ctx, `
+                INSERT INTO message_key_envelopes (message_id, key_id, envelope) VALUES (?, ?, ?)`,
+				m.ID, keyID, envelope)
+			if err != nil {
+				return sent, err
+			}
+		}
+		if sent.SwitchedToEncryption, err = markEncrypted(ctx, tx, m.SenderID, m.ReceiverID); err != nil {
+			return sent, err
+		}
+	}
+	if sent.Attachments, err = claimAttachments(ctx, tx, m.SenderID, m.ID, m.AttachmentIDs); err != nil {
+		return sent, err
+	}
+	return sent, tx.Commit()
+}
+
+// markEncrypted switches the conversation between the two users to
+// end-to-end encryption for good, and reports whether it was not yet.
+func markEncrypted(ctx context.Context, tx *sql.Tx, userID, otherID string) (bool, error) {
+	a, b := userID, otherID
+	if a > b {
+		a, b = b, a
+	}
+	res, err := tx.ExecContext(ctx, `
+        INSERT INTO conversation_settings (user_a, user_b, encrypted, updated_by)
+        VALUES (?, ?, TRUE, ?)
+        ON CONFLICT (user_a, user_b) DO UPDATE SET
+            encrypted = TRUE,
+            updated_by = excluded.updated_by,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE conversation_settings.encrypted = FALSE`,
+		a, b, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// claimAttachments attaches the uploader's pending uploads to a message.
+func claimAttachments(ctx context.Context, tx *sql.Tx, uploaderID, messageID string, attachmentIDs []string) ([]store.AttachmentInfo, error) {
+	attachments := []store.AttachmentInfo{}
+	for _, id := range attachmentIDs {
+		res, err := tx.ExecContext(ctx, `
+            UPDATE attachments SET message_id = ?
+            WHERE id = ? AND uploader_id = ? AND message_id IS NULL`,
+			messageID, id, uploaderID)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return nil, store.ErrAttachmentNotFound
+		}
+
+		a := store.AttachmentInfo{ID: id}
+		var thumbnailKey sql.NullString
+		err = tx.QueryRowContext(ctx, `
+            SELECT file_name, content_type, size, thumbnail_key FROM attachments WHERE id = ?`, id).
+			Scan(&a.FileName, &a.ContentType, &a.Size, &thumbnailKey)
+		if err != nil {
+			return nil, err
+		}
+		a.HasThumbnail = thumbnailKey.Valid
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+func (s *messages) ListPrivate(ctx context.Context, userID, otherID string, limit, offset int) ([]store.PrivateMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT m.id, m.sender_id, m.receiver_id, u.nickname, m.content, m.created_at, m.is_read, m.edited_at, m.is_deleted, m.expires_at, m.is_encrypted
+        FROM private_messages m
+        JOIN users u ON m.sender_id = u.id
+        WHERE ((m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?))
+          AND `+unexpired+`
+        ORDER BY m.idss DESC, m.id DESC
+        LIMIT ? OFFSET ?`,
+		userID, otherID, otherID, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []store.PrivateMessage
+	for rows.Next() {
+		var msg store.PrivateMessage
+		var editedAt, expiresAt sql.NullTime
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Sender, &msg.Content, &msg.CreatedAt, &msg.IsRead, &editedAt, &msg.IsDeleted, &expiresAt, &msg.IsEncrypted); err != nil {
+			return nil, err
+		}
+		if editedAt.Valid {
+			msg.EditedAt = &editedAt.Time
+		}
+		if expiresAt.Valid {
+			msg.ExpiresAt = &expiresAt.Time
+		}
+		list = append(list, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+}
+
+func (s *messages) MarkRead(ctx context.Context, messageID, senderID, receiverID string) (bool, error) {
+	res, err := s.stmts.markRead.ExecContext(ctx, messageID, senderID, receiverID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *messages) MarkReadUntil(ctx context.Context, messageID, senderID, receiverID string) (int64, error) {
+	res, err := s.writer.ExecContext(ctx, `
+        UPDATE private_messages SET is_read = TRUE
+        WHERE sender_id = ? AND receiver_id = ? AND is_read = FALSE
+          AND idss <= (SELECT idss FROM private_messages WHERE id = ? AND sender_id = ? AND receiver_id = ?)`,
+		senderID, receiverID, messageID, senderID, receiverID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *messages) Edit(ctx context.Context, messageID, senderID, content string, window time.Duration) (string, bool, error) {
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var receiverID, previous string
+	var encrypted, recent bool
+	err = tx.QueryRowContext(ctx, `
+        SELECT m.receiver_id, m.content, m.is_encrypted,
+               m.created_at >= `+s.dialect.SecondsFromNow("?")+`
+        FROM private_messages m
+        WHERE m.id = ? AND m.sender_id = ? AND m.is_deleted = FALSE AND `+unexpired,
+		-int64(window/time.Second), messageID, senderID).Scan(&receiverID, &previous, &encrypted, &recent)
+	if err != nil {
+		return "", false, notFound(err)
+	}
+	if encrypted || !recent {
+		return "", false, store.ErrNotEditable
+	}
+	// A message sent in plaintext stays as it was once the conversation
+	// is encrypted
+	var conversationEncrypted bool
+	a, b := orderedPair(senderID, receiverID)
+	err = tx.QueryRowContext(ctx, `
+        SELECT encrypted FROM conversation_settings WHERE user_a = ? AND user_b = ?`, a, b).Scan(&conversationEncrypted)
+	if err != nil && err != sql.ErrNoRows {
+		return "", false, err
+	}
+	if conversationEncrypted {
+		return "", false, store.ErrEncryptedConversation
+	}
+	if previous == content {
+		return receiverID, false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+        INSERT INTO private_message_edits (message_id, content) VALUES (?, ?)`,
+		messageID, previous); err != nil {
+		return "", false, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE private_messages SET content = ?, edited_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		content, messageID); err != nil {
+		return "", false, err
+	}
+	return receiverID, true, tx.Commit()
+}
+
+func (s *messages) Delete(ctx context.Context, messageID, senderID string) (string, error) {
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var receiverID string
+	err = tx.QueryRowContext(ctx, `
+        SELECT receiver_id FROM private_messages
+        WHERE id = ? AND sender_id = ? AND is_deleted = FALSE`,
+		messageID, senderID).Scan(&receiverID)
+	if err != nil {
+		return "", notFound(err)
+	}
+
+	for _, table := range []string{"private_message_edits", "message_reactions", "message_key_envelopes"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE message_id = ?`, messageID); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+        UPDATE private_messages SET content = '', is_deleted = TRUE WHERE id = ?`, messageID); err != nil {
+		return "", err
+	}
+	return receiverID, tx.Commit()
+}
+
+func (s *messages) Conversations(ctx context.Context, userID string) ([]store.ConversationSummary, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        WITH latest AS (
+            SELECT CASE WHEN sender_id = ? THEN receiver_id ELSE sender_id END AS other_id,
+                   MAX(idss) AS last_idss
+            FROM private_messages m
+            WHERE (sender_id = ? OR receiver_id = ?) AND `+unexpired+`
+            GROUP BY other_id
+        ),
+        unread AS (
+            SELECT sender_id AS other_id, COUNT(*) AS unread_count
+            FROM private_messages m
+            WHERE receiver_id = ? AND is_read = FALSE AND is_deleted = FALSE AND `+unexpired+`
+            GROUP BY sender_id
+        )
+        SELECT u.id, u.nickname, u.is_online,
+               m.id, m.sender_id, m.content, m.created_at, m.is_deleted, m.is_encrypted,
+               COALESCE(un.unread_count, 0)
+        FROM users u
+        LEFT JOIN latest l ON l.other_id = u.id
+        LEFT JOIN private_messages m ON m.idss = l.last_idss
+        LEFT JOIN unread un ON un.other_id = u.id
+        WHERE u.id != ?
+        ORDER BY l.last_idss IS NULL, l.last_idss DESC, LOWER(u.nickname)`,
+		userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []store.ConversationSummary{}
+	for rows.Next() {
+		var c store.ConversationSummary
+		var msgID, senderID, content sql.NullString
+		var createdAt sql.NullTime
+		var isDeleted, isEncrypted sql.NullBool
+		if err := rows.Scan(&c.ID, &c.Nickname, &c.IsOnline,
+			&msgID, &senderID, &content, &createdAt, &isDeleted, &isEncrypted, &c.UnreadCount); err != nil {
+			return nil, err
+		}
+		if msgID.Valid {
+			c.LastMessage = &store.PrivateMessage{
+				ID:          msgID.String,
+				SenderID:    senderID.String,
+				Content:     content.String,
+				CreatedAt:   createdAt.Time,
+				IsDeleted:   isDeleted.Bool,
+				IsEncrypted: isEncrypted.Bool,
+			}
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+func (s *messages) UnreadBySender(ctx context.Context, userID string) ([]store.UnreadSender, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT m.sender_id, u.nickname, COUNT(*), MAX(m.created_at)
+        FROM private_messages m
+        JOIN users u ON u.id = m.sender_id
+        WHERE m.receiver_id = ? AND m.is_read = FALSE AND m.is_deleted = FALSE AND `+unexpired+`
+        GROUP BY m.sender_id, u.nickname
+        ORDER BY MAX(m.idss) DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []store.UnreadSender{}
+	for rows.Next() {
+		var u store.UnreadSender
+		var lastMessageAt string
+		if err := rows.Scan(&u.SenderID, &u.Nickname, &u.Count, &lastMessageAt); err != nil {
+			return nil, err
+		}
+		if t, err := database.ParseTime(lastMessageAt); err == nil {
+			u.LastMessageAt = t
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+func (s *messages) Search(ctx context.Context, q store.MessageSearch) ([]store.SearchResult, error) {
+	query := `
+        SELECT m.idss, m.id, m.sender_id, m.receiver_id, m.content, m.created_at, u.nickname
+        FROM private_messages m
+        JOIN users u ON u.id = m.sender_id`
+	var where []string
+	var args []interface{}
+	if database.FullTextSearch {
+		query += ` JOIN private_messages_fts f ON f.rowid = m.idss`
+		where = append(where, "private_messages_fts MATCH ?")
+		args = append(args, database.FTSQuery(q.Terms))
+	} else {
+		for _, t := range q.Terms {
+			where = append(where, `m.content `+s.dialect.ILike()+` ? ESCAPE '\'`)
+			args = append(args, database.LikePattern(t))
+		}
+	}
+	// Ciphertext can't be searched, only the participants' devices can read it
+	where = append(where, "m.is_deleted = FALSE", "m.is_encrypted = FALSE", unexpired, "(m.sender_id = ? OR m.receiver_id = ?)")
+	args = append(args, q.UserID, q.UserID)
+	if q.WithUserID != "" {
+		where = append(where, "(m.sender_id = ? OR m.receiver_id = ?)")
+		args = append(args, q.WithUserID, q.WithUserID)
+	}
+	query += " WHERE " + strings.Join(where, " AND ") + " ORDER BY m.idss DESC LIMIT ?"
+	args = append(args, q.Limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var seqs []int64
+	results := []store.SearchResult{}
+	for rows.Next() {
+		var seq int64
+		var res store.SearchResult
+		if err := rows.Scan(&seq, &res.ID, &res.SenderID, &res.ReceiverID, &res.Content, &res.CreatedAt, &res.Sender); err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, seq)
+		results = append(results, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i := range results {
+		if err := s.searchContext(ctx, &results[i], q.UserID, seqs[i], q.Context); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// searchContext fills in the neighbouring message IDs and the page offset
+// of a search result in the conversation between userID and the other
+// participant.
+func (s *messages) searchContext(ctx context.Context, res *store.SearchResult, userID string, seq int64, size int) error {
+	otherID := res.ReceiverID
+	if otherID == userID {
+		otherID = res.SenderID
+	}
+	const pair = `((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))`
+	pairArgs := []interface{}{userID, otherID, otherID, userID}
+
+	before, err := queryStrings(ctx, s.db, `SELECT id FROM private_messages m WHERE `+pair+` AND `+unexpired+` AND idss < ? ORDER BY idss DESC LIMIT ?`,
+		append(pairArgs, seq, size)...)
+	if err != nil {
+		return err
+	}
+	// Fetched newest first; context is listed oldest first
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+	after, err := queryStrings(ctx, s.db, `SELECT id FROM private_messages m WHERE `+pair+` AND `+unexpired+` AND idss > ? ORDER BY idss ASC LIMIT ?`,
+		append(pairArgs, seq, size)...)
+	if err != nil {
+		return err
+	}
+	res.Before, res.After = before, after
+
+	return s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM private_messages m WHERE `+pair+` AND `+unexpired+` AND idss > ?`,
+		append(pairArgs, seq)...).Scan(&res.Offset)
+}
+
+func (s *messages) ListAfter(ctx context.Context, userID, otherID string, cursor int64, limit int) ([]store.PrivateMessage, int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT m.idss, m.id, m.sender_id, m.receiver_id, u.nickname, m.content, m.created_at, m.is_read, m.edited_at, m.is_deleted, m.expires_at, m.is_encrypted
+        FROM private_messages m
+        JOIN users u ON u.id = m.sender_id
+        WHERE ((m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?))
+          AND m.idss > ? AND `+unexpired+`
+        ORDER BY m.idss ASC
+        LIMIT ?`,
+		userID, otherID, otherID, userID, cursor, limit)
+	if err != nil {
+		return nil, cursor, err
+	}
+	defer rows.Close()
+
+	list := make([]store.PrivateMessage, 0, limit)
+	last := cursor
+	for rows.Next() {
+		var msg store.PrivateMessage
+		var editedAt, expiresAt sql.NullTime
+		if err := rows.Scan(&last, &msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Sender, &msg.Content, &msg.CreatedAt,
+			&msg.IsRead, &editedAt, &msg.IsDeleted, &expiresAt, &msg.IsEncrypted); err != nil {
+			return nil, cursor, err
+		}
+		if editedAt.Valid {
+			msg.EditedAt = &editedAt.Time
+		}
+		if expiresAt.Valid {
+			msg.ExpiresAt = &expiresAt.Time
+		}
+		list = append(list, msg)
+	}
+	return list, last, rows.Err()
+}
+
+func (s *messages) Participants(ctx context.Context, messageID, userID string) (string, string, error) {
+	var senderID, receiverID string
+	err := s.db.QueryRowContext(ctx, `
+        SELECT sender_id, receiver_id FROM private_messages m
+        WHERE id = ? AND is_deleted = FALSE AND (sender_id = ? OR receiver_id = ?)
+          AND `+unexpired,
+		messageID, userID, userID).Scan(&senderID, &receiverID)
+	return senderID, receiverID, notFound(err)
+}
+
+// Expired runs up to three passes, each stopping once limit messages are
+// found, so that every query can use an index: messages past their
+// disappearing timer, messages older than the global retention, and then
+// the messages of each conversation whose own retention is shorter. The
+// retention passes skip what the earlier passes already cover, and the
+// last one only runs for conversations that set a retention. Each pass
+// sorts on its indexed column; ordering by idss would have SQLite walk the
+// whole table in rowid order instead.
+func (s *messages) Expired(ctx context.Context, retention time.Duration, skipDeleted bool, limit int) ([]store.ExpiredMessage, error) {
+	live := ""
+	if skipDeleted {
+		live = " AND m.is_deleted = FALSE"
+	}
+
+	list, err := s.expired(ctx, `
+        SELECT m.id, m.sender_id, m.receiver_id FROM private_messages m
+        WHERE m.expires_at <= CURRENT_TIMESTAMP`+live+`
+        ORDER BY m.expires_at LIMIT ?`, limit)
+	if err != nil || len(list) == limit {
+		return list, err
+	}
+
+	global := int64(retention / time.Second)
+	if global > 0 {
+		more, err := s.expired(ctx, `
+            SELECT m.id, m.sender_id, m.receiver_id FROM private_messages m
+            WHERE m.created_at <= `+s.dialect.SecondsFromNow("?")+` AND `+unexpired+live+`
+            ORDER BY m.created_at LIMIT ?`, -global, limit-len(list))
+		list = append(list, more...)
+		if err != nil || len(list) == limit {
+			return list, err
+		}
+	}
+
+	// Conversations can only shorten the global retention
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT user_a, user_b, retention_seconds FROM conversation_settings
+        WHERE retention_seconds > 0 AND (? = 0 OR retention_seconds < ?)`, global, global)
+	if err != nil {
+		return list, err
+	}
+	type conversation struct {
+		a, b string
+		keep int64
+	}
+	var conversations []conversation
+	for rows.Next() {
+		var c conversation
+		if err := rows.Scan(&c.a, &c.b, &c.keep); err != nil {
+			rows.Close()
+			return list, err
+		}
+		conversations = append(conversations, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return list, err
+	}
+
+	olderThanGlobal := ""
+	if global > 0 {
+		olderThanGlobal = " AND m.created_at > " + s.dialect.SecondsFromNow("?")
+	}
+	for _, c := range conversations {
+		args := []interface{}{c.a, c.b, c.b, c.a, -c.keep}
+		if global > 0 {
+			args = append(args, -global)
+		}
+		more, err := s.expired(ctx, `
+            SELECT m.id, m.sender_id, m.receiver_id FROM private_messages m
+            WHERE ((m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?))
+              AND m.created_at <= `+s.dialect.SecondsFromNow("?")+olderThanGlobal+` AND `+unexpired+live+`
+            ORDER BY m.idss LIMIT ?`, append(args, limit-len(list))...)
+		list = append(list, more...)
+		if err != nil || len(list) == limit {
+			return list, err
+		}
+	}
+	return list, nil
+}
+
+// expired runs one pass of Expired.
+func (s *messages) expired(ctx context.Context, query string, args ...interface{}) ([]store.ExpiredMessage, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []store.ExpiredMessage
+	for rows.Next() {
+		var m store.ExpiredMessage
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.ReceiverID); err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+func (s *messages) Expire(ctx context.Context, ids []string, redact bool) error {
+	placeholders, args := inList(ids)
+	in := "(" + placeholders + ")"
+
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		"DELETE FROM private_message_edits WHERE message_id IN " + in,
+		"DELETE FROM message_reactions WHERE message_id IN " + in,
+		"DELETE FROM message_key_envelopes WHERE message_id IN " + in,
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+			return err
+		}
+	}
+	if redact {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE private_messages SET content = '', is_deleted = TRUE, edited_at = NULL, expires_at = NULL
+            WHERE id IN `+in, args...)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM private_messages WHERE id IN "+in, args...)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,143 @@
+package sqlstore
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"jj/config"
+	"jj/database"
+	"jj/store"
+)
+
+// openTestStore migrates a fresh SQLite database in a temporary directory.
+func openTestStore(t *testing.T) store.Store {
+	t.Helper()
+	cfg := config.Default().Database
+	cfg.Path = filepath.Join(t.TempDir(), "forum.db")
+	if err := database.InitDB(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.CloseDB)
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := New(database.DB, database.Writer, database.Current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestExpired(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		err := st.Users.Create(ctx, store.NewUser{ID: id, Nickname: "user-" + id, Email: id + "@example.com", PasswordHash: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the conversation between c and d has its own retention
+	if err := st.Settings.SetRetention(ctx, "c", "d", 3600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []struct {
+		id, sender, receiver, age, expires string
+		deleted                            bool
+	}{
+		{id: "timer", sender: "a", receiver: "b", age: "-1 minutes", expires: "-1 seconds"},
+		{id: "timer-pending", sender: "a", receiver: "b", age: "-1 minutes", expires: "+1 hours"},
+		{id: "old", sender: "a", receiver: "b", age: "-2 days"},
+		{id: "old-tombstone", sender: "b", receiver: "a", age: "-3 days", deleted: true},
+		{id: "recent", sender: "a", receiver: "b", age: "-2 hours"},
+		{id: "conversation", sender: "d", receiver: "c", age: "-2 hours"},
+		{id: "conversation-recent", sender: "c", receiver: "d", age: "-10 minutes"},
+	} {
+		expires := "NULL"
+		if m.expires != "" {
+			expires = "datetime('now', '" + m.expires + "')"
+		}
+		_, err := database.DB.Exec(`
+            INSERT INTO private_messages (id, sender_id, receiver_id, content, created_at, expires_at, is_deleted)
+            VALUES (?, ?, ?, 'text', datetime('now', ?), `+expires+`, ?)`,
+			m.id, m.sender, m.receiver, m.age, m.deleted)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expired := func(retention time.Duration, skipDeleted bool, limit int) string {
+		t.Helper()
+		list, err := st.Messages.Expired(ctx, retention, skipDeleted, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, m := range list {
+			ids = append(ids, m.ID)
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	tests := []struct {
+		name        string
+		retention   time.Duration
+		skipDeleted bool
+		limit       int
+		want        string
+	}{
+		{"no global retention", 0, false, 10, "conversation,timer"},
+		{"global retention", 24 * time.Hour, false, 10, "conversation,old,old-tombstone,timer"},
+		{"skip tombstones", 24 * time.Hour, true, 10, "conversation,old,timer"},
+		{"global retention shorter than the conversation's", 90 * time.Minute, false, 10, "conversation,old,old-tombstone,recent,timer"},
+		{"limit stops at the timer pass", 24 * time.Hour, false, 1, "timer"},
+		{"limit stops at the global pass", 24 * time.Hour, true, 2, "old,timer"},
+	}
+	for _, tt := range tests {
+		if got := expired(tt.retention, tt.skipDeleted, tt.limit); got != tt.want {
+			t.Errorf("%s: Expired = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpireRedact(t *testing.T) {
+	st := openTestStore(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		if err := st.Users.Create(ctx, store.NewUser{ID: id, Nickname: "user-" + id, Email: id + "@example.com", PasswordHash: "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.Messages.SendPrivate(ctx, store.NewPrivateMessage{ID: "m", SenderID: "a", ReceiverID: "b", Content: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Reactions.Add(ctx, "m", "b", "👍"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.Messages.Expire(ctx, []string{"m"}, true); err != nil {
+		t.Fatal(err)
+	}
+	list, err := st.Messages.ListPrivate(ctx, "a", "b", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !list[0].IsDeleted || list[0].Content != "" {
+		t.Fatalf("after redacting, messages = %+v, want one empty tombstone", list)
+	}
+	reactions, err := st.Reactions.ForMessages(ctx, []string{"m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions["m"]) != 0 {
+		t.Errorf("redacted message kept its reactions: %v", reactions["m"])
+	}
+}
@@ -0,0 +1,98 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"jj/store"
+)
+
+type posts struct {
+	db     *sql.DB
+	writer *sql.DB
+}
+
+const selectPosts = `
+        SELECT p.id, p.user_id, u.nickname, p.category, p.title, p.content, p.created_at
+        FROM posts p
+        JOIN users u ON p.user_id = u.id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPost(row scanner) (store.Post, error) {
+	var p store.Post
+	err := row.Scan(&p.ID, &p.UserID, &p.Author, &p.Category, &p.Title, &p.Content, &p.CreatedAt)
+	return p, err
+}
+
+func (s *posts) Create(ctx context.Context, p store.Post) error {
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO posts (id, user_id, category, title, content)
+        VALUES (?, ?, ?, ?, ?)`,
+		p.ID, p.UserID, p.Category, p.Title, p.Content)
+	return err
+}
+
+func (s *posts) Get(ctx context.Context, id string) (store.Post, error) {
+	p, err := scanPost(s.db.QueryRowContext(ctx, selectPosts+` WHERE p.id = ?`, id))
+	return p, notFound(err)
+}
+
+func (s *posts) Latest(ctx context.Context) (store.Post, error) {
+	p, err := scanPost(s.db.QueryRowContext(ctx, selectPosts+` ORDER BY p.created_at DESC LIMIT 1`))
+	return p, notFound(err)
+}
+
+func (s *posts) List(ctx context.Context, limit, offset int) ([]store.Post, error) {
+	rows, err := s.db.QueryContext(ctx, selectPosts+` ORDER BY p.created_at DESC LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []store.Post
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+type comments struct {
+	db     *sql.DB
+	writer *sql.DB
+}
+
+func (s *comments) Create(ctx context.Context, c store.Comment) error {
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO comments (id, post_id, user_id, content)
+        VALUES (?, ?, ?, ?)`,
+		c.ID, c.PostID, c.UserID, c.Content)
+	return err
+}
+
+func (s *comments) ListByPost(ctx context.Context, postID string) ([]store.Comment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT c.id, c.post_id, c.user_id, u.nickname, c.content, c.created_at
+        FROM comments c
+        JOIN users u ON c.user_id = u.id
+        WHERE c.post_id = ?
+        ORDER BY c.created_at ASC`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []store.Comment
+	for rows.Next() {
+		var c store.Comment
+		if err := rows.Scan(&c.ID, &c.PostID, &c.UserID, &c.Author, &c.Content, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
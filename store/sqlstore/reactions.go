@@ -0,0 +1,79 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"jj/database"
+	"jj/store"
+)
+
+type reactions struct {
+	db      *sql.DB
+	writer  *sql.DB
+	dialect database.Dialect
+}
+
+func (s *reactions) ForMessages(ctx context.Context, messageIDs []string) (map[string][]store.Reaction, error) {
+	result := make(map[string][]store.Reaction)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+	placeholders, args := inList(messageIDs)
+	// Reactions added within the same second keep their insertion order on SQLite
+	order := "created_at"
+	if s.dialect == database.SQLite {
+		order += ", rowid"
+	}
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT message_id, emoji, user_id
+        FROM message_reactions
+        WHERE message_id IN (`+placeholders+`)
+        ORDER BY `+order, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, emoji, userID string
+		if err := rows.Scan(&messageID, &emoji, &userID); err != nil {
+			return nil, err
+		}
+		list := result[messageID]
+		found := false
+		for i := range list {
+			if list[i].Emoji == emoji {
+				list[i].UserIDs = append(list[i].UserIDs, userID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, store.Reaction{Emoji: emoji, UserIDs: []string{userID}})
+		}
+		result[messageID] = list
+	}
+	return result, rows.Err()
+}
+
+func (s *reactions) Emoji(ctx context.Context, messageID, userID string) ([]string, error) {
+	return queryStrings(ctx, s.db, `
+        SELECT emoji FROM message_reactions WHERE message_id = ? AND user_id = ?`,
+		messageID, userID)
+}
+
+func (s *reactions) Add(ctx context.Context, messageID, userID, emoji string) error {
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO message_reactions (message_id, user_id, emoji) VALUES (?, ?, ?)
+        ON CONFLICT DO NOTHING`,
+		messageID, userID, emoji)
+	return err
+}
+
+func (s *reactions) Remove(ctx context.Context, messageID, userID, emoji string) error {
+	_, err := s.writer.ExecContext(ctx, `
+        DELETE FROM message_reactions WHERE message_id = ? AND user_id = ? AND emoji = ?`,
+		messageID, userID, emoji)
+	return err
+}
@@ -0,0 +1,83 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"jj/store"
+)
+
+type relations struct {
+	db     *sql.DB
+	writer *sql.DB
+}
+
+func (s *relations) Blocked(ctx context.Context, userA, userB string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+        SELECT COUNT(*) FROM user_blocks
+        WHERE kind = ? AND ((blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?))`,
+		store.RelationBlock, userA, userB, userB, userA).Scan(&n)
+	return n > 0, err
+}
+
+func (s *relations) BlockedIDs(ctx context.Context, userID string) (map[string]bool, error) {
+	ids, err := queryStrings(ctx, s.db, `
+        SELECT blocked_id FROM user_blocks WHERE kind = ? AND blocker_id = ?
+        UNION
+        SELECT blocker_id FROM user_blocks WHERE kind = ? AND blocked_id = ?`,
+		store.RelationBlock, userID, store.RelationBlock, userID)
+	return set(ids), err
+}
+
+func (s *relations) TargetIDs(ctx context.Context, userID string) (map[string]bool, error) {
+	ids, err := queryStrings(ctx, s.db, `SELECT blocked_id FROM user_blocks WHERE blocker_id = ?`, userID)
+	return set(ids), err
+}
+
+func (s *relations) Set(ctx context.Context, userID, targetID, kind string, active bool) error {
+	var err error
+	if active {
+		_, err = s.writer.ExecContext(ctx, `
+            INSERT INTO user_blocks (blocker_id, blocked_id, kind) VALUES (?, ?, ?)
+            ON CONFLICT DO NOTHING`,
+			userID, targetID, kind)
+	} else {
+		_, err = s.writer.ExecContext(ctx, `
+            DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ? AND kind = ?`,
+			userID, targetID, kind)
+	}
+	return err
+}
+
+func (s *relations) List(ctx context.Context, userID string) ([]store.Relation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT b.kind, u.id, u.nickname
+        FROM user_blocks b
+        JOIN users u ON u.id = b.blocked_id
+        WHERE b.blocker_id = ?
+        ORDER BY b.created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []store.Relation
+	for rows.Next() {
+		var r store.Relation
+		if err := rows.Scan(&r.Kind, &r.User.ID, &r.User.Nickname); err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// set turns a list of IDs into a set.
+func set(ids []string) map[string]bool {
+	m := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		m[id] = true
+	}
+	return m
+}
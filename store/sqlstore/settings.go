@@ -0,0 +1,70 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"jj/store"
+)
+
+type settings struct {
+	db     *sql.DB
+	writer *sql.DB
+}
+
+// orderedPair returns the two user IDs in the order conversation_settings
+// stores them.
+func orderedPair(a, b string) (string, string) {
+	if a > b {
+		return b, a
+	}
+	return a, b
+}
+
+func (s *settings) Get(ctx context.Context, userID, otherID string) (store.ConversationSettings, error) {
+	var cs store.ConversationSettings
+	var updatedBy sql.NullString
+	a, b := orderedPair(userID, otherID)
+	err := s.db.QueryRowContext(ctx, `
+        SELECT retention_seconds, disappearing_seconds, encrypted, updated_by
+        FROM conversation_settings WHERE user_a = ? AND user_b = ?`, a, b).
+		Scan(&cs.RetentionSeconds, &cs.DisappearingSeconds, &cs.Encrypted, &updatedBy)
+	if err != nil && err != sql.ErrNoRows {
+		return cs, err
+	}
+	cs.UpdatedBy = updatedBy.String
+	return cs, nil
+}
+
+func (s *settings) SetDisappearing(ctx context.Context, userID, otherID string, seconds int64) error {
+	a, b := orderedPair(userID, otherID)
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO conversation_settings (user_a, user_b, disappearing_seconds, updated_by)
+        VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_a, user_b) DO UPDATE SET
+            disappearing_seconds = excluded.disappearing_seconds,
+            updated_by = excluded.updated_by,
+            updated_at = CURRENT_TIMESTAMP`,
+		a, b, seconds, userID)
+	return err
+}
+
+func (s *settings) SetRetention(ctx context.Context, userID, otherID string, seconds int64) error {
+	a, b := orderedPair(userID, otherID)
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO conversation_settings (user_a, user_b, retention_seconds, updated_by)
+        VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_a, user_b) DO UPDATE SET
+            retention_seconds = excluded.retention_seconds,
+            updated_by = excluded.updated_by,
+            updated_at = CURRENT_TIMESTAMP`,
+		a, b, seconds, userID)
+	return err
+}
+
+func (s *settings) EncryptedPeers(ctx context.Context, userID string) ([]string, error) {
+	return queryStrings(ctx, s.db, `
+        SELECT CASE WHEN user_a = ? THEN user_b ELSE user_a END
+        FROM conversation_settings
+        WHERE encrypted = TRUE AND (user_a = ? OR user_b = ?)`, userID, userID, userID)
+}
@@ -0,0 +1,77 @@
+// Package sqlstore implements the stores on database/sql for SQLite and
+// Postgres.
+//
+// Queries are shared between the two and use ? placeholders, which the
+// Postgres driver in package database rewrites; the expressions the
+// dialects spell differently come from database.Dialect.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"jj/database"
+	"jj/store"
+)
+
+// New returns the stores backed by db, which speaks dialect. Every write
+// goes through writer, which may be db itself (see database.Writer), so
+// on SQLite writes queue up in the process instead of competing for the
+// file lock. Writes never nest: a transaction on writer runs all of its
+// statements on the transaction.
+func New(db, writer *sql.DB, dialect database.Dialect) (store.Store, error) {
+	st, err := prepareStatements(db, writer, dialect)
+	if err != nil {
+		return store.Store{}, err
+	}
+	return store.Store{
+		Users:       &users{db: db, writer: writer, dialect: dialect, stmts: st},
+		Sessions:    &sessions{db: db, writer: writer, stmts: st},
+		Posts:       &posts{db: db, writer: writer},
+		Comments:    &comments{db: db, writer: writer},
+		Messages:    &messages{db: db, writer: writer, dialect: dialect, stmts: st},
+		Groups:      &groups{db: db, writer: writer},
+		Settings:    &settings{db: db, writer: writer},
+		Relations:   &relations{db: db, writer: writer},
+		Keys:        &keys{db: db, writer: writer},
+		Attachments: &attachments{db: db, writer: writer, dialect: dialect},
+		Reactions:   &reactions{db: db, writer: writer, dialect: dialect},
+	}, nil
+}
+
+// notFound maps sql.ErrNoRows to store.ErrNotFound.
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return store.ErrNotFound
+	}
+	return err
+}
+
+// inList returns "?,?,..." for n values and the values as arguments.
+func inList(values []string) (string, []interface{}) {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(values)), ","), args
+}
+
+// queryStrings runs a query selecting a single text column.
+func queryStrings(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
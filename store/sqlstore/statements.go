@@ -0,0 +1,52 @@
+package sqlstore
+
+import (
+	"database/sql"
+
+	"jj/database"
+)
+
+// statements are the queries run for nearly every request or message,
+// prepared once by New instead of on each call.
+type statements struct {
+	sessionUserID *sql.Stmt
+	userByID      *sql.Stmt
+
+	// Prepared on the writer, where they run
+	insertMessage *sql.Stmt
+	markRead      *sql.Stmt
+}
+
+func prepareStatements(db, writer *sql.DB, dialect database.Dialect) (*statements, error) {
+	st := &statements{}
+	for _, p := range []struct {
+		db    *sql.DB
+		stmt  **sql.Stmt
+		query string
+	}{
+		{db, &st.sessionUserID, `SELECT id FROM users WHERE token = ?`},
+		{db, &st.userByID, `SELECT id, nickname FROM users WHERE id = ?`},
+		{writer, &st.insertMessage, `
+        INSERT INTO private_messages (id, sender_id, receiver_id, content, is_read, expires_at, is_encrypted)
+        VALUES (?, ?, ?, ?, FALSE, CASE WHEN ? > 0 THEN ` + dialect.SecondsFromNow("?") + ` END, ?)`},
+		{writer, &st.markRead, `
+        UPDATE private_messages SET is_read = TRUE
+        WHERE id = ? AND sender_id = ? AND receiver_id = ? AND is_read = FALSE`},
+	} {
+		stmt, err := p.db.Prepare(p.query)
+		if err != nil {
+			st.close()
+			return nil, err
+		}
+		*p.stmt = stmt
+	}
+	return st, nil
+}
+
+func (st *statements) close() {
+	for _, stmt := range []*sql.Stmt{st.sessionUserID, st.userByID, st.insertMessage, st.markRead} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
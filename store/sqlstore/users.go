@@ -0,0 +1,127 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+
+	"jj/database"
+	"jj/models"
+	"jj/store"
+)
+
+type users struct {
+	db      *sql.DB
+	writer  *sql.DB
+	dialect database.Dialect
+	stmts   *statements
+}
+
+func (s *users) Create(ctx context.Context, u store.NewUser) error {
+	_, err := s.writer.ExecContext(ctx, `
+        INSERT INTO users (id, nickname, age, gender, first_name, last_name, email, password)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.ID, u.Nickname, u.Age, u.Gender, u.FirstName, u.LastName, u.Email, u.PasswordHash)
+	if s.dialect.IsUniqueViolation(err) {
+		return store.ErrDuplicate
+	}
+	return err
+}
+
+func (s *users) ByID(ctx context.Context, id string) (models.User, error) {
+	var u models.User
+	err := s.stmts.userByID.QueryRowContext(ctx, id).Scan(&u.ID, &u.Nickname)
+	return u, notFound(err)
+}
+
+func (s *users) ByIDs(ctx context.Context, ids []string) ([]models.User, error) {
+	list := []models.User{}
+	if len(ids) == 0 {
+		return list, nil
+	}
+	placeholders, args := inList(ids)
+	rows, err := s.db.QueryContext(ctx, `SELECT id, nickname FROM users WHERE id IN (`+placeholders+`) ORDER BY nickname`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.Nickname); err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+func (s *users) Credentials(ctx context.Context, identifier string) (store.Credentials, error) {
+	var c store.Credentials
+	err := s.db.QueryRowContext(ctx, `
+        SELECT id, nickname, password FROM users WHERE nickname = ? OR email = ?`,
+		identifier, identifier).Scan(&c.ID, &c.Nickname, &c.PasswordHash)
+	return c, notFound(err)
+}
+
+func (s *users) List(ctx context.Context) ([]store.UserStatus, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, nickname, is_online FROM users`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []store.UserStatus
+	for rows.Next() {
+		var u store.UserStatus
+		if err := rows.Scan(&u.ID, &u.Nickname, &u.IsOnline); err != nil {
+			return nil, err
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+func (s *users) SetOnline(ctx context.Context, id string, online bool) error {
+	query := `UPDATE users SET is_online = TRUE WHERE id = ?`
+	if !online {
+		query = `UPDATE users SET is_online = FALSE, last_seen = CURRENT_TIMESTAMP WHERE id = ?`
+	}
+	_, err := s.writer.ExecContext(ctx, query, id)
+	return err
+}
+
+func (s *users) ResetOnline(ctx context.Context, keep []string) (int64, error) {
+	query := `UPDATE users SET is_online = FALSE WHERE is_online = TRUE`
+	var args []interface{}
+	if len(keep) > 0 {
+		var placeholders string
+		placeholders, args = inList(keep)
+		query += ` AND id NOT IN (` + placeholders + `)`
+	}
+	res, err := s.writer.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type sessions struct {
+	db     *sql.DB
+	writer *sql.DB
+	stmts  *statements
+}
+
+func (s *sessions) Create(ctx context.Context, userID, token string) error {
+	_, err := s.writer.ExecContext(ctx, `
+        UPDATE users SET token = ?, last_seen = CURRENT_TIMESTAMP WHERE id = ?`, token, userID)
+	return err
+}
+
+func (s *sessions) UserID(ctx context.Context, token string) (string, error) {
+	var userID string
+	err := s.stmts.sessionUserID.QueryRowContext(ctx, token).Scan(&userID)
+	return userID, notFound(err)
+}
+
+func (s *sessions) Delete(ctx context.Context, userID string) error {
+	_, err := s.writer.ExecContext(ctx, `UPDATE users SET token = NULL WHERE id = ?`, userID)
+	return err
+}
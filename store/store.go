@@ -0,0 +1,517 @@
+// Package store defines the persistence interfaces of users, sessions,
+// posts, comments, private and group conversations, blocks, device keys,
+// attachments and reactions.
+//
+// Handlers and the websocket hub reach those records only through the
+// interfaces below, so they work with any backend: store/sqlstore
+// implements them for SQLite and Postgres, and tests can plug in fakes.
+// Only the readiness probe talks to the database directly, to check the
+// connection and the schema themselves.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"jj/models"
+)
+
+var (
+	// ErrNotFound is returned when the requested record doesn't exist, or
+	// isn't visible to the caller.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a record would repeat a unique value,
+	// such as a nickname or email that is already taken.
+	ErrDuplicate = errors.New("already exists")
+	// ErrAttachmentNotFound is returned for an attachment that is unknown,
+	// belongs to someone else or is already attached to a message.
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	// ErrNotEditable is returned for a message that exists but can no
+	// longer be edited, such as one past the edit window.
+	ErrNotEditable = errors.New("message can no longer be edited")
+	// ErrEncryptedConversation is returned when a change would put
+	// plaintext into a conversation that has switched to encryption.
+	ErrEncryptedConversation = errors.New("conversation is end-to-end encrypted")
+)
+
+// Store groups the stores of one database.
+type Store struct {
+	Users       UserStore
+	Sessions    SessionStore
+	Posts       PostStore
+	Comments    CommentStore
+	Messages    MessageStore
+	Groups      GroupStore
+	Settings    SettingsStore
+	Relations   RelationStore
+	Keys        KeyStore
+	Attachments AttachmentStore
+	Reactions   ReactionStore
+}
+
+// NewUser is a registration. Text fields are stored as given, so callers
+// escape them first.
+type NewUser struct {
+	ID           string
+	Nickname     string
+	Age          int
+	Gender       string
+	FirstName    string
+	LastName     string
+	Email        string
+	PasswordHash string
+}
+
+// Credentials are what logging in checks a password against.
+type Credentials struct {
+	ID           string
+	Nickname     string
+	PasswordHash string
+}
+
+// UserStatus is a user with their online flag.
+type UserStatus struct {
+	models.User
+	IsOnline bool
+}
+
+// UserStore manages accounts and their online flags.
+type UserStore interface {
+	// Create registers a user, failing with ErrDuplicate if the nickname
+	// or email is taken.
+	Create(ctx context.Context, u NewUser) error
+	// ByID returns a user or ErrNotFound.
+	ByID(ctx context.Context, id string) (models.User, error)
+	// ByIDs returns the users that exist among ids, ordered by nickname.
+	ByIDs(ctx context.Context, ids []string) ([]models.User, error)
+	// Credentials finds a user by nickname or email.
+	Credentials(ctx context.Context, identifier string) (Credentials, error)
+	// List returns every user.
+	List(ctx context.Context) ([]UserStatus, error)
+	// SetOnline sets a user's online flag; going offline also records
+	// when the user was last seen.
+	SetOnline(ctx context.Context, id string, online bool) error
+	// ResetOnline clears the online flag of everyone not in keep and
+	// returns how many users it changed.
+	ResetOnline(ctx context.Context, keep []string) (int64, error)
+}
+
+// SessionStore maps session tokens to users. A user has one session at a
+// time; logging in again replaces it.
+type SessionStore interface {
+	// Create starts a session for userID under token.
+	Create(ctx context.Context, userID, token string) error
+	// UserID returns the user a token belongs to, or ErrNotFound.
+	UserID(ctx context.Context, token string) (string, error)
+	// Delete ends the user's session.
+	Delete(ctx context.Context, userID string) error
+}
+
+// Post is a forum post with its author's nickname.
+type Post struct {
+	ID        string
+	UserID    string
+	Author    string
+	Category  string
+	Title     string
+	Content   string
+	CreatedAt time.Time
+}
+
+// PostStore manages forum posts.
+type PostStore interface {
+	// Create stores p; its Author and CreatedAt are ignored.
+	Create(ctx context.Context, p Post) error
+	// Get returns a post or ErrNotFound.
+	Get(ctx context.Context, id string) (Post, error)
+	// Latest returns the newest post or ErrNotFound.
+	Latest(ctx context.Context) (Post, error)
+	// List returns a page of posts, newest first.
+	List(ctx context.Context, limit, offset int) ([]Post, error)
+}
+
+// Comment is a comment on a post with its author's nickname.
+type Comment struct {
+	ID        string
+	PostID    string
+	UserID    string
+	Author    string
+	Content   string
+	CreatedAt time.Time
+}
+
+// CommentStore manages comments on posts.
+type CommentStore interface {
+	// Create stores c; its Author and CreatedAt are ignored.
+	Create(ctx context.Context, c Comment) error
+	// ListByPost returns the comments of a post, oldest first.
+	ListByPost(ctx context.Context, postID string) ([]Comment, error)
+}
+
+// PrivateMessage is a message between two users.
+type PrivateMessage struct {
+	ID          string
+	SenderID    string
+	ReceiverID  string
+	Sender      string // sender's nickname
+	Content     string
+	CreatedAt   time.Time
+	IsRead      bool
+	EditedAt    *time.Time
+	IsDeleted   bool
+	ExpiresAt   *time.Time
+	IsEncrypted bool
+}
+
+// NewPrivateMessage is a message to send, with everything that has to be
+// stored together with it.
+type NewPrivateMessage struct {
+	ID         string
+	SenderID   string
+	ReceiverID string
+	Content    string
+	// DisappearingSeconds, when positive, makes the message expire that
+	// long after it is stored.
+	DisappearingSeconds int64
+	// Encrypted messages carry e2ee ciphertext and one key envelope per
+	// device, keyed by key ID. The first one switches the conversation to
+	// encryption for good.
+	Encrypted bool
+	Envelopes map[string]string
+	// AttachmentIDs are the sender's pending uploads to attach.
+	AttachmentIDs []string
+}
+
+// AttachmentInfo describes a file attached to a message.
+type AttachmentInfo struct {
+	ID           string
+	FileName     string
+	ContentType  string
+	Size         int64
+	HasThumbnail bool
+}
+
+// SentPrivateMessage is what storing a NewPrivateMessage produced.
+type SentPrivateMessage struct {
+	Attachments []AttachmentInfo
+	// SwitchedToEncryption is set when this message made the conversation
+	// end-to-end encrypted.
+	SwitchedToEncryption bool
+}
+
+// ConversationSummary is another user as seen in a user's conversation
+// list, with the last private message the two exchanged.
+type ConversationSummary struct {
+	UserStatus
+	// LastMessage is nil when the two never exchanged a message; only its
+	// ID, SenderID, Content, CreatedAt, IsDeleted and IsEncrypted are set.
+	LastMessage *PrivateMessage
+	// UnreadCount counts the other user's messages not read yet.
+	UnreadCount int
+}
+
+// UnreadSender counts the unread private messages from one sender.
+type UnreadSender struct {
+	SenderID      string
+	Nickname      string
+	Count         int
+	LastMessageAt time.Time
+}
+
+// MessageSearch selects the private messages of UserID that contain every
+// term, optionally only those exchanged with WithUserID.
+type MessageSearch struct {
+	UserID     string
+	WithUserID string
+	// Terms are matched against content as stored, so callers escape
+	// them the same way.
+	Terms []string
+	Limit int
+	// Context is how many neighbouring message IDs to return on each side
+	// of a match.
+	Context int
+}
+
+// SearchResult is a message matching a search, newest match first. Only
+// its ID, SenderID, ReceiverID, Sender, Content and CreatedAt are set.
+type SearchResult struct {
+	PrivateMessage
+	// Before and After are the IDs of the neighbouring messages in the
+	// conversation, oldest first.
+	Before []string
+	After  []string
+	// Offset is the number of newer messages in the conversation, the
+	// offset of the page of ListPrivate that starts at the match.
+	Offset int
+}
+
+// ExpiredMessage is a private message past its disappearing timer or its
+// conversation's retention.
+type ExpiredMessage struct {
+	ID         string
+	SenderID   string
+	ReceiverID string
+}
+
+// MessageStore manages private messages.
+type MessageStore interface {
+	// SendPrivate stores a message, its key envelopes and attachments in
+	// one transaction. It fails with ErrAttachmentNotFound if any of the
+	// attachments can't be claimed.
+	SendPrivate(ctx context.Context, m NewPrivateMessage) (SentPrivateMessage, error)
+	// ListPrivate returns a page of the unexpired messages between two
+	// users, counting offset from the newest, in chronological order.
+	ListPrivate(ctx context.Context, userID, otherID string, limit, offset int) ([]PrivateMessage, error)
+	// MarkRead marks one message from senderID to receiverID as read and
+	// reports whether it was unread.
+	MarkRead(ctx context.Context, messageID, senderID, receiverID string) (bool, error)
+	// MarkReadUntil marks every message from senderID to receiverID up to
+	// and including messageID as read, and returns how many were unread.
+	MarkReadUntil(ctx context.Context, messageID, senderID, receiverID string) (int64, error)
+	// Edit replaces the content of a message senderID sent less than
+	// window ago, keeping the previous content in the edit history. It
+	// returns the receiver and whether the content changed. It returns
+	// ErrNotFound if senderID has no such message, ErrNotEditable if it is
+	// encrypted or older than window, and ErrEncryptedConversation once the
+	// conversation has switched to encryption.
+	Edit(ctx context.Context, messageID, senderID, content string, window time.Duration) (receiverID string, changed bool, err error)
+	// Delete turns a message senderID sent into a tombstone, dropping its
+	// edit history, reactions and key envelopes. It returns the receiver,
+	// or ErrNotFound.
+	Delete(ctx context.Context, messageID, senderID string) (receiverID string, err error)
+	// Conversations lists every user but userID with the last unexpired
+	// message the two exchanged, most recent conversation first, then
+	// users without messages by nickname.
+	Conversations(ctx context.Context, userID string) ([]ConversationSummary, error)
+	// UnreadBySender counts userID's unread, unexpired messages per sender,
+	// most recent first.
+	UnreadBySender(ctx context.Context, userID string) ([]UnreadSender, error)
+	// Search returns up to q.Limit unexpired, undeleted plaintext messages
+	// matching q.
+	Search(ctx context.Context, q MessageSearch) ([]SearchResult, error)
+	// ListAfter returns up to limit unexpired messages between two users
+	// that come after cursor, oldest first, and the cursor of the last
+	// one. The first page starts at cursor 0.
+	ListAfter(ctx context.Context, userID, otherID string, cursor int64, limit int) ([]PrivateMessage, int64, error)
+	// Participants returns the two users of an unexpired, undeleted
+	// message userID takes part in, or ErrNotFound.
+	Participants(ctx context.Context, messageID, userID string) (senderID, receiverID string, err error)
+	// Expired returns up to limit messages past their disappearing timer
+	// or the shorter of retention and their conversation's retention; zero
+	// retention is no global limit. With skipDeleted, tombstones are left
+	// out.
+	Expired(ctx context.Context, retention time.Duration, skipDeleted bool, limit int) ([]ExpiredMessage, error)
+	// Expire deletes the given messages, or with redact turns them into
+	// tombstones, together with their edit history, reactions and key
+	// envelopes, in one transaction.
+	Expire(ctx context.Context, ids []string, redact bool) error
+}
+
+// Group is a named conversation with any number of members.
+type Group struct {
+	ID        string
+	Name      string
+	CreatedBy string
+	CreatedAt time.Time
+	// Members are ordered by when they joined.
+	Members []models.User
+	// UnreadCount counts the messages of others the viewer hasn't read.
+	UnreadCount   int
+	LastMessageAt *time.Time
+}
+
+// GroupMessage is a message sent to a group conversation.
+type GroupMessage struct {
+	ID             string
+	ConversationID string
+	SenderID       string
+	Sender         string // sender's nickname
+	Content        string
+	CreatedAt      time.Time
+	// Seq orders the messages of a conversation and is what read
+	// positions are compared to.
+	Seq int64
+}
+
+// UnreadGroup counts the unread messages of one group conversation.
+type UnreadGroup struct {
+	ConversationID string
+	Name           string
+	Count          int
+}
+
+// GroupStore manages group conversations, their members and messages.
+type GroupStore interface {
+	// Create stores a group created by createdBy with the given members,
+	// who must exist.
+	Create(ctx context.Context, id, name, createdBy string, memberIDs []string) error
+	// Get returns a group as seen by viewerID, or ErrNotFound.
+	Get(ctx context.Context, id, viewerID string) (Group, error)
+	// List returns the groups userID belongs to as seen by userID, most
+	// recently active first.
+	List(ctx context.Context, userID string) ([]Group, error)
+	// Rename changes a group's name.
+	Rename(ctx context.Context, id, name string) error
+	// IsMember reports whether userID belongs to the group.
+	IsMember(ctx context.Context, id, userID string) (bool, error)
+	// MemberIDs returns the user IDs of every member.
+	MemberIDs(ctx context.Context, id string) ([]string, error)
+	// AddMember adds userID to the group; adding a member again does nothing.
+	AddMember(ctx context.Context, id, userID string) error
+	// RemoveMember removes userID from the group, and deletes the group
+	// once its last member is gone.
+	RemoveMember(ctx context.Context, id, userID string) error
+	// ReadPositions returns the Seq of the last message each member read.
+	ReadPositions(ctx context.Context, id string) (map[string]int64, error)
+	// Messages returns a page of a group's messages, counting offset from
+	// the newest, in chronological order.
+	Messages(ctx context.Context, id string, limit, offset int) ([]GroupMessage, error)
+	// Send stores a message; its Sender, CreatedAt and Seq are ignored.
+	Send(ctx context.Context, m GroupMessage) error
+	// MarkRead moves userID's read position up to messageID and reports
+	// whether it moved.
+	MarkRead(ctx context.Context, id, userID, messageID string) (bool, error)
+	// Unread counts userID's unread messages per group, most recent first.
+	Unread(ctx context.Context, userID string) ([]UnreadGroup, error)
+}
+
+// ConversationSettings are the settings of a private conversation.
+type ConversationSettings struct {
+	RetentionSeconds    int64
+	DisappearingSeconds int64
+	// Encrypted is set by the first end-to-end encrypted message.
+	Encrypted bool
+	UpdatedBy string
+}
+
+// SettingsStore manages the settings of private conversations. The two
+// users can be given in either order.
+type SettingsStore interface {
+	// Get returns the settings of the conversation between the two users,
+	// or zero settings if none were ever set.
+	Get(ctx context.Context, userID, otherID string) (ConversationSettings, error)
+	// SetDisappearing sets the disappearing timer, recording userID as
+	// the one who changed it.
+	SetDisappearing(ctx context.Context, userID, otherID string, seconds int64) error
+	// SetRetention sets the conversation retention, recording userID as
+	// the one who changed it.
+	SetRetention(ctx context.Context, userID, otherID string, seconds int64) error
+	// EncryptedPeers returns the users userID shares an end-to-end
+	// encrypted conversation with.
+	EncryptedPeers(ctx context.Context, userID string) ([]string, error)
+}
+
+// Kinds of relation one user can set on another.
+const (
+	// RelationBlock stops all direct contact in both directions.
+	RelationBlock = "block"
+	// RelationMute only collapses the muted user's posts and comments.
+	RelationMute = "mute"
+)
+
+// Relation is a block or mute set on User.
+type Relation struct {
+	Kind string
+	User models.User
+}
+
+// RelationStore manages blocks and mutes.
+type RelationStore interface {
+	// Blocked reports whether either user has blocked the other.
+	Blocked(ctx context.Context, userA, userB string) (bool, error)
+	// BlockedIDs returns every user userID has blocked or been blocked by.
+	BlockedIDs(ctx context.Context, userID string) (map[string]bool, error)
+	// TargetIDs returns every user userID has blocked or muted.
+	TargetIDs(ctx context.Context, userID string) (map[string]bool, error)
+	// Set adds or, without active, removes a relation of the given kind
+	// from userID to targetID. Adding one that exists does nothing.
+	Set(ctx context.Context, userID, targetID, kind string, active bool) error
+	// List returns the relations userID has set, newest first.
+	List(ctx context.Context, userID string) ([]Relation, error)
+}
+
+// DeviceKey is a public key published by one device of a user.
+type DeviceKey struct {
+	ID        string
+	UserID    string
+	DeviceID  string
+	PublicKey string
+	CreatedAt time.Time
+}
+
+// KeyStore manages device keys and the key envelopes of encrypted messages.
+type KeyStore interface {
+	// Active returns the keys of userID that have not been revoked,
+	// oldest first.
+	Active(ctx context.Context, userID string) ([]DeviceKey, error)
+	// Publish stores k, revoking the key its device had before, and
+	// returns it with CreatedAt set.
+	Publish(ctx context.Context, k DeviceKey) (DeviceKey, error)
+	// Revoke revokes one of userID's active keys, or returns ErrNotFound.
+	Revoke(ctx context.Context, keyID, userID string) error
+	// Envelopes returns, for each of the given messages, the envelopes
+	// addressed to userID's devices keyed by key ID, revoked keys included.
+	Envelopes(ctx context.Context, messageIDs []string, userID string) (map[string]map[string]string, error)
+}
+
+// NewAttachment is an uploaded file whose contents are already stored.
+type NewAttachment struct {
+	ID          string
+	UploaderID  string
+	FileName    string
+	ContentType string
+	Size        int64
+	StorageKey  string
+	// ThumbnailKey is empty for files without a thumbnail.
+	ThumbnailKey string
+}
+
+// StoredAttachment locates the contents of an attachment.
+type StoredAttachment struct {
+	FileName     string
+	ContentType  string
+	StorageKey   string
+	ThumbnailKey string // empty without a thumbnail
+	CreatedAt    time.Time
+}
+
+// AttachmentStore manages the records of uploaded files.
+type AttachmentStore interface {
+	// Create records an upload, not yet attached to a message.
+	Create(ctx context.Context, a NewAttachment) error
+	// Get returns an attachment userID may fetch: one they uploaded, or
+	// one of an unexpired message they take part in. Anything else is
+	// ErrNotFound.
+	Get(ctx context.Context, id, userID string) (StoredAttachment, error)
+	// ForMessages returns the attachments of the given messages keyed by
+	// message ID, oldest first.
+	ForMessages(ctx context.Context, messageIDs []string) (map[string][]AttachmentInfo, error)
+	// DeleteForMessage removes the records of a message's attachments and
+	// returns the storage keys of their files and thumbnails.
+	DeleteForMessage(ctx context.Context, messageID string) ([]string, error)
+	// DeletePending removes up to limit uploads that were never attached
+	// to a message and are older than olderThan. It returns how many it
+	// removed and the storage keys of their files and thumbnails.
+	DeletePending(ctx context.Context, olderThan time.Duration, limit int) (n int, keys []string, err error)
+}
+
+// Reaction is one emoji on a message and the users who reacted with it,
+// in the order they did.
+type Reaction struct {
+	Emoji   string
+	UserIDs []string
+}
+
+// ReactionStore manages emoji reactions on private messages.
+type ReactionStore interface {
+	// ForMessages returns the reactions of the given messages keyed by
+	// message ID, each emoji in the order it was first used.
+	ForMessages(ctx context.Context, messageIDs []string) (map[string][]Reaction, error)
+	// Emoji returns the emoji userID put on a message.
+	Emoji(ctx context.Context, messageID, userID string) ([]string, error)
+	// Add puts userID's emoji on a message; adding it again does nothing.
+	Add(ctx context.Context, messageID, userID, emoji string) error
+	// Remove takes userID's emoji off a message.
+	Remove(ctx context.Context, messageID, userID, emoji string) error
+}
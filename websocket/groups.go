@@ -0,0 +1,87 @@
+package websocket
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"jj/api"
+	"jj/logging"
+	"jj/models"
+	"jj/store"
+
+	"github.com/google/uuid"
+)
+
+// HandleGroupMessage stores a message sent to a group conversation and
+// delivers it to every connection of every member.
+func HandleGroupMessage(ctx context.Context, client *models.Client, sender models.User, conversationID, content, clientMessageID string) error {
+	if len(content) > conf.Limits.MessageMax || strings.TrimSpace(content) == "" {
+		return protocolError(CodeValidationFailed, "try  a better message")
+	}
+	ok, err := api.IsConversationMember(ctx, conversationID, sender.ID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to check membership", "conversation_id", conversationID, "error", err)
+		return errInternal
+	}
+	if !ok {
+		return protocolError(CodeNotFound, "conversation not found")
+	}
+
+	messageID := uuid.New().String()
+	Contentformessage := models.Skip(content)
+	err = Stores.Groups.Send(ctx, store.GroupMessage{
+		ID:             messageID,
+		ConversationID: conversationID,
+		SenderID:       sender.ID,
+		Content:        Contentformessage,
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to save group message", "conversation_id", conversationID, "error", err)
+		return errInternal
+	}
+	messagesSent.Inc("group")
+
+	memberIDs, err := api.ConversationMemberIDs(ctx, conversationID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load conversation members", "conversation_id", conversationID, "error", err)
+		return errInternal
+	}
+
+	sendToUsers(newEvent("group_message", map[string]interface{}{
+		"messageId":       messageID,
+		"clientMessageId": clientMessageID,
+		"conversationId":  conversationID,
+		"senderId":        sender.ID,
+		"senderName":      sender.Nickname,
+		"content":         Contentformessage,
+		"timestamp":       time.Now().Format(time.RFC3339),
+	}), memberIDs...)
+	return nil
+}
+
+// HandleMarkGroupRead advances the reader's read position in a group
+// conversation up to messageID and tells the other members.
+func HandleMarkGroupRead(ctx context.Context, readerID, conversationID, messageID string) error {
+	moved, err := Stores.Groups.MarkRead(ctx, conversationID, readerID, messageID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to mark group message read", "conversation_id", conversationID, "message_id", messageID, "error", err)
+		return errInternal
+	}
+	if !moved {
+		return nil
+	}
+
+	memberIDs, err := api.ConversationMemberIDs(ctx, conversationID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load conversation members", "conversation_id", conversationID, "error", err)
+		return errInternal
+	}
+
+	sendToUsers(newEvent("group_read", map[string]interface{}{
+		"conversationId": conversationID,
+		"messageId":      messageID,
+		"readerId":       readerID,
+	}), memberIDs...)
+	return nil
+}
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+
+	"jj/api"
+	"jj/models"
+)
+
+// requestHandler serves one request type. A returned *ProtocolError is sent
+// to the client as is; any other error is reported as CodeInternal.
+type requestHandler func(ctx context.Context, client *models.Client, user models.User, req Envelope) error
+
+// requestHandlers maps request types to their handlers.
+var requestHandlers = map[string]requestHandler{
+	"private_message": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			ReceiverID    string            `json:"receiverId"`
+			Content       string            `json:"content"`
+			MessageID     string            `json:"messageId"`
+			AttachmentIDs []string          `json:"attachmentIds"`
+			Encrypted     bool              `json:"encrypted"`
+			Envelopes     map[string]string `json:"envelopes"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandlePrivateMessage(ctx, client, user.ID, p.ReceiverID, p.Content, p.MessageID, p.AttachmentIDs, p.Encrypted, p.Envelopes)
+	},
+	"mark_read": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			SenderID  string `json:"senderId"`
+			MessageID string `json:"messageId"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleMarkRead(ctx, user.ID, p.SenderID, p.MessageID)
+	},
+	"mark_read_until": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			SenderID  string `json:"senderId"`
+			MessageID string `json:"messageId"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleMarkReadUntil(ctx, user.ID, p.SenderID, p.MessageID)
+	},
+	"typing": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			ReceiverID string `json:"receiverId"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleTyping(ctx, client, user.ID, user.Nickname, p.ReceiverID)
+	},
+	"stop_typing": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			ReceiverID string `json:"receiverId"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleStopTyping(ctx, client, user.ID, user.Nickname, p.ReceiverID)
+	},
+	"edit_message": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			MessageID string `json:"messageId"`
+			Content   string `json:"content"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleEditMessage(ctx, client, user.ID, p.MessageID, p.Content)
+	},
+	"delete_message": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			MessageID string `json:"messageId"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleDeleteMessage(ctx, client, user.ID, p.MessageID)
+	},
+	"set_disappearing_timer": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			ReceiverID string `json:"receiverId"`
+			Seconds    int64  `json:"seconds"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleSetDisappearingTimer(ctx, user.ID, p.ReceiverID, p.Seconds)
+	},
+	"react_message":   handleReactionRequest,
+	"unreact_message": handleReactionRequest,
+	"group_message": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			ConversationID string `json:"conversationId"`
+			Content        string `json:"content"`
+			MessageID      string `json:"messageId"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleGroupMessage(ctx, client, user, p.ConversationID, p.Content, p.MessageID)
+	},
+	"mark_group_read": func(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+		var p struct {
+			ConversationID string `json:"conversationId"`
+			MessageID      string `json:"messageId"`
+		}
+		if err := decodePayload(req, &p); err != nil {
+			return err
+		}
+		return HandleMarkGroupRead(ctx, user.ID, p.ConversationID, p.MessageID)
+	},
+}
+
+// handleReactionRequest serves both react_message and unreact_message.
+func handleReactionRequest(ctx context.Context, client *models.Client, user models.User, req Envelope) error {
+	var p struct {
+		MessageID string `json:"messageId"`
+		Emoji     string `json:"emoji"`
+	}
+	if err := decodePayload(req, &p); err != nil {
+		return err
+	}
+	return HandleReaction(ctx, client, user.ID, p.MessageID, p.Emoji, req.Type == "react_message")
+}
+
+// handleRequest checks a request against the connection's version, rate
+// limit and session, then runs the handler for its type.
+func handleRequest(ctx context.Context, client *models.Client, user models.User, limiter *rateLimiter, req Envelope) error {
+	if client.Version >= ProtocolV2 && req.V != client.Version {
+		return protocolError(CodeUnsupportedVersion, fmt.Sprintf("this connection speaks version %d", client.Version))
+	}
+	if !limiter.Allow() {
+		api.RateLimitRejections.Inc("websocket", "/ws")
+		return protocolError(CodeRateLimited, "too many requests, slow down")
+	}
+	if !sessionValid(ctx, client) {
+		return protocolError(CodeUnauthorized, "your session has ended, log in again")
+	}
+	handler, ok := requestHandlers[req.Type]
+	if !ok {
+		return protocolError(CodeUnknownType, "unknown message type "+req.Type)
+	}
+	return handler(ctx, client, user, req)
+}
+
+// sessionValid reports whether the session the connection was opened with
+// is still the user's current one.
+func sessionValid(ctx context.Context, client *models.Client) bool {
+	userID, err := Stores.Sessions.UserID(ctx, client.Token)
+	return err == nil && userID == client.UserID
+}
@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"jj/api"
+	"jj/logging"
+	"jj/models"
+	"jj/store"
+)
+
+// messageEditWindow is how long after sending a message its sender may still edit it.
+const messageEditWindow = 15 * time.Minute
+
+// HandleEditMessage replaces the content of a private message sent by senderID,
+// keeping the previous content in private_message_edits, and pushes the new
+// version to both participants.
+func HandleEditMessage(ctx context.Context, client *models.Client, senderID, messageID, content string) error {
+	if len(content) > conf.Limits.MessageMax || strings.TrimSpace(content) == "" {
+		return protocolError(CodeValidationFailed, "try  a better message")
+	}
+	Contentformessage := models.Skip(content)
+
+	receiverID, changed, err := Stores.Messages.Edit(ctx, messageID, senderID, Contentformessage, messageEditWindow)
+	if err == store.ErrNotFound {
+		return protocolError(CodeNotFound, "message not found")
+	} else if err == store.ErrNotEditable {
+		return protocolError(CodeForbidden, "this message can no longer be edited")
+	} else if err == store.ErrEncryptedConversation {
+		return protocolError(CodeForbidden, api.ErrEncryptedConversation.Error())
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Failed to edit message", "message_id", messageID, "error", err)
+		return errInternal
+	}
+	if !changed {
+		return nil
+	}
+
+	sendToUsers(newEvent("message_edited", map[string]interface{}{
+		"messageId":  messageID,
+		"senderId":   senderID,
+		"receiverId": receiverID,
+		"content":    Contentformessage,
+		"editedAt":   time.Now().Format(time.RFC3339),
+	}), senderID, receiverID)
+	return nil
+}
+
+// HandleDeleteMessage turns a private message sent by senderID into a
+// tombstone and tells both participants. Its content, edit history,
+// reactions, key envelopes and attachments are dropped.
+func HandleDeleteMessage(ctx context.Context, client *models.Client, senderID, messageID string) error {
+	receiverID, err := Stores.Messages.Delete(ctx, messageID, senderID)
+	if err == store.ErrNotFound {
+		return protocolError(CodeNotFound, "message not found")
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Failed to delete message", "message_id", messageID, "error", err)
+		return errInternal
+	}
+	if err := api.DeleteMessageAttachments(ctx, messageID); err != nil {
+		logging.FromContext(ctx).Error("Failed to delete message attachments", "message_id", messageID, "error", err)
+	}
+
+	sendToUsers(newEvent("message_deleted", map[string]interface{}{
+		"messageId":  messageID,
+		"senderId":   senderID,
+		"receiverId": receiverID,
+	}), senderID, receiverID)
+	return nil
+}
+
+// HandleSetDisappearingTimer sets the disappearing timer of the conversation
+// between userID and receiverID and announces it to both participants.
+func HandleSetDisappearingTimer(ctx context.Context, userID, receiverID string, seconds int64) error {
+	if receiverID == "" || receiverID == userID {
+		return protocolError(CodeValidationFailed, "invalid user ID")
+	}
+	if !api.ValidDisappearingTimer(seconds) {
+		return protocolError(CodeValidationFailed, "the timer must be off or between one minute and one week")
+	}
+	blocked, err := api.IsBlocked(ctx, userID, receiverID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to check block", "receiver_id", receiverID, "error", err)
+		return errInternal
+	}
+	if blocked {
+		return protocolError(CodeForbidden, "you can't change this conversation")
+	}
+
+	if _, err := Stores.Users.ByID(ctx, receiverID); err == store.ErrNotFound {
+		return protocolError(CodeNotFound, "user not found")
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Failed to look up user", "receiver_id", receiverID, "error", err)
+		return errInternal
+	}
+
+	settings, err := api.SetDisappearingTimer(ctx, userID, receiverID, seconds)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to set disappearing timer", "receiver_id", receiverID, "error", err)
+		return errInternal
+	}
+	api.NotifyConversationSettings(userID, receiverID, settings)
+	return nil
+}
@@ -0,0 +1,28 @@
+package websocket
+
+import (
+	"math"
+
+	"jj/metrics"
+)
+
+var (
+	openConnections = metrics.NewGauge("forum_websocket_connections",
+		"Open websocket connections on this instance.")
+	messagesSent = metrics.NewCounter("forum_messages_sent_total",
+		"Chat messages stored, by kind (private or group).", "kind")
+	fanoutDuration = metrics.NewHistogram("forum_broadcast_fanout_duration_seconds",
+		"Time to write a published event to the matching connections of this instance.",
+		[]float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+)
+
+func init() {
+	// Counted across instances when the presence registry is shared
+	metrics.NewGaugeFunc("forum_online_users", "Users with at least one open websocket connection.", func() float64 {
+		ids, err := OnlinePresence.Online()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(len(ids))
+	})
+}
@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"context"
+	"log/slog"
+
+	"jj/broker"
+	"jj/logging"
+	"jj/models"
+)
+
+// Broker carries realtime events to the connections of every server
+// instance, and OnlinePresence counts connections across them. Both are
+// process-local until main calls UseBroker.
+var (
+	Broker         broker.Broker   = broker.NewLocal()
+	OnlinePresence broker.Presence = broker.NewLocalPresence()
+)
+
+func init() {
+	Broker.Subscribe(deliver)
+}
+
+// UseBroker switches the hub to b and p, unsubscribing from the previous
+// broker. It must be called before the server accepts connections.
+func UseBroker(b broker.Broker, p broker.Presence) {
+	Broker.Subscribe(nil)
+	Broker = b
+	OnlinePresence = p
+	Broker.Subscribe(deliver)
+
+	// Presence shared with other instances can lose users when one of them dies
+	if stale, ok := p.(interface{ OnStaleOffline(func(userID string)) }); ok {
+		stale.OnStaleOffline(staleUserOffline)
+	}
+}
+
+// ReconcilePresence brings the persisted is_online flags in line with
+// OnlinePresence at startup. Flags left behind by a crash or an unclean
+// shutdown are cleared; users connected to other instances stay online.
+func ReconcilePresence(ctx context.Context) error {
+	online, err := OnlinePresence.Online()
+	if err != nil {
+		return err
+	}
+
+	n, err := Stores.Users.ResetOnline(ctx, online)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logging.FromContext(ctx).Info("Reset stale online status", "users", n)
+	}
+	return nil
+}
+
+// userConnected persists and announces the user's offline -> online transition.
+func userConnected(ctx context.Context, user models.User) {
+	if err := Stores.Users.SetOnline(ctx, user.ID, true); err != nil {
+		logging.FromContext(ctx).Error("Failed to set user online", "error", err)
+	}
+	BroadcastPresence(ctx, "user_online", user)
+}
+
+// userDisconnected persists and announces the user's online -> offline transition.
+func userDisconnected(ctx context.Context, user models.User) {
+	if err := Stores.Users.SetOnline(ctx, user.ID, false); err != nil {
+		logging.FromContext(ctx).Error("Failed to set user offline", "error", err)
+	}
+	BroadcastPresence(ctx, "user_offline", user)
+}
+
+// staleUserOffline announces a user whose only connections were held by an
+// instance that died.
+func staleUserOffline(userID string) {
+	ctx, cancel := frameContext(logging.WithLogger(context.Background(), slog.With("user_id", userID)))
+	defer cancel()
+	user, err := Stores.Users.ByID(ctx, userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load user", "error", err)
+		return
+	}
+	userDisconnected(ctx, user)
+}
@@ -0,0 +1,214 @@
+package websocket
+
+// The websocket protocol.
+//
+// Every frame, in both directions, is a JSON envelope:
+//
+//	{"v": 2, "type": "private_message", "id": "c-17", "payload": {...}}
+//
+// v is the protocol version, type selects the handler or names the event,
+// id is an optional client-chosen request id and payload is type specific.
+//
+// The version is negotiated with the Sec-WebSocket-Protocol header: a
+// client offers "forum.v2" and/or "forum.v1" and the server picks the
+// newest one it supports. A client that offers none speaks version 1. The
+// first frame the server sends on every connection is a "hello" event
+// carrying the negotiated version.
+//
+// For version 2, every request that carries an id is answered with either
+//
+//	{"v": 2, "type": "ack", "id": "c-17", "payload": {"type": "private_message"}}
+//
+// or
+//
+//	{"v": 2, "type": "error", "id": "c-17", "payload": {"type": "private_message", "code": "validation_failed", "message": "..."}}
+//
+// Errors are sent for requests without an id as well; acks are not.
+// Version 1 clients get no acks and receive errors as the legacy
+// {"type": "eroor", "payload": {"eroor": "..."}} frame.
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"jj/models"
+)
+
+// Protocol versions understood by the server.
+const (
+	ProtocolV1      = 1
+	ProtocolV2      = 2
+	CurrentProtocol = ProtocolV2
+)
+
+// subprotocols maps Sec-WebSocket-Protocol names to protocol versions,
+// newest first, which is also the server's order of preference.
+var subprotocols = []struct {
+	Name    string
+	Version int
+}{
+	{"forum.v2", ProtocolV2},
+	{"forum.v1", ProtocolV1},
+}
+
+// Machine-readable codes carried by "error" events.
+const (
+	CodeBadPayload         = "bad_payload"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeRateLimited        = "rate_limited"
+	CodeUnknownType        = "unknown_type"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeKeysChanged        = "keys_changed" // an encrypted message missed or had extra device keys
+	CodeInternal           = "internal"
+)
+
+// Per-connection request rate: a burst of rateBurst requests, refilled at
+// rateRefill requests per second.
+const (
+	rateBurst  = 30
+	rateRefill = 10
+)
+
+// Envelope is an inbound frame.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Event is an outbound frame. Version 1 clients ignore V and ID.
+type Event struct {
+	V       int         `json:"v"`
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// newEvent builds a server event of the current protocol version.
+func newEvent(eventType string, payload interface{}) Event {
+	return Event{V: CurrentProtocol, Type: eventType, Payload: payload}
+}
+
+// ProtocolError is a request failure reported back to the client that sent it.
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// protocolError creates a ProtocolError with the given code.
+func protocolError(code, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// errInternal is returned by handlers after they logged a server-side failure.
+var errInternal = protocolError(CodeInternal, "something went wrong, try again")
+
+// negotiateVersion returns the protocol version for the subprotocol the
+// upgrader selected, or ProtocolV1 when the client offered none.
+func negotiateVersion(subprotocol string) int {
+	for _, p := range subprotocols {
+		if p.Name == subprotocol {
+			return p.Version
+		}
+	}
+	return ProtocolV1
+}
+
+// subprotocolNames lists the supported subprotocols in order of preference.
+func subprotocolNames() []string {
+	names := make([]string, len(subprotocols))
+	for i, p := range subprotocols {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// sendHello tells a freshly connected client which protocol version it speaks.
+func sendHello(client *models.Client) {
+	versions := make([]int, len(subprotocols))
+	for i, p := range subprotocols {
+		versions[i] = p.Version
+	}
+	sendToClient(client, newEvent("hello", map[string]interface{}{
+		"version":           client.Version,
+		"supportedVersions": versions,
+		"userId":            client.UserID,
+	}))
+}
+
+// sendAck confirms a request that carried an id. Version 1 clients get no acks.
+func sendAck(client *models.Client, req Envelope) {
+	if client.Version < ProtocolV2 || req.ID == "" {
+		return
+	}
+	event := newEvent("ack", map[string]interface{}{"type": req.Type})
+	event.ID = req.ID
+	sendToClient(client, event)
+}
+
+// sendRequestError reports a failed request back to the client that sent it.
+func sendRequestError(client *models.Client, req Envelope, err error) {
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		perr = errInternal
+	}
+	if client.Version < ProtocolV2 {
+		sendToClient(client, map[string]interface{}{
+			"type": "eroor",
+			"payload": map[string]interface{}{
+				"eroor": perr.Message,
+			},
+		})
+		return
+	}
+	event := newEvent("error", map[string]interface{}{
+		"type":    req.Type,
+		"code":    perr.Code,
+		"message": perr.Message,
+	})
+	event.ID = req.ID
+	sendToClient(client, event)
+}
+
+// decodePayload unmarshals a request payload, turning failures into bad_payload errors.
+func decodePayload(req Envelope, v interface{}) error {
+	if err := json.Unmarshal(req.Payload, v); err != nil {
+		return protocolError(CodeBadPayload, "invalid "+req.Type+" payload")
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket limiting the requests of one connection.
+// It is only used by that connection's read loop.
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{tokens: rateBurst, last: time.Now()}
+}
+
+// Allow takes a token if one is available.
+func (l *rateLimiter) Allow() bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * rateRefill
+	if l.tokens > rateBurst {
+		l.tokens = rateBurst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"context"
+
+	"jj/api"
+	"jj/logging"
+	"jj/models"
+	"jj/store"
+)
+
+// HandleReaction adds or removes userID's emoji reaction on a private
+// message they take part in, then sends the message's updated reactions
+// to both participants.
+func HandleReaction(ctx context.Context, client *models.Client, userID, messageID, emoji string, add bool) error {
+	if !api.ValidReaction(emoji) {
+		return protocolError(CodeValidationFailed, "invalid reaction")
+	}
+
+	senderID, receiverID, err := Stores.Messages.Participants(ctx, messageID, userID)
+	if err == store.ErrNotFound {
+		return protocolError(CodeNotFound, "message not found")
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Failed to load message for reaction", "message_id", messageID, "error", err)
+		return errInternal
+	}
+	blocked, err := api.IsBlocked(ctx, senderID, receiverID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to check block", "message_id", messageID, "error", err)
+		return errInternal
+	}
+	if blocked {
+		return protocolError(CodeForbidden, "you can't react to this message")
+	}
+
+	action := "remove"
+	if add {
+		action = "add"
+		limited, err := api.ReactionLimitReached(ctx, messageID, userID, emoji)
+		if err != nil {
+			logging.FromContext(ctx).Error("Failed to count reactions", "message_id", messageID, "error", err)
+			return errInternal
+		}
+		if limited {
+			return protocolError(CodeValidationFailed, "too many reactions")
+		}
+		if err := Stores.Reactions.Add(ctx, messageID, userID, emoji); err != nil {
+			logging.FromContext(ctx).Error("Failed to add reaction", "message_id", messageID, "error", err)
+			return errInternal
+		}
+	} else {
+		if err := Stores.Reactions.Remove(ctx, messageID, userID, emoji); err != nil {
+			logging.FromContext(ctx).Error("Failed to remove reaction", "message_id", messageID, "error", err)
+			return errInternal
+		}
+	}
+
+	reactions, err := api.LoadMessageReactions(ctx, []string{messageID})
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load reactions", "message_id", messageID, "error", err)
+		return errInternal
+	}
+
+	sendToUsers(newEvent("message_reaction", map[string]interface{}{
+		"messageId": messageID,
+		"userId":    userID,
+		"emoji":     emoji,
+		"action":    action,
+		"reactions": reactions[messageID],
+	}), senderID, receiverID)
+	return nil
+}
@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"jj/api"
+
+	"github.com/gorilla/websocket"
+)
+
+// restartRetryAfter is the reconnect hint given to clients when the server
+// shuts down. Clients wait between once and twice as long, so they don't
+// all reconnect at the same moment.
+const restartRetryAfter = 2 * time.Second
+
+// closeWriteTimeout bounds writing the close frame to one connection.
+const closeWriteTimeout = time.Second
+
+// draining is set once Shutdown starts; new upgrades are refused from then on.
+var draining atomic.Bool
+
+// refuseDraining answers an upgrade request with 503 while the hub drains,
+// reporting whether it did.
+func refuseDraining(w http.ResponseWriter) bool {
+	if !draining.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(restartRetryAfter/time.Second)))
+	w.Header().Set("Connection", "close")
+	api.RespondWithError(w, http.StatusServiceUnavailable, "Server restarting")
+	return true
+}
+
+// Shutdown drains the hub. New upgrades are refused, and every connection
+// gets a close frame with code 1012 (service restart) whose reason says
+// when to reconnect. Connections are taken out of Clients first, so
+// nothing is written after their close frame. Shutdown then waits until
+// the clients have closed and their users have been marked offline, or
+// until ctx ends; main then closes whatever is left through the base
+// context, which still marks those users offline.
+func Shutdown(ctx context.Context) error {
+	draining.Store(true)
+	reason := websocket.FormatCloseMessage(websocket.CloseServiceRestart,
+		fmt.Sprintf("server restarting, retry after %ds", int(restartRetryAfter/time.Second)))
+
+	// Writes go out under ClientsMutex, so holding it means the writes in
+	// flight have been flushed. A stuck write holds it until ctx ends.
+	locked := make(chan struct{})
+	go func() {
+		ClientsMutex.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			ClientsMutex.Unlock()
+		}()
+		return ctx.Err()
+	}
+
+	deadline := time.Now().Add(closeWriteTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	for c := range Clients {
+		delete(Clients, c)
+		if err := c.Conn.WriteControl(websocket.CloseMessage, reason, deadline); err != nil {
+			slog.Warn("Failed to send close frame", "conn_id", c.ID, "user_id", c.UserID, "error", err)
+			c.Conn.Close()
+		}
+	}
+	ClientsMutex.Unlock()
+
+	return Wait(ctx)
+}
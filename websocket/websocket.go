@@ -1,16 +1,21 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"jj/api"
-	"jj/database"
+	"jj/broker"
+	"jj/config"
+	"jj/e2ee"
+	"jj/logging"
 	"jj/models"
+	"jj/store"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -21,11 +26,55 @@ var (
 	Clients      = make(map[*models.Client]bool) // Use models.Client
 	ClientsMutex sync.Mutex
 	Upgrader     = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin:  func(r *http.Request) bool { return true },
+		Subprotocols: subprotocolNames(),
 	}
 )
 
-// WsHandler manages WebSocket connections.
+// conf holds the message limits and feature toggles; main replaces the
+// defaults with Configure before the server starts.
+var conf = config.Default()
+
+// Configure sets the configuration used for websocket messages.
+func Configure(c *config.Config) {
+	conf = c
+}
+
+// Stores holds the users and private messages the hub reads and writes.
+// main sets it at startup, together with api.Stores.
+var Stores store.Store
+
+// connections counts the read loops still running, so shutdown can wait
+// for them before closing the database.
+var connections sync.WaitGroup
+
+// Wait blocks until the read loop of every connection has finished, or
+// until ctx ends. Connections end when their request context is
+// cancelled, which main does on shutdown through the server's base context.
+func Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// frameContext bounds the work done for one frame, or for setting up or
+// tearing down a connection, by the configured request timeout.
+func frameContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d := conf.Timeouts.Request.D(); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// WsHandler manages WebSocket connections. See protocol.go for the frame format.
 func WsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Upgrade") != "websocket" {
 		http.Redirect(w, r, "/", http.StatusSeeOther) // 303
@@ -35,80 +84,65 @@ func WsHandler(w http.ResponseWriter, r *http.Request) {
 		api.RespondWithError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
 		return
 	}
-
-	conn, err := Upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket upgrade error:", err)
+	if refuseDraining(w) {
 		return
 	}
 
-	// Authentication
+	// Authenticate before upgrading, while failures can still be HTTP responses
 	ids, err := authenticateUser(r)
 	if err != nil {
 		api.RespondWithError(w, http.StatusUnauthorized, "Authentication required")
 		return
 	}
-
-	var user models.User
-	err = database.DB.QueryRow("SELECT id, nickname FROM users WHERE id = ?", ids).Scan(&user.ID, &user.Nickname)
+	user, err := Stores.Users.ByID(r.Context(), ids)
 	if err != nil {
 		api.RespondWithError(w, http.StatusUnauthorized, "Authentication required")
-		conn.Close()
 		return
 	}
+	cookie, _ := r.Cookie("session_id")
 
-	client := &models.Client{Conn: conn, UserID: user.ID}
-
-	// Add client
-	ClientsMutex.Lock()
-	Clients[client] = true
-	ClientsMutex.Unlock()
-
-	// Update online status for all users
-	allUsers := []string{}
-	rows, err := database.DB.Query("SELECT id FROM users")
+	conn, err := Upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Failed to get users:", err)
+		logging.FromContext(r.Context()).Warn("WebSocket upgrade failed", "error", err)
 		return
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var userID string
-		if err := rows.Scan(&userID); err != nil {
-			log.Println("Failed to scan user ID:", err)
-			continue
-		}
-		allUsers = append(allUsers, userID)
-	}
+	connections.Add(1)
+	defer connections.Done()
+	openConnections.Inc()
+	defer openConnections.Dec()
 
-	for _, r := range allUsers {
-		kk := false
-		ClientsMutex.Lock()
-		for clien := range Clients {
-			if clien.UserID == r {
-				kk = true
-				_, err := database.DB.Exec("UPDATE users SET is_online = TRUE WHERE id = ?", r)
-				if err != nil {
-					log.Printf("Failed to set user %s online: %v", r, err)
-				}
-				break
-			}
-		}
-		ClientsMutex.Unlock()
-		if !kk {
-			_, err := database.DB.Exec("UPDATE users SET is_online = FALSE WHERE id = ?", r)
-			if err != nil {
-				log.Printf("Failed to set user %s offline: %v", r, err)
-			}
-		}
+	// The connection lives until its request context is cancelled;
+	// closing the socket then ends the read loop below
+	connID := uuid.New().String()
+	ctx := logging.WithLogger(r.Context(), logging.FromContext(r.Context()).With("conn_id", connID))
+	stopClosing := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClosing()
+
+	client := &models.Client{
+		ID:      connID,
+		Conn:    conn,
+		UserID:  user.ID,
+		Token:   cookie.Value,
+		Version: negotiateVersion(conn.Subprotocol()),
 	}
 
-	// Update status
-	_, err = database.DB.Exec("UPDATE users SET is_online = TRUE WHERE id = ?", user.ID)
-	if err != nil {
-		log.Printf("Failed to set user %s online: %v", user.ID, err)
+	// Add client
+	ClientsMutex.Lock()
+	Clients[client] = true
+	ClientsMutex.Unlock()
+
+	logger := logging.FromContext(ctx)
+	logger.Info("WebSocket connected", "protocol_version", client.Version)
+	sendHello(client)
+	setup, cancel := frameContext(ctx)
+	if first, err := OnlinePresence.Connect(user.ID); err != nil {
+		logger.Error("Failed to register connection", "error", err)
+	} else if first {
+		userConnected(setup, user)
 	}
-	BroadcastOnlineUsers()
+	SendOnlineUsers(setup, client)
+	SendUnreadSummary(setup, client)
+	cancel()
 
 	defer func() {
 		ClientsMutex.Lock()
@@ -116,366 +150,389 @@ func WsHandler(w http.ResponseWriter, r *http.Request) {
 		ClientsMutex.Unlock()
 		conn.Close()
 
-		_, err := database.DB.Exec("UPDATE users SET is_online = FALSE WHERE id = ?", user.ID)
-		if err != nil {
-			log.Printf("Failed to set user %s offline: %v", user.ID, err)
-		}
-		for _, r := range allUsers {
-			kk := false
-			ClientsMutex.Lock()
-			for clien := range Clients {
-				if clien.UserID == r {
-					kk = true
-					_, err := database.DB.Exec("UPDATE users SET is_online = TRUE WHERE id = ?", r)
-					if err != nil {
-						log.Printf("Failed to set user %s online: %v", r, err)
-					}
-					break
-				}
-			}
-			ClientsMutex.Unlock()
-			if !kk {
-				_, err := database.DB.Exec("UPDATE users SET is_online = FALSE WHERE id = ?", r)
-				if err != nil {
-					log.Printf("Failed to set user %s offline: %v", r, err)
-				}
-			}
-		}
-
 		if api.Lougout {
-			_, err2 := database.DB.Exec("UPDATE users SET is_online = FALSE WHERE id = ?", user.ID)
-			if err2 != nil {
-			}
-
+			// Closing the user's other connections ends their read loops,
+			// and each of them releases its own presence slot on the way out.
+			ClientsMutex.Lock()
 			for c := range Clients {
 				if c.UserID == user.ID {
 					c.Conn.Close()
 					delete(Clients, c)
-
 				}
 			}
-
+			ClientsMutex.Unlock()
 		}
 		api.Lougout = false
-		BroadcastOnlineUsers()
+
+		// The user goes offline even when shutdown cancelled the connection
+		teardown, cancel := frameContext(context.WithoutCancel(ctx))
+		defer cancel()
+		if last, err := OnlinePresence.Disconnect(user.ID); err != nil {
+			logger.Error("Failed to unregister connection", "error", err)
+		} else if last {
+			userDisconnected(teardown, user)
+		}
+		logger.Info("WebSocket disconnected")
 	}()
 
 	// Listen for messages
+	limiter := newRateLimiter()
 	for {
-
-		var msg struct {
-			Type    string          `json:"type"`
-			Payload json.RawMessage `json:"payload"`
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil && !draining.Load() {
+				logger.Info("WebSocket read failed", "error", err)
+			}
+			break
 		}
 
-		if err := conn.ReadJSON(&msg); err != nil {
-			log.Printf("WebSocket read error for user %s: %v", user.ID, err)
-			break
+		var req Envelope
+		if err := json.Unmarshal(data, &req); err != nil {
+			sendRequestError(client, req, protocolError(CodeBadPayload, "frames must be JSON envelopes"))
+			continue
 		}
-		switch msg.Type {
-		case "private_message":
-			var message struct {
-				ReceiverID string `json:"receiverId"`
-				Content    string `json:"content"`
-				MessageID  string `json:"messageId"`
-			}
-			if err := json.Unmarshal(msg.Payload, &message); err != nil {
-				log.Printf("Failed to unmarshal private message: %v", err)
-				continue
-			}
-			HandlePrivateMessage(client, user.ID, message.ReceiverID, message.Content, message.MessageID)
-		case "mark_read":
-			var readData struct {
-				SenderID  string `json:"senderId"`
-				MessageID string `json:"messageId"`
-			}
-			if err := json.Unmarshal(msg.Payload, &readData); err != nil {
-				log.Printf("Failed to unmarshal mark_read message: %v", err)
-				continue
-			}
-			HandleMarkRead(user.ID, readData.SenderID, readData.MessageID)
-		case "typing":
-			var typingData struct {
-				ReceiverID string `json:"receiverId"`
-			}
-			if err := json.Unmarshal(msg.Payload, &typingData); err != nil {
-				log.Printf("Failed to unmarshal typing message: %v", err)
-				continue
-			}
-			HandleTyping(client, user.ID, user.Nickname, typingData.ReceiverID)
-		case "stop_typing":
-			var typingData struct {
-				ReceiverID string `json:"receiverId"`
-			}
-			if err := json.Unmarshal(msg.Payload, &typingData); err != nil {
-				log.Printf("Failed to unmarshal stop_typing message: %v", err)
-				continue
+		frame, cancel := frameContext(ctx)
+		err = handleRequest(frame, client, user, limiter, req)
+		cancel()
+		if err != nil {
+			sendRequestError(client, req, err)
+			if perr, ok := err.(*ProtocolError); ok && perr.Code == CodeUnauthorized {
+				break
 			}
-			HandleStopTyping(client, user.ID, user.Nickname, typingData.ReceiverID)
-
+			continue
 		}
+		sendAck(client, req)
 	}
 }
 
-// BroadcastUserStatus sends user online/offline status to all connected clients.
-func BroadcastUserStatus(userID string, isOnline bool) {
-	message := map[string]interface{}{
-		"type":     "user_status",
-		"userId":   userID,
-		"isOnline": isOnline,
+// BroadcastPresence announces a single user's online/offline transition
+// (eventType is "user_online" or "user_offline") to all connected clients
+// except those in a block relation with the user.
+func BroadcastPresence(ctx context.Context, eventType string, user models.User) {
+	hidden, err := api.BlockedUserIDs(ctx, user.ID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load blocks", "presence_user_id", user.ID, "error", err)
 	}
+	except := make([]string, 0, len(hidden))
+	for id := range hidden {
+		except = append(except, id)
+	}
+	broadcast(newEvent(eventType, user), except...)
+}
 
-	ClientsMutex.Lock()
-	defer ClientsMutex.Unlock()
-
-	for client := range Clients {
-		if err := client.Conn.WriteJSON(message); err != nil {
-			log.Printf("Failed to broadcast user status to client %s: %v", client.UserID, err)
-			client.Conn.Close()
-			delete(Clients, client)
-		}
+// BroadcastOnlineUsers sends a list of all currently online users to every
+// online user, leaving out users each recipient is in a block relation with.
+func BroadcastOnlineUsers(ctx context.Context) {
+	users := onlineUsers(ctx)
+	for _, u := range users {
+		sendToUsers(newEvent("online_users", visibleUsers(ctx, u.ID, users)), u.ID)
 	}
 }
 
-// BroadcastOnlineUsers sends a list of all currently online users to all connected clients.
-func BroadcastOnlineUsers() {
-	rows, err := database.DB.Query("SELECT id, nickname FROM users WHERE is_online = TRUE")
+// SendOnlineUsers sends the current online users snapshot to a single client,
+// so a fresh connection starts from a full list and then follows the deltas.
+func SendOnlineUsers(ctx context.Context, client *models.Client) {
+	message := newEvent("online_users", visibleUsers(ctx, client.UserID, onlineUsers(ctx)))
+
+	sendToClient(client, message)
+}
+
+// visibleUsers filters out the users viewerID is in a block relation with.
+func visibleUsers(ctx context.Context, viewerID string, users []models.User) []models.User {
+	hidden, err := api.BlockedUserIDs(ctx, viewerID)
 	if err != nil {
-		log.Println("Failed to get online users:", err)
-		return
+		logging.FromContext(ctx).Error("Failed to load blocks", "viewer_id", viewerID, "error", err)
+		return users
 	}
-	defer rows.Close()
-
-	var onlineUsers []models.User
-	for rows.Next() {
-		var user models.User
-		if err := rows.Scan(&user.ID, &user.Nickname); err != nil {
-			log.Printf("Failed to scan user: %v", err)
-			continue
+	visible := make([]models.User, 0, len(users))
+	for _, u := range users {
+		if !hidden[u.ID] {
+			visible = append(visible, u)
 		}
-		onlineUsers = append(onlineUsers, user)
 	}
+	return visible
+}
 
-	message := map[string]interface{}{
-		"type":    "online_users",
-		"payload": onlineUsers,
+// SendUnreadSummary tells a freshly connected client what it missed while
+// offline, so unread badges are right before any conversation is opened.
+func SendUnreadSummary(ctx context.Context, client *models.Client) {
+	summary, err := api.LoadUnreadSummary(ctx, client.UserID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load unread summary", "error", err)
+		return
 	}
+	sendToClient(client, newEvent("unread_summary", summary))
+}
 
-	ClientsMutex.Lock()
-	defer ClientsMutex.Unlock()
-
-	for client := range Clients {
-		if err := client.Conn.WriteJSON(message); err != nil {
-			log.Printf("Failed to broadcast online users to client %s: %v", client.UserID, err)
-			client.Conn.Close()
-			delete(Clients, client)
-		}
+// onlineUsers resolves the presence registry into users with nicknames.
+func onlineUsers(ctx context.Context) []models.User {
+	onlineUsers := []models.User{}
+	ids, err := OnlinePresence.Online()
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to get online users", "error", err)
+		return onlineUsers
 	}
+	users, err := Stores.Users.ByIDs(ctx, ids)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to get online users", "error", err)
+		return onlineUsers
+	}
+	return users
 }
 
 // HandlePrivateMessage processes a private message from one user to another.
-func HandlePrivateMessage(client *models.Client, senderID, receiverID, content, clientMessageID string) {
+// attachmentIDs reference files the sender uploaded beforehand; a message
+// may consist of attachments only.
+//
+// An encrypted message carries e2ee ciphertext as its content and one key
+// envelope per device of both users. It is stored as is, and switches the
+// conversation to encryption for good: plaintext is refused from then on.
+func HandlePrivateMessage(ctx context.Context, client *models.Client, senderID, receiverID, content, clientMessageID string, attachmentIDs []string, encrypted bool, envelopes map[string]string) error {
 	messageID := uuid.New().String()
-	eroor := map[string]interface{}{
-		"type": "eroor",
-		"payload": map[string]interface{}{
-			"eroor": "try  a better message",
-		},
-	}
-	if len(content) > 100 || strings.TrimSpace(content) == "" {
-		client.Conn.WriteJSON(eroor)
-		return
+	if encrypted {
+		if !conf.Features.Encryption {
+			return protocolError(CodeForbidden, "end-to-end encryption is disabled on this server")
+		}
+		if err := e2ee.ValidateCiphertext(content, conf.Limits.MessageMax); err != nil {
+			return protocolError(CodeValidationFailed, err.Error())
+		}
+		if len(attachmentIDs) > 0 {
+			return protocolError(CodeValidationFailed, "attachments can't be end-to-end encrypted")
+		}
+	} else if len(attachmentIDs) > conf.Limits.AttachmentsPerMessage {
+		return protocolError(CodeValidationFailed, api.ErrTooManyAttachments.Error())
+	} else if len(content) > conf.Limits.MessageMax || (strings.TrimSpace(content) == "" && len(attachmentIDs) == 0) {
+		return protocolError(CodeValidationFailed, "try  a better message")
 	}
-	Contentformessage := models.Skip(content)
-	_, err := database.DB.Exec(`
-        INSERT INTO private_messages (id, sender_id, receiver_id, content, is_read)
-        VALUES (?, ?, ?, ?, ?)`,
-		messageID, senderID, receiverID, Contentformessage, false)
+	blocked, err := api.IsBlocked(ctx, senderID, receiverID)
 	if err != nil {
-		log.Println("Failed to save message:", err)
-		return
+		logging.FromContext(ctx).Error("Failed to check block", "receiver_id", receiverID, "error", err)
+		return errInternal
 	}
-
-	var senderNickname string
-	err = database.DB.QueryRow("SELECT nickname FROM users WHERE id = ?", senderID).Scan(&senderNickname)
+	if blocked {
+		return protocolError(CodeForbidden, "you can't message this user")
+	}
+	settings, err := api.LoadConversationSettings(ctx, senderID, receiverID)
 	if err != nil {
-		log.Printf("Failed to get sender nickname for user %s: %v", senderID, err)
-		return
+		logging.FromContext(ctx).Error("Failed to load conversation settings", "receiver_id", receiverID, "error", err)
+		return errInternal
+	}
+	timer := settings.DisappearingSeconds
+
+	Contentformessage := content
+	if encrypted {
+		err := api.CheckEnvelopes(ctx, senderID, receiverID, envelopes)
+		if err == api.ErrNoRecipientKeys || err == e2ee.ErrInvalidEnvelope {
+			return protocolError(CodeValidationFailed, err.Error())
+		} else if err == api.ErrKeysChanged {
+			return protocolError(CodeKeysChanged, err.Error())
+		} else if err != nil {
+			logging.FromContext(ctx).Error("Failed to check key envelopes", "receiver_id", receiverID, "error", err)
+			return errInternal
+		}
+	} else {
+		if settings.Encrypted {
+			return protocolError(CodeForbidden, api.ErrEncryptedConversation.Error())
+		}
+		Contentformessage = models.Skip(content)
+	}
+
+	// The timer in force when the message is sent decides when it disappears
+	var expiresAt *time.Time
+	if timer > 0 {
+		t := time.Now().Add(time.Duration(timer) * time.Second).UTC()
+		expiresAt = &t
+	}
+	sent, err := Stores.Messages.SendPrivate(ctx, store.NewPrivateMessage{
+		ID:                  messageID,
+		SenderID:            senderID,
+		ReceiverID:          receiverID,
+		Content:             Contentformessage,
+		DisappearingSeconds: timer,
+		Encrypted:           encrypted,
+		Envelopes:           envelopes,
+		AttachmentIDs:       attachmentIDs,
+	})
+	if err == store.ErrAttachmentNotFound {
+		return protocolError(CodeNotFound, err.Error())
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Failed to save message", "message_id", messageID, "error", err)
+		return errInternal
+	}
+	messagesSent.Inc("private")
+
+	sender, err := Stores.Users.ByID(ctx, senderID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to load sender", "error", err)
+		return errInternal
+	}
+
+	// Goes to every connection of both users, including all of the sender's tabs
+	sendToUsers(newEvent("private_message", map[string]interface{}{
+		"messageId":       messageID,
+		"clientMessageId": clientMessageID,
+		"senderId":        senderID,
+		"senderName":      sender.Nickname,
+		"receiverId":      receiverID,
+		"content":         Contentformessage,
+		"attachments":     api.Attachments(sent.Attachments),
+		"timestamp":       time.Now().Format(time.RFC3339),
+		"isRead":          false,
+		"expiresAt":       expiresAt,
+		"isEncrypted":     encrypted,
+		"envelopes":       envelopes,
+	}), receiverID, senderID)
+
+	if sent.SwitchedToEncryption {
+		if settings, err := api.LoadConversationSettings(ctx, senderID, receiverID); err == nil {
+			api.NotifyConversationSettings(senderID, receiverID, settings)
+		}
 	}
+	return nil
+}
 
-	message := map[string]interface{}{
-		"type": "private_message",
-		"payload": map[string]interface{}{
-			"messageId":       messageID,
-			"clientMessageId": clientMessageID,
-			"senderId":        senderID,
-			"senderName":      senderNickname,
-			"receiverId":      receiverID,
-			"content":         Contentformessage,
-			"timestamp":       time.Now().Format(time.RFC3339),
-			"isRead":          false,
-		},
-	}
-	ofsset := map[string]interface{}{
-		"type": "offset",
-		"payload": map[string]interface{}{
-			"messageId":       messageID,
-			"clientMessageId": clientMessageID,
-			"senderId":        senderID,
-			"senderName":      senderNickname,
-			"receiverId":      receiverID,
-			"content":         Contentformessage,
-			"timestamp":       time.Now().Format(time.RFC3339),
-			"isRead":          false,
-		},
+// HandleMarkRead marks a single message as read and tells both the sender
+// and the reader's own connections, so every tab drops the unread badge.
+func HandleMarkRead(ctx context.Context, receiverID, senderID, messageID string) error {
+	marked, err := Stores.Messages.MarkRead(ctx, messageID, senderID, receiverID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to mark message read", "message_id", messageID, "error", err)
+		return errInternal
+	}
+	if !marked {
+		return nil
 	}
 
-	ClientsMutex.Lock()
-	defer ClientsMutex.Unlock()
+	sendToUsers(newEvent("message_read", map[string]interface{}{
+		"messageId":  messageID,
+		"senderId":   senderID,
+		"receiverId": receiverID,
+	}), senderID, receiverID)
+	return nil
+}
 
-	// Send to all connections of the receiver
-	for c := range Clients {
-		if c.UserID == receiverID {
-			if err := c.Conn.WriteJSON(message); err != nil {
-				log.Printf("Failed to send message to client %s: %v", c.UserID, err)
-				c.Conn.Close()
-				delete(Clients, c)
-			}
-		}
+// HandleMarkReadUntil marks every message senderID sent to receiverID up to
+// and including messageID as read in one statement, then sends the new read
+// state to both users' connections.
+func HandleMarkReadUntil(ctx context.Context, receiverID, senderID, messageID string) error {
+	count, err := Stores.Messages.MarkReadUntil(ctx, messageID, senderID, receiverID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to mark messages read", "until_message_id", messageID, "error", err)
+		return errInternal
+	}
+	if count == 0 {
+		return nil
 	}
 
-	// Send to all connections of the sender (including all their tabs)
-	for c := range Clients {
-		if c.UserID == senderID {
-			if err := c.Conn.WriteJSON(message); err != nil {
-				log.Printf("Failed to send message to sender %s: %v", senderID, err)
-				c.Conn.Close()
-				delete(Clients, c)
-			}
-		}
+	sendToUsers(newEvent("messages_read", map[string]interface{}{
+		"messageId":  messageID,
+		"senderId":   senderID,
+		"receiverId": receiverID,
+		"count":      count,
+	}), senderID, receiverID)
+	return nil
+}
+
+// HandleTyping sends a typing event to the receiver, unless either of them blocked the other.
+func HandleTyping(ctx context.Context, client *models.Client, senderID, senderNickname, receiverID string) error {
+	return sendTyping(ctx, "typing", senderID, senderNickname, receiverID)
+}
+
+// HandleStopTyping sends a stop typing event to the receiver, unless either of them blocked the other.
+func HandleStopTyping(ctx context.Context, client *models.Client, senderID, senderNickname, receiverID string) error {
+	return sendTyping(ctx, "stop_typing", senderID, senderNickname, receiverID)
+}
+
+// sendTyping delivers a typing or stop_typing event to the receiver's connections.
+func sendTyping(ctx context.Context, eventType, senderID, senderNickname, receiverID string) error {
+	blocked, err := api.IsBlocked(ctx, senderID, receiverID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Failed to check block", "receiver_id", receiverID, "error", err)
+		return errInternal
 	}
-	for c := range Clients {
-		if c.UserID == senderID {
-			if err := c.Conn.WriteJSON(ofsset); err != nil {
-				log.Printf("Failed to send message to sender %s: %v", senderID, err)
-				c.Conn.Close()
-				delete(Clients, c)
-			}
-		}
+	if blocked {
+		return nil
 	}
-	for c := range Clients {
-		if c.UserID == receiverID {
-			if err := c.Conn.WriteJSON(ofsset); err != nil {
-				log.Printf("Failed to send message to client %s: %v", c.UserID, err)
-				c.Conn.Close()
-				delete(Clients, c)
-			}
-		}
+
+	sendToUsers(newEvent(eventType, map[string]interface{}{
+		"senderId":   senderID,
+		"senderName": senderNickname,
+		"receiver":   receiverID,
+	}), receiverID)
+	return nil
+}
+
+// NotifyUsers sends an event to every connection of the given users.
+// main wires it into api.NotifyUsers so HTTP handlers can push updates.
+func NotifyUsers(userIDs []string, eventType string, payload interface{}) {
+	sendToUsers(newEvent(eventType, payload), userIDs...)
+}
+
+// sendToUsers publishes message to every connection, on any instance, that
+// belongs to one of userIDs.
+func sendToUsers(message interface{}, userIDs ...string) {
+	if len(userIDs) == 0 {
+		return
 	}
+	publish(broker.Message{UserIDs: userIDs}, message)
 }
 
-// HandleMarkRead marks a message as read in the database and notifies the sender.
-func HandleMarkRead(receiverID, senderID, messageID string) {
-	_, err := database.DB.Exec(`
-        UPDATE private_messages SET is_read = TRUE
-        WHERE id = ? AND sender_id = ? AND receiver_id = ? AND is_read = FALSE`,
-		messageID, senderID, receiverID)
+// broadcast publishes message to every connected user except the given ones.
+func broadcast(message interface{}, except ...string) {
+	publish(broker.Message{Except: except}, message)
+}
+
+// publish encodes message as msg's event and hands it to the broker.
+func publish(msg broker.Message, message interface{}) {
+	event, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Failed to mark message %s as read: %v", messageID, err)
+		slog.Error("Failed to encode event", "error", err)
 		return
 	}
-
-	readMessage := map[string]interface{}{
-		"type": "message_read",
-		"payload": map[string]interface{}{
-			"messageId":  messageID,
-			"senderId":   senderID,
-			"receiverId": receiverID,
-		},
+	msg.Event = event
+	if err := Broker.Publish(msg); err != nil {
+		slog.Error("Failed to publish event", "error", err)
 	}
+}
 
-	ClientsMutex.Lock()
-	defer ClientsMutex.Unlock()
+// deliver writes a published message to the matching connections of this instance.
+func deliver(msg broker.Message) {
+	start := time.Now()
+	defer func() { fanoutDuration.Observe(time.Since(start).Seconds()) }()
 
-	// Notify sender
-	for client := range Clients {
-		if client.UserID == senderID {
-			if err := client.Conn.WriteJSON(readMessage); err != nil {
-				log.Printf("Failed to notify sender %s of read status: %v", senderID, err)
-				client.Conn.Close()
-				delete(Clients, client)
-			}
-		}
+	targets := make(map[string]bool, len(msg.UserIDs))
+	for _, id := range msg.UserIDs {
+		targets[id] = true
+	}
+	except := make(map[string]bool, len(msg.Except))
+	for _, id := range msg.Except {
+		except[id] = true
 	}
-}
 
-// HandleTyping sends a typing event to the receiver.
-func HandleTyping(client *models.Client, senderID, senderNickname, receiverID string) {
 	ClientsMutex.Lock()
 	defer ClientsMutex.Unlock()
 
 	for c := range Clients {
-		if c.UserID == receiverID {
-			err := c.Conn.WriteJSON(struct {
-				Type    string `json:"type"`
-				Payload struct {
-					Sender     string `json:"senderId"`
-					SenderName string `json:"senderName"`
-					Receiver   string `json:"receiver"`
-				} `json:"payload"`
-			}{
-				Type: "typing",
-				Payload: struct {
-					Sender     string `json:"senderId"`
-					SenderName string `json:"senderName"`
-					Receiver   string `json:"receiver"`
-				}{
-					Sender:     senderID,
-					SenderName: senderNickname,
-					Receiver:   receiverID,
-				},
-			})
-			if err != nil {
-				log.Printf("Failed to send typing event to user %s: %v", receiverID, err)
-				c.Conn.Close()
-				delete(Clients, c)
-			}
+		if (len(targets) > 0 && !targets[c.UserID]) || except[c.UserID] {
+			continue
+		}
+		if err := c.Conn.WriteMessage(websocket.TextMessage, msg.Event); err != nil {
+			slog.Warn("Failed to write to connection", "conn_id", c.ID, "user_id", c.UserID, "error", err)
+			c.Conn.Close()
+			delete(Clients, c)
 		}
 	}
 }
 
-// HandleStopTyping sends a stop typing event to the receiver.
-func HandleStopTyping(client *models.Client, senderID, senderNickname, receiverID string) {
+// sendToClient writes message to a single connection.
+func sendToClient(client *models.Client, message interface{}) {
 	ClientsMutex.Lock()
 	defer ClientsMutex.Unlock()
 
-	for c := range Clients {
-		if c.UserID == receiverID {
-			err := c.Conn.WriteJSON(struct {
-				Type    string `json:"type"`
-				Payload struct {
-					SenderID   string `json:"senderId"`
-					SenderName string `json:"senderName"`
-					Receiver   string `json:"receiver"`
-				} `json:"payload"`
-			}{
-				Type: "stop_typing",
-				Payload: struct {
-					SenderID   string `json:"senderId"`
-					SenderName string `json:"senderName"`
-					Receiver   string `json:"receiver"`
-				}{
-					SenderID:   senderID,
-					SenderName: senderNickname,
-					Receiver:   receiverID,
-				},
-			})
-			if err != nil {
-				log.Printf("Failed to send stop_typing event to user %s: %v", receiverID, err)
-				c.Conn.Close()
-				delete(Clients, c)
-			}
-		}
+	if err := client.Conn.WriteJSON(message); err != nil {
+		slog.Warn("Failed to write to connection", "conn_id", client.ID, "user_id", client.UserID, "error", err)
+		client.Conn.Close()
+		delete(Clients, client)
 	}
 }
 
@@ -485,12 +542,10 @@ func authenticateUser(r *http.Request) (string, error) {
 		return "", err
 	}
 
-	var userID string
-	err = database.DB.QueryRow("SELECT id FROM users WHERE token = ?", cookie.Value).Scan(&userID)
+	userID, err := Stores.Sessions.UserID(r.Context(), cookie.Value)
 	if err != nil {
-		// fmt.Println(err)
 		return "", err
 	}
-
+	logging.SetUser(r.Context(), userID)
 	return userID, nil
 }
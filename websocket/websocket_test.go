@@ -0,0 +1,242 @@
+package websocket
+
+import (
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"jj/api"
+	"jj/broker"
+	"jj/config"
+	"jj/database"
+	"jj/e2ee"
+	"jj/store"
+	"jj/store/sqlstore"
+)
+
+// useTestStore points the hub and the API at a fresh SQLite database.
+func useTestStore(t *testing.T) store.Store {
+	t.Helper()
+	cfg := config.Default().Database
+	cfg.Path = filepath.Join(t.TempDir(), "forum.db")
+	if err := database.InitDB(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.CloseDB)
+	if err := database.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := sqlstore.New(database.DB, database.Writer, database.Current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevWS, prevAPI := Stores, api.Stores
+	Stores, api.Stores = st, st
+	t.Cleanup(func() { Stores, api.Stores = prevWS, prevAPI })
+	return st
+}
+
+// publishKey publishes a new device key for userID and returns its key ID
+// and public key.
+func publishKey(t *testing.T, st store.Store, userID, deviceID string) (string, *ecdh.PublicKey) {
+	t.Helper()
+	key, err := e2ee.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := st.Keys.Publish(context.Background(), store.DeviceKey{
+		ID:        userID + "-" + deviceID,
+		UserID:    userID,
+		DeviceID:  deviceID,
+		PublicKey: e2ee.EncodePublicKey(key.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.ID, key.PublicKey()
+}
+
+// createUsers creates a user for each ID, which doubles as the nickname.
+func createUsers(t *testing.T, st store.Store, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		err := st.Users.Create(context.Background(), store.NewUser{ID: id, Nickname: id, Email: id + "@example.com", PasswordHash: "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sendPlaintext sends a plaintext message from alice to bob and returns
+// its ID.
+func sendPlaintext(t *testing.T, st store.Store) string {
+	t.Helper()
+	ctx := context.Background()
+	if err := HandlePrivateMessage(ctx, nil, "alice", "bob", "hello", "", nil, false, nil); err != nil {
+		t.Fatalf("plaintext message: %v", err)
+	}
+	sent, err := st.Messages.ListPrivate(ctx, "alice", "bob", 1, 0)
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("ListPrivate: %v, %d messages", err, len(sent))
+	}
+	return sent[0].ID
+}
+
+// errorCode returns the protocol error code of err, or "" when err is nil.
+func errorCode(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %v, want a protocol error", err)
+	}
+	return perr.Code
+}
+
+func TestEncryptedConversationRefusesDowngrade(t *testing.T) {
+	st := useTestStore(t)
+	ctx := context.Background()
+	createUsers(t, st, "alice", "bob")
+	devices := make(map[string]*ecdh.PublicKey)
+	for _, d := range []struct{ user, device string }{{"alice", "laptop"}, {"bob", "phone"}} {
+		id, pub := publishKey(t, st, d.user, d.device)
+		devices[id] = pub
+	}
+	encrypt := func(devices map[string]*ecdh.PublicKey) (string, map[string]string) {
+		ciphertext, envelopes, err := e2ee.Encrypt([]byte("hello"), devices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ciphertext, envelopes
+	}
+
+	// Plaintext is fine until the first encrypted message
+	plaintextID := sendPlaintext(t, st)
+	ciphertext, envelopes := encrypt(devices)
+	if code := errorCode(t, HandlePrivateMessage(ctx, nil, "alice", "bob", ciphertext, "", nil, true, envelopes)); code != "" {
+		t.Fatalf("encrypted message: %s", code)
+	}
+
+	// From then on, neither user can go back to plaintext
+	for _, sender := range []string{"alice", "bob"} {
+		receiver := map[string]string{"alice": "bob", "bob": "alice"}[sender]
+		err := HandlePrivateMessage(ctx, nil, sender, receiver, "hello", "", nil, false, nil)
+		if code := errorCode(t, err); code != CodeForbidden {
+			t.Errorf("plaintext from %s after encryption: %q, want %q", sender, code, CodeForbidden)
+		}
+	}
+
+	// Nor edit a message sent before the switch, though it is recent enough
+	if code := errorCode(t, HandleEditMessage(ctx, nil, "alice", plaintextID, "hello again")); code != CodeForbidden {
+		t.Errorf("editing a pre-encryption message: %q, want %q", code, CodeForbidden)
+	}
+
+	// Bob adds a tablet: envelopes for the old device set no longer match
+	tabletID, tablet := publishKey(t, st, "bob", "tablet")
+	ciphertext, stale := encrypt(devices)
+	if code := errorCode(t, HandlePrivateMessage(ctx, nil, "alice", "bob", ciphertext, "", nil, true, stale)); code != CodeKeysChanged {
+		t.Errorf("missing envelope: %q, want %q", code, CodeKeysChanged)
+	}
+
+	withTablet := map[string]*ecdh.PublicKey{tabletID: tablet}
+	for id, pub := range devices {
+		withTablet[id] = pub
+	}
+	ciphertext, envelopes = encrypt(withTablet)
+	wrong := make(map[string]string)
+	for id, envelope := range envelopes {
+		if id == tabletID {
+			id = "bob-revoked"
+		}
+		wrong[id] = envelope
+	}
+	if code := errorCode(t, HandlePrivateMessage(ctx, nil, "alice", "bob", ciphertext, "", nil, true, wrong)); code != CodeKeysChanged {
+		t.Errorf("envelope for an unknown device: %q, want %q", code, CodeKeysChanged)
+	}
+
+	if code := errorCode(t, HandlePrivateMessage(ctx, nil, "alice", "bob", ciphertext, "", nil, true, envelopes)); code != "" {
+		t.Errorf("envelopes for every current device: %s", code)
+	}
+}
+
+func TestEditAndDeleteMissingMessage(t *testing.T) {
+	st := useTestStore(t)
+	ctx := context.Background()
+	createUsers(t, st, "alice", "bob")
+	messageID := sendPlaintext(t, st)
+
+	// Someone else's message is as missing as an unknown one
+	for _, tt := range []struct{ userID, messageID string }{{"alice", "unknown"}, {"bob", messageID}} {
+		if code := errorCode(t, HandleEditMessage(ctx, nil, tt.userID, tt.messageID, "edited")); code != CodeNotFound {
+			t.Errorf("edit %s as %s: %q, want %q", tt.messageID, tt.userID, code, CodeNotFound)
+		}
+		if code := errorCode(t, HandleDeleteMessage(ctx, nil, tt.userID, tt.messageID)); code != CodeNotFound {
+			t.Errorf("delete %s as %s: %q, want %q", tt.messageID, tt.userID, code, CodeNotFound)
+		}
+	}
+
+	if err := HandleEditMessage(ctx, nil, "alice", messageID, "edited"); err != nil {
+		t.Errorf("edit own message: %v", err)
+	}
+	if err := HandleDeleteMessage(ctx, nil, "alice", messageID); err != nil {
+		t.Errorf("delete own message: %v", err)
+	}
+	if code := errorCode(t, HandleEditMessage(ctx, nil, "alice", messageID, "again")); code != CodeNotFound {
+		t.Errorf("edit a deleted message: %q, want %q", code, CodeNotFound)
+	}
+}
+
+func TestReactionLimit(t *testing.T) {
+	st := useTestStore(t)
+	ctx := context.Background()
+	createUsers(t, st, "alice", "bob")
+	messageID := sendPlaintext(t, st)
+
+	emoji := []string{"👍", "👎", "😀", "😂", "😍", "😢", "😮", "😡", "🎉", "🔥"}
+	for _, e := range emoji {
+		if err := HandleReaction(ctx, nil, "bob", messageID, e, true); err != nil {
+			t.Fatalf("react %s: %v", e, err)
+		}
+	}
+	// At the limit, repeating a reaction is still fine; a new one is not
+	if err := HandleReaction(ctx, nil, "bob", messageID, emoji[0], true); err != nil {
+		t.Errorf("repeat %s at the limit: %v", emoji[0], err)
+	}
+	if code := errorCode(t, HandleReaction(ctx, nil, "bob", messageID, "💯", true)); code != CodeValidationFailed {
+		t.Errorf("new emoji at the limit: %q, want %q", code, CodeValidationFailed)
+	}
+	// The limit is per user
+	if err := HandleReaction(ctx, nil, "alice", messageID, "💯", true); err != nil {
+		t.Errorf("alice reacts: %v", err)
+	}
+}
+
+// recordingBroker remembers whether it has a subscriber.
+type recordingBroker struct {
+	broker.Local
+	subscribed bool
+}
+
+func (b *recordingBroker) Subscribe(deliver func(broker.Message)) {
+	b.subscribed = deliver != nil
+	b.Local.Subscribe(deliver)
+}
+
+func TestUseBrokerUnsubscribesPrevious(t *testing.T) {
+	prevBroker, prevPresence := Broker, OnlinePresence
+	t.Cleanup(func() { UseBroker(prevBroker, prevPresence) })
+
+	first, second := &recordingBroker{}, &recordingBroker{}
+	UseBroker(first, broker.NewLocalPresence())
+	if !first.subscribed {
+		t.Fatal("UseBroker didn't subscribe to the broker")
+	}
+	UseBroker(second, broker.NewLocalPresence())
+	if first.subscribed || !second.subscribed {
+		t.Errorf("after switching brokers: first subscribed %v, second %v; want false, true", first.subscribed, second.subscribed)
+	}
+}